@@ -1,19 +1,29 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"math/rand"
+	"runtime"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/timcki/learncoin/internal/chain"
 	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/mempool"
 	"github.com/timcki/learncoin/internal/transaction"
 )
 
 const RINGSIZE = 8
 
+// Maximum number of inputs spent by a single transaction
+const MAXINPUTS = 3
+
+// Utxo amounts are multiples of a cent
+const cent = transaction.AtomicUnitsPerCoin / 100
+
+// Fee paid by every transaction
+const FEE = cent / 10
+
 var trueFalse = map[bool]string{
 	true:  color.GreenString("✓"),
 	false: color.RedString("𐄂"),
@@ -24,20 +34,19 @@ type ChainSimulation struct {
 	Addr        []transaction.Address
 	utxoSet     chain.UtxoSet
 	utxoForAddr map[int][]crypto.FixedHash
-	keyImages   [][]byte
-	utxoValue   float32
+	utxoValue   transaction.Amount
+	// Picks decoys from the outputs of the chain
+	decoys *transaction.DecoySelector
 
 	// Chain
-	Chain chain.Chain
+	Chain *chain.Chain
 }
 
 func NewChainSimulation(addrQuant int, utxoSetSize int) *ChainSimulation {
 	chainSim := ChainSimulation{
 		utxoSet:     chain.NewUtxoSet(),
 		utxoForAddr: make(map[int][]crypto.FixedHash),
-		Chain:       *chain.NewChain(),
-		utxoValue:   float32(rand.Intn(utxoSetSize)/10) / 100,
-		keyImages:   make([][]byte, 0),
+		utxoValue:   transaction.Amount(rand.Intn(utxoSetSize/10)+1) * cent,
 	}
 	var addr []transaction.Address
 	rand.Seed(time.Now().Unix())
@@ -47,24 +56,44 @@ func NewChainSimulation(addrQuant int, utxoSetSize int) *ChainSimulation {
 		addr = append(addr, a)
 	}
 	fmt.Printf("Randomized %d addresses...\n", addrQuant)
-	// Randomly generate starting utxo set
+	// Randomly generate starting utxo set, it's allocated by the genesis block
+	params := chain.DefaultParams
 	for i := 0; i < utxoSetSize; i++ {
 		// Choose random address to generate one time key from
 		randAddr := rand.Intn(addrQuant)
-		dest, err := addr[randAddr].NewDestinationAddress()
+		// Random value in (0, utxoSetSize/1000)
+		amt := transaction.Amount(rand.Int63n(int64(chainSim.utxoValue/cent))) * cent
+		utxo, _, err := addr[randAddr].NewOutput(amt)
 		if err != nil {
 			panic(err)
 		}
-		// Random value in (0, utxoSetSize/1000)
-		amt := float32(rand.Intn(int(chainSim.utxoValue*100))) / 100
-		utxo := transaction.NewUtxo(amt, dest)
 		chainSim.utxoSet.Add(*utxo)
+		params.GenesisOutputs = append(params.GenesisOutputs, *utxo)
 	}
 	fmt.Printf("Randomized %d utxos for those addresses...\n", utxoSetSize)
 	chainSim.Addr = addr
+	c, err := chain.NewChainWithStore(chain.NewMemoryStore(), params)
+	if err != nil {
+		panic(err)
+	}
+	chainSim.Chain = c
+	decoys, err := transaction.NewDecoySelector(c, RINGSIZE)
+	if err != nil {
+		panic(err)
+	}
+	chainSim.decoys = decoys
 	return &chainSim
 }
 
+// mineBlock mines a block with the transactions on top of the chain
+func (sim *ChainSimulation) mineBlock(miner *chain.Miner, txns []transaction.Transaction) (*chain.Block, error) {
+	block := sim.Chain.NewBlockTemplate(txns)
+	start := time.Now()
+	miner.MineBlock(block, nil)
+	fmt.Printf("Mined block with %d workers in %v\n", miner.Workers(), time.Since(start))
+	return block, sim.Chain.AddBlock(block)
+}
+
 func (sim *ChainSimulation) RandomTxn() *transaction.Transaction {
 	// Choose address at random
 	a := rand.Intn(len(sim.Addr))
@@ -75,32 +104,29 @@ func (sim *ChainSimulation) RandomTxn() *transaction.Transaction {
 		fmt.Printf("Found %d linked utxos for addr: %s\n", num, humanReadable)
 	}
 
-	// Pick random utxo and address to perform transaction
-	// Utxo
-	randUtxoNum := rand.Intn(len(sim.utxoForAddr[a]))
-	trueUtxoHash := sim.utxoForAddr[a][randUtxoNum]
-	trueUtxo := sim.utxoSet.Get(trueUtxoHash)
-
-	decoyUtxos := make([]transaction.Utxo, 0)
-
-	// Pick RINGSIZE-1 other txns with same amount
-	trueHash, _ := trueUtxo.Hash()
-
-	// There is a possibility that we'll find less than target ringsize
-	// that's acceptable and we should continue as long as ringsize > 0
-	for _, utxo := range sim.utxoSet.GetUtxos() {
-		if len(decoyUtxos) == RINGSIZE-1 {
-			break
+	// Pick up to MAXINPUTS random utxos to spend, consolidating them
+	// into a single output and change
+	numInputs := rand.Intn(MAXINPUTS) + 1
+	if numInputs > len(sim.utxoForAddr[a]) {
+		numInputs = len(sim.utxoForAddr[a])
+	}
+	trueUtxos := make([]transaction.Utxo, 0, numInputs)
+	decoyUtxos := make([][]transaction.Utxo, 0, numInputs)
+	var trueAmount transaction.Amount
+	for _, i := range rand.Perm(len(sim.utxoForAddr[a]))[:numInputs] {
+		trueUtxo := sim.utxoSet.Get(sim.utxoForAddr[a][i])
+		amount, _, err := addr.OpenUtxo(*trueUtxo)
+		if err != nil {
+			continue
 		}
-		decoyHash, _ := utxo.Hash()
-		if utxo.Amount == trueUtxo.Amount && bytes.Compare(trueHash, decoyHash) != 0 {
-			decoyUtxos = append(decoyUtxos, *utxo)
+		decoys, err := sim.decoys.SelectDecoys(*trueUtxo)
+		if err != nil {
+			fmt.Printf("Failed to pick decoys: %v, skipping\n", err)
+			return nil
 		}
-
-	}
-	if len(decoyUtxos) == 0 {
-		fmt.Println("Not enough utxos with mirror amount, skipping")
-		return nil
+		trueUtxos = append(trueUtxos, *trueUtxo)
+		decoyUtxos = append(decoyUtxos, decoys)
+		trueAmount += amount
 	}
 
 	// Address
@@ -116,30 +142,39 @@ func (sim *ChainSimulation) RandomTxn() *transaction.Transaction {
 	fmt.Println("Picked random destination address...")
 
 	// Pick a random amount for the transaction
-	randomAmount := float32(rand.Intn(int(trueUtxo.Amount)*100)) / 100
-	txn := addr.NewTransaction(append(decoyUtxos, *trueUtxo), randomAmount, addr2)
-	fmt.Println("Created new transaction...")
+	if len(trueUtxos) == 0 || trueAmount < FEE {
+		fmt.Println("Utxos can't cover the fee, skipping")
+		return nil
+	}
+	randomAmount := transaction.Amount(rand.Int63n(int64(trueAmount-FEE) + 1))
+	txn, err := addr.NewTransaction(trueUtxos, decoyUtxos, randomAmount, FEE, addr2, sim.Chain)
+	if err != nil {
+		fmt.Printf("Failed to create transaction: %v\n", err)
+		return nil
+	}
+	fmt.Printf("Created new transaction with %d inputs sending %s...\n", len(trueUtxos), randomAmount)
 
-	fmt.Println("Computing ring signature for transaction with:")
-	fmt.Printf("  Real utxo:    %s", trueUtxo.Bytes())
-	for i, u := range decoyUtxos {
-		fmt.Printf("  Decoy utxo %d: %s", i, u.Bytes())
+	fmt.Println("Computing ring signatures for transaction with:")
+	for i, trueUtxo := range trueUtxos {
+		fmt.Printf("  Input %d real utxo:    %x\n", i, trueUtxo.Bytes())
+		for j, u := range decoyUtxos[i] {
+			fmt.Printf("  Input %d decoy utxo %d: %x\n", i, j, u.Bytes())
+		}
 	}
 
+	// Sign every input with its ring
+	if err := addr.SignTransaction(&txn, trueUtxos); err != nil {
+		fmt.Printf("Failed to sign transaction: %v\n", err)
+		return nil
+	}
 	// Message is the byte representation of our txn
-	message := txn.Bytes()
-
-	// Sign the message with trueUtxo+decoyUtxos
-	ringSig := addr.NewRingSignature(*trueUtxo, decoyUtxos, message)
+	message := txn.SignatureMessage()
 	fmt.Println("\nSigned byte representation of transaction")
 	fmt.Printf("%s:\n", color.BlueString("Ring signature validation"))
-	fmt.Printf("  Transaction:  %v\n", trueFalse[ringSig.CheckSignatureValidity(message)])
-	fmt.Printf("  Fake message: %v\n", trueFalse[ringSig.CheckSignatureValidity([]byte("Fake"))])
-
-	// Assign the ring signature to our txns
-	txn.Sigature = ringSig
-	// Append of txn to the used key images set to prevent double spending
-	sim.keyImages = append(sim.keyImages, ringSig.Image)
+	for i, in := range txn.Inputs {
+		fmt.Printf("  Input %d transaction:  %v\n", i, trueFalse[in.Signature.Verify(message, in.PseudoOutput)])
+		fmt.Printf("  Input %d fake message: %v\n", i, trueFalse[in.Signature.Verify([]byte("Fake"), in.PseudoOutput)])
+	}
 	return &txn
 }
 
@@ -166,25 +201,41 @@ func main() {
 	fmt.Printf("\n\n====== %s ======\n\n", color.BlueString("Generating new chain simulation"))
 	sim := NewChainSimulation(1000, 150000)
 
-	mempool := make([]crypto.Hashable, 0)
+	miner := chain.NewMiner(runtime.NumCPU())
+	// Outputs can only be ring members once they're buried deep enough
+	fmt.Printf("\n\n====== %s ======\n\n", color.BlueString("Mining blocks until the genesis outputs mature"))
+	for sim.Chain.NumOutputs() == 0 {
+		if _, err := sim.mineBlock(miner, nil); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Printf("%s: %d\n", color.BlueString("Chain length"), sim.Chain.Length())
+
+	pool := mempool.NewMempool(sim.Chain)
 	for {
 		fmt.Printf("\n==== %s ====\n", color.BlueString("Simulating transaction"))
 		txn := sim.RandomTxn()
 		if txn != nil {
 			fmt.Printf("Signed transaction: %s\n", txn.PrettyPrint())
-			mempool = append(mempool, txn)
+			// The mempool rejects double spends of the chain and of its other txns
+			if err := pool.Add(*txn); err != nil {
+				fmt.Printf("%s: %v\n", color.RedString("Transaction rejected from mempool"), err)
+			}
 		}
-		// Construct block with 50% prob if more than two txns
-		if len(mempool) > 2 && rand.Intn(2) < 1 {
+		// Mine a block if more than two txns
+		if pool.Len() > 2 {
 			fmt.Printf("\n\n====== %s ======\n\n", color.BlueString("Constructing block from transactions"))
-			block := chain.NewBlock(mempool)
-			sim.Chain.AddBlock(block)
-			fmt.Printf("%s\n", color.BlueString("Added block to chain"))
-			fmt.Printf("%s: %s\n", color.YellowString("header"), block.Header.PrettyPrint())
-			fmt.Printf("%s:\n%s\n", color.YellowString("txns"), block.Transactions.PrettyPrint())
+			if block, err := sim.mineBlock(miner, pool.Transactions()); err != nil {
+				fmt.Printf("%s: %v\n", color.RedString("Failed to add block"), err)
+			} else {
+				pool.RemoveBlock(block)
+				tree, _ := block.MerkleTree()
+				fmt.Printf("%s\n", color.BlueString("Added block to chain"))
+				fmt.Printf("%s: %s\n", color.YellowString("header"), block.Header.PrettyPrint())
+				fmt.Printf("%s:\n%s\n", color.YellowString("txns"), tree.PrettyPrint())
+			}
 			fmt.Printf("\n%s: %d\n", color.BlueString("Chain length"), sim.Chain.Length())
-			fmt.Printf("%s\n", color.BlueString("Clearing mempool"))
-			mempool = make([]crypto.Hashable, 0)
+			fmt.Printf("%s: %d\n", color.BlueString("Transactions left in mempool"), pool.Len())
 		}
 		time.Sleep(time.Second * 2)
 	}
@@ -1,16 +1,21 @@
 package main
 
 import (
-	"encoding/gob"
 	"encoding/json"
 	"math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 
 	log "github.com/inconshreveable/log15"
+	"github.com/timcki/learncoin/internal/addrmgr"
+	"github.com/timcki/learncoin/internal/chain"
 	"github.com/timcki/learncoin/internal/config"
 	"github.com/timcki/learncoin/internal/constants"
-	"github.com/timcki/learncoin/internal/messages"
+	"github.com/timcki/learncoin/internal/mempool"
 	"github.com/timcki/learncoin/internal/node"
 	"github.com/timcki/learncoin/internal/transaction"
 )
@@ -34,17 +39,6 @@ func testMerkleTree() {
 }
 */
 
-func initGob() {
-	gob.Register(messages.VersionMessage{})
-	gob.Register(messages.VerAckMessage{})
-
-	gob.Register(messages.PingMessage{})
-	gob.Register(messages.PongMessage{})
-
-	gob.Register(messages.GetAddrMessage{})
-	gob.Register(messages.AddrMessage{})
-}
-
 func testCrypto() {
 	logger := log.New()
 	address, err := transaction.NewAddress()
@@ -55,8 +49,56 @@ func testCrypto() {
 	logger.Info(address.PubKey.ToHumanReadable(false))
 }
 
+// mine keeps extending the tip of the chain with newly mined blocks
+// including the transactions waiting in the mempool. A block from another
+// node makes the template stale, so mining starts over on the new tip
+func mine(c *chain.Chain, pool *mempool.Mempool, n *node.Node, miner *chain.Miner, logger log.Logger) {
+	for {
+		// Taken before the template so a tip change in between isn't missed
+		quit := c.TipChanged()
+		block := c.NewBlockTemplate(pool.Transactions())
+		if !miner.MineBlock(block, quit) {
+			logger.Debug("Tip changed, restarting mining")
+			continue
+		}
+		if err := n.SubmitBlock(block); err != nil {
+			logger.Warn("Mined block got rejected", "err", err)
+			continue
+		}
+		hash, _ := block.Header.Hash()
+		logger.Info("Mined new block", "hash", hash, "length", c.Length())
+	}
+}
+
+// watchSubmissions submits the transactions saved as JSON files in the
+// directory and removes them. Rejected files are renamed to *.rejected
+func watchSubmissions(dir string, n *node.Node, logger log.Logger) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		logger.Error("Failed to create submission dir", "err", err)
+		return
+	}
+	for range time.Tick(2 * time.Second) {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		for _, file := range files {
+			var txn transaction.Transaction
+			data, err := os.ReadFile(file)
+			if err == nil {
+				err = json.Unmarshal(data, &txn)
+			}
+			if err == nil {
+				err = n.SubmitTransaction(txn)
+			}
+			if err != nil {
+				logger.Warn("Rejected submitted transaction", "file", file, "err", err)
+				os.Rename(file, file+".rejected")
+				continue
+			}
+			os.Remove(file)
+		}
+	}
+}
+
 func main() {
-	initGob()
 	//testCrypto()
 
 	var logger log.Logger
@@ -73,7 +115,7 @@ func main() {
 
 	// Read NodeConfig from disk or generate new one is non-existing
 	var nodeConfig config.NodeConfig
-	conf, err := os.Open("data/config.json")
+	conf, err := os.Open(filepath.Join(constants.DataDir, "config.json"))
 	if err != nil {
 		logger.Warn("Failed to read node config from disk")
 		nodeConfig, err = config.NewNodeConfig()
@@ -94,7 +136,36 @@ func main() {
 		nodeConfig.SetAddr(config.NewAddress(constants.ConnAddr, connPort))
 	}
 
-	node := node.NewNode(nodeConfig, logger.New("node", "main_node"))
+	// The consensus parameters are the same for every node of the network
+	params := chain.DefaultParams
+
+	// Reload the chain from the data dir, a fresh dir starts from genesis
+	blockchain, err := chain.LoadChain(filepath.Join(constants.DataDir, "chain"), params)
+	if err != nil {
+		logger.Error("Failed to load chain", "err", err)
+		os.Exit(-1)
+	}
+	logger.Info("Loaded chain", "length", blockchain.Length())
+	pool := mempool.NewMempool(blockchain)
+
+	// Addresses of other nodes learned in previous runs
+	addrs, err := addrmgr.New(filepath.Join(constants.DataDir, "peers.json"))
+	if err != nil {
+		logger.Error("Failed to load addresses", "err", err)
+		os.Exit(-1)
+	}
+	logger.Info("Loaded addresses", "count", addrs.Len())
+
+	node := node.NewNode(nodeConfig, blockchain, pool, addrs, logger.New("node", "main_node"))
+
+	// Start mining if requested
+	if workers, err := strconv.Atoi(os.Getenv("MINING_WORKERS")); err == nil && workers > 0 {
+		logger.Info("Starting miner", "workers", workers)
+		go mine(blockchain, pool, node, chain.NewMiner(workers), logger.New("module", "miner"))
+	}
+
+	// Transactions dropped in the submit dir get relayed to the network
+	go watchSubmissions(filepath.Join(constants.DataDir, "submit"), node, logger.New("module", "submit"))
 
 	// Default peer list
 	// TODO: Move to file
@@ -109,5 +180,17 @@ func main() {
 		}
 	}
 
-	node.Start()
+	go node.Start()
+
+	// The node runs until it's stopped, then the addresses learned since
+	// they were last saved are written and the block store gets flushed
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	logger.Info("Shutting down", "signal", <-stop)
+	if err := addrs.Save(); err != nil {
+		logger.Error("Failed to save addresses", "err", err)
+	}
+	if err := blockchain.Close(); err != nil {
+		logger.Error("Failed to close chain", "err", err)
+	}
 }
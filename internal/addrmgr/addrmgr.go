@@ -0,0 +1,410 @@
+package addrmgr
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+// The address manager keeps the addresses of nodes learned from peers.
+// Addresses we never connected to are in the new table, the ones we
+// connected to at least once are in the tried table. Both tables are split
+// in buckets chosen by a keyed hash of the network group of the address, so
+// a single peer or network can only fill a few buckets. Outbound peers are
+// picked from a random bucket which makes it hard to eclipse the node by
+// flooding it with addresses
+
+const (
+	newBucketCount   = 64
+	triedBucketCount = 16
+	bucketSize       = 64
+
+	// Maximum number of addresses in a getaddr answer and the share of the
+	// table it may reveal
+	MaxSampleSize  = 250
+	samplePercent  = 23
+	minSampleSize  = 10
+	maxSelectTries = 100
+
+	// Addresses not seen for this long are dropped
+	maxAddressAge = 30 * 24 * time.Hour
+	// Failed attempts after which an address which never worked is dropped
+	maxRetries = 3
+	// Failed attempts after which an address which worked before is dropped
+	maxFailures = 10
+	minFailDays = 7 * 24 * time.Hour
+)
+
+var InvalidAddressError = errors.New("Address isn't a valid host:port")
+
+// KnownAddress is an address with the history of our connections to it
+type KnownAddress struct {
+	Addr string `json:"addr"`
+	// Address of the peer which told us about it
+	Source      string    `json:"source"`
+	LastSeen    time.Time `json:"last_seen"`
+	LastTried   time.Time `json:"last_tried"`
+	LastSuccess time.Time `json:"last_success"`
+	// Failed attempts since the last success
+	Attempts  int  `json:"attempts"`
+	Successes int  `json:"successes"`
+	Tried     bool `json:"tried"`
+}
+
+// isBad reports if the address isn't worth keeping
+func (ka *KnownAddress) isBad(now time.Time) bool {
+	if now.Sub(ka.LastSeen) > maxAddressAge {
+		return true
+	}
+	if ka.Successes == 0 && ka.Attempts >= maxRetries {
+		return true
+	}
+	return ka.Attempts >= maxFailures && now.Sub(ka.LastSuccess) > minFailDays
+}
+
+// chance returns the relative chance of the address to be selected. Addresses
+// tried recently and ones which failed repeatedly are less likely
+func (ka *KnownAddress) chance(now time.Time) float64 {
+	c := 1.0
+	if now.Sub(ka.LastTried) < 10*time.Minute {
+		c *= 0.01
+	}
+	for i := 0; i < min(ka.Attempts, 8); i++ {
+		c *= 0.66
+	}
+	return c
+}
+
+// AddrManager is safe for concurrent use
+type AddrManager struct {
+	path string
+	// Secret key of the bucket hashes so peers can't predict them
+	key   crypto.Hash
+	addrs map[string]*KnownAddress
+	new   [newBucketCount][]string
+	tried [triedBucketCount][]string
+	rand  *mrand.Rand
+	mu    sync.Mutex
+}
+
+// file is the representation of the manager on disk
+type file struct {
+	Key       crypto.Hash     `json:"key"`
+	Addresses []*KnownAddress `json:"addresses"`
+}
+
+// New loads the addresses saved at the path, a missing file starts empty
+func New(path string) (*AddrManager, error) {
+	var seed [8]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+	a := &AddrManager{
+		path:  path,
+		addrs: make(map[string]*KnownAddress),
+		rand:  mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		a.key, err = newKey()
+		return a, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	// Without a secret key anyone could tell which buckets an address lands in
+	a.key = f.Key
+	if len(a.key) != sha256.Size {
+		if a.key, err = newKey(); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	for _, ka := range f.Addresses {
+		if ka.isBad(now) {
+			continue
+		}
+		if ka.Tried {
+			a.addTried(ka)
+		} else {
+			a.addNew(ka)
+		}
+	}
+	return a, nil
+}
+
+// newKey returns a random key for the bucket hashes
+func newKey() (crypto.Hash, error) {
+	key := make(crypto.Hash, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Save writes the addresses to the path of the manager
+func (a *AddrManager) Save() error {
+	a.mu.Lock()
+	f := file{Key: a.key, Addresses: make([]*KnownAddress, 0, len(a.addrs))}
+	for _, ka := range a.addrs {
+		f.Addresses = append(f.Addresses, ka)
+	}
+	data, err := json.Marshal(f)
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Write a copy first so a crash doesn't leave a truncated file
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+func (a *AddrManager) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.addrs)
+}
+
+// Group returns the network group of the address: the /16 of IPv4
+// addresses, the /32 of IPv6 addresses and the name of hosts
+func Group(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// bucket hashes the parts with the key to a bucket index
+func (a *AddrManager) bucket(count int, parts ...string) int {
+	h := sha256.New()
+	h.Write(a.key)
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return int(binary.BigEndian.Uint64(h.Sum(nil)) % uint64(count))
+}
+
+func (a *AddrManager) newBucket(ka *KnownAddress) int {
+	return a.bucket(newBucketCount, "new", Group(ka.Source), Group(ka.Addr))
+}
+
+func (a *AddrManager) triedBucket(ka *KnownAddress) int {
+	return a.bucket(triedBucketCount, "tried", Group(ka.Addr), ka.Addr)
+}
+
+func removeFrom(bucket []string, addr string) []string {
+	for i, other := range bucket {
+		if other == addr {
+			return append(bucket[:i], bucket[i+1:]...)
+		}
+	}
+	return bucket
+}
+
+// worst returns the address of the bucket to evict: a bad one or the one
+// seen the longest time ago
+func (a *AddrManager) worst(bucket []string, now time.Time) string {
+	worst := bucket[0]
+	for _, addr := range bucket {
+		ka := a.addrs[addr]
+		if ka.isBad(now) {
+			return addr
+		}
+		if ka.LastSeen.Before(a.addrs[worst].LastSeen) {
+			worst = addr
+		}
+	}
+	return worst
+}
+
+// addNew puts the address in its new bucket, evicting another one if it's full
+func (a *AddrManager) addNew(ka *KnownAddress) {
+	ka.Tried = false
+	b := a.newBucket(ka)
+	if len(a.new[b]) >= bucketSize {
+		evicted := a.worst(a.new[b], time.Now())
+		a.new[b] = removeFrom(a.new[b], evicted)
+		delete(a.addrs, evicted)
+	}
+	a.new[b] = append(a.new[b], ka.Addr)
+	a.addrs[ka.Addr] = ka
+}
+
+// addTried puts the address in its tried bucket. If it's full the address
+// which worked the longest time ago goes back to the new table
+func (a *AddrManager) addTried(ka *KnownAddress) {
+	ka.Tried = true
+	b := a.triedBucket(ka)
+	if len(a.tried[b]) >= bucketSize {
+		oldest := a.tried[b][0]
+		for _, addr := range a.tried[b] {
+			if a.addrs[addr].LastSuccess.Before(a.addrs[oldest].LastSuccess) {
+				oldest = addr
+			}
+		}
+		a.tried[b] = removeFrom(a.tried[b], oldest)
+		a.addNew(a.addrs[oldest])
+	}
+	a.tried[b] = append(a.tried[b], ka.Addr)
+	a.addrs[ka.Addr] = ka
+}
+
+// AddAddresses adds the addresses a peer told us about. Known addresses
+// only get their last seen time updated
+func (a *AddrManager) AddAddresses(addrs []string, source string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for _, addr := range addrs {
+		if !validAddress(addr) {
+			continue
+		}
+		if ka, ok := a.addrs[addr]; ok {
+			ka.LastSeen = now
+			continue
+		}
+		a.addNew(&KnownAddress{Addr: addr, Source: source, LastSeen: now})
+	}
+}
+
+// validAddress accepts host:port addresses we could connect to
+func validAddress(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || port == "" || port == "0" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsUnspecified()
+}
+
+// Remove forgets the address, e.g. if it turned out to be our own
+func (a *AddrManager) Remove(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ka, ok := a.addrs[addr]
+	if !ok {
+		return
+	}
+	if ka.Tried {
+		b := a.triedBucket(ka)
+		a.tried[b] = removeFrom(a.tried[b], addr)
+	} else {
+		b := a.newBucket(ka)
+		a.new[b] = removeFrom(a.new[b], addr)
+	}
+	delete(a.addrs, addr)
+}
+
+// Attempt records a connection attempt to the address
+func (a *AddrManager) Attempt(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ka, ok := a.addrs[addr]; ok {
+		ka.LastTried = time.Now()
+		ka.Attempts++
+	}
+}
+
+// Good records a successful connection and moves the address to the tried table
+func (a *AddrManager) Good(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	ka, ok := a.addrs[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr, Source: addr}
+	}
+	ka.LastSeen, ka.LastTried, ka.LastSuccess = now, now, now
+	ka.Attempts = 0
+	ka.Successes++
+	if ok && ka.Tried {
+		return
+	}
+	if ok {
+		b := a.newBucket(ka)
+		a.new[b] = removeFrom(a.new[b], addr)
+	}
+	a.addTried(ka)
+}
+
+// Select picks an address to connect to. The tried and the new table are
+// equally likely, then a random bucket and an address in it which gets
+// accepted with its chance. Addresses for which exclude is true are skipped
+func (a *AddrManager) Select(exclude func(string) bool) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var newBuckets, triedBuckets [][]string
+	for _, b := range a.new {
+		if len(b) > 0 {
+			newBuckets = append(newBuckets, b)
+		}
+	}
+	for _, b := range a.tried {
+		if len(b) > 0 {
+			triedBuckets = append(triedBuckets, b)
+		}
+	}
+	if len(newBuckets) == 0 && len(triedBuckets) == 0 {
+		return "", false
+	}
+
+	now := time.Now()
+	for i := 0; i < maxSelectTries; i++ {
+		buckets := newBuckets
+		if len(triedBuckets) > 0 && (len(newBuckets) == 0 || a.rand.Intn(2) == 0) {
+			buckets = triedBuckets
+		}
+		bucket := buckets[a.rand.Intn(len(buckets))]
+		ka := a.addrs[bucket[a.rand.Intn(len(bucket))]]
+		if ka.isBad(now) || (exclude != nil && exclude(ka.Addr)) {
+			continue
+		}
+		if a.rand.Float64() < ka.chance(now) {
+			return ka.Addr, true
+		}
+	}
+	return "", false
+}
+
+// Sample returns a random sample of the good addresses to answer a getaddr.
+// It has at most MaxSampleSize addresses and a bounded share of the table
+func (a *AddrManager) Sample() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	good := make([]string, 0, len(a.addrs))
+	for addr, ka := range a.addrs {
+		if !ka.isBad(now) {
+			good = append(good, addr)
+		}
+	}
+	limit := min(max(len(good)*samplePercent/100, minSampleSize), MaxSampleSize, len(good))
+	a.rand.Shuffle(len(good), func(i, j int) { good[i], good[j] = good[j], good[i] })
+	return good[:limit]
+}
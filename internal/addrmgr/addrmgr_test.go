@@ -0,0 +1,185 @@
+package addrmgr
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T) *AddrManager {
+	t.Helper()
+	a, err := New(filepath.Join(t.TempDir(), "peers.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// spread returns n addresses of n different network groups
+func spread(n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("%d.%d.1.1:8333", 1+i/250, i%250)
+	}
+	return addrs
+}
+
+func TestBucketPlacement(t *testing.T) {
+	a := newTestManager(t)
+	addrs := []string{"10.1.0.1:8333", "10.1.0.2:8333", "10.2.0.1:8333"}
+	a.AddAddresses(addrs, "192.168.0.1:8333")
+	for _, addr := range addrs {
+		ka := a.addrs[addr]
+		if ka.Tried || !slices.Contains(a.new[a.newBucket(ka)], addr) {
+			t.Fatalf("%s isn't in its new bucket", addr)
+		}
+	}
+	// A network group learned from a source fills a single bucket
+	if a.newBucket(a.addrs[addrs[0]]) != a.newBucket(a.addrs[addrs[1]]) {
+		t.Fatal("expected addresses of a group from the same source in the same bucket")
+	}
+
+	a.Good(addrs[0])
+	ka := a.addrs[addrs[0]]
+	if !ka.Tried || !slices.Contains(a.tried[a.triedBucket(ka)], addrs[0]) {
+		t.Fatal("good address isn't in its tried bucket")
+	}
+	if slices.Contains(a.new[a.newBucket(ka)], addrs[0]) {
+		t.Fatal("good address is still in the new table")
+	}
+	// Addresses we connected to without learning them first are tried too
+	a.Good("10.3.0.1:8333")
+	if ka := a.addrs["10.3.0.1:8333"]; ka == nil || !ka.Tried {
+		t.Fatal("expected the address in the tried table")
+	}
+}
+
+// A full new bucket evicts the address seen the longest time ago
+func TestNewBucketEviction(t *testing.T) {
+	a := newTestManager(t)
+	source := "192.168.0.1:8333"
+	addrs := make([]string, bucketSize+1)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("10.1.%d.%d:8333", i/250, i%250+1)
+	}
+	a.AddAddresses(addrs[:bucketSize], source)
+	a.addrs[addrs[7]].LastSeen = time.Now().Add(-time.Hour)
+	a.AddAddresses(addrs[bucketSize:], source)
+
+	b := a.newBucket(a.addrs[addrs[0]])
+	if len(a.new[b]) != bucketSize || a.Len() != bucketSize {
+		t.Fatalf("expected %d addresses, got %d in the bucket and %d known", bucketSize, len(a.new[b]), a.Len())
+	}
+	if _, ok := a.addrs[addrs[7]]; ok {
+		t.Fatal("expected the oldest address to be evicted")
+	}
+	if !slices.Contains(a.new[b], addrs[bucketSize]) {
+		t.Fatal("new address isn't in the bucket")
+	}
+}
+
+// A full tried bucket sends the address which worked the longest time ago
+// back to the new table
+func TestTriedBucketEviction(t *testing.T) {
+	a := newTestManager(t)
+	var addrs []string
+	for i := 0; len(addrs) <= bucketSize; i++ {
+		addr := fmt.Sprintf("10.%d.%d.1:8333", i/250, i%250)
+		if a.triedBucket(&KnownAddress{Addr: addr}) == 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	for i, addr := range addrs[:bucketSize] {
+		a.Good(addr)
+		a.addrs[addr].LastSuccess = time.Now().Add(time.Duration(i) * time.Second)
+	}
+	a.addrs[addrs[3]].LastSuccess = time.Now().Add(-time.Hour)
+	a.Good(addrs[bucketSize])
+
+	if len(a.tried[0]) != bucketSize {
+		t.Fatalf("expected %d addresses in the bucket, got %d", bucketSize, len(a.tried[0]))
+	}
+	ka, ok := a.addrs[addrs[3]]
+	if !ok || ka.Tried || slices.Contains(a.tried[0], addrs[3]) {
+		t.Fatal("expected the oldest address back in the new table")
+	}
+	if !slices.Contains(a.new[a.newBucket(ka)], addrs[3]) {
+		t.Fatal("evicted address isn't in its new bucket")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	a, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.AddAddresses([]string{"10.1.0.1:8333", "10.2.0.1:8333", "10.3.0.1:8333"}, "192.168.0.1:8333")
+	a.Good("10.1.0.1:8333")
+	a.addrs["10.3.0.1:8333"].LastSeen = time.Now().Add(-2 * maxAddressAge)
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.key.String() != a.key.String() {
+		t.Fatal("bucket key changed")
+	}
+	// Stale addresses are dropped on load
+	if loaded.Len() != 2 {
+		t.Fatalf("expected 2 addresses, got %d", loaded.Len())
+	}
+	for _, addr := range []string{"10.1.0.1:8333", "10.2.0.1:8333"} {
+		ka, ok := loaded.addrs[addr]
+		if !ok || ka.Tried != a.addrs[addr].Tried {
+			t.Fatalf("%s wasn't restored", addr)
+		}
+		if ka.Tried && !slices.Contains(loaded.tried[loaded.triedBucket(ka)], addr) ||
+			!ka.Tried && !slices.Contains(loaded.new[loaded.newBucket(ka)], addr) {
+			t.Fatalf("%s isn't in the same bucket", addr)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	for _, test := range []struct {
+		known, sample int
+	}{
+		{5, 5},
+		{20, minSampleSize},
+		{100, 23},
+		{1200, MaxSampleSize},
+	} {
+		a := newTestManager(t)
+		addrs := spread(test.known)
+		for i, addr := range addrs {
+			a.AddAddresses([]string{addr}, addrs[(i+1)%len(addrs)])
+		}
+		if a.Len() != test.known {
+			t.Fatalf("expected %d known addresses, got %d", test.known, a.Len())
+		}
+		sample := a.Sample()
+		if len(sample) != test.sample {
+			t.Fatalf("%d addresses: expected a sample of %d, got %d", test.known, test.sample, len(sample))
+		}
+		slices.Sort(sample)
+		if len(slices.Compact(sample)) != len(sample) {
+			t.Fatal("sample has duplicates")
+		}
+	}
+
+	// Bad addresses aren't shared
+	a := newTestManager(t)
+	a.AddAddresses(spread(5), "192.168.0.1:8333")
+	for _, ka := range a.addrs {
+		ka.LastSeen = time.Now().Add(-2 * maxAddressAge)
+	}
+	if sample := a.Sample(); len(sample) != 0 {
+		t.Fatalf("expected no addresses, got %d", len(sample))
+	}
+}
@@ -2,9 +2,10 @@ package chain
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,27 +14,57 @@ import (
 	"github.com/timcki/learncoin/internal/transaction"
 )
 
+// HeaderSize is the size of the canonical header encoding
+// version (1) | previous hash (32) | merkle root (32) | time (8) | bits (4) | nonce (8)
+// Size: 85 bytes
+const HeaderSize = 85
+
 // Header is the header of a block
 type Header struct {
 	Version      uint8       `json:"version"`
 	PreviousHash crypto.Hash `json:"previous_hash"`
 	MerkleRoot   crypto.Hash `json:"merkle_root"`
-	hash         crypto.Hash `json:"hash"`
-	Time         time.Time   `json:"time"`
+	hash         crypto.Hash
+	Time         time.Time `json:"time"`
+	// Compact representation of the target the hash has to meet
+	Bits  uint32 `json:"bits"`
+	Nonce uint64 `json:"nonce"`
 }
 
 // Block is a container for groups of transactions. It
 type Block struct {
-	Header       Header
-	Transactions crypto.MerkleTree
+	Header       Header                    `json:"header"`
+	Transactions []transaction.Transaction `json:"transactions"`
 }
 
 // Chain is the abstraction of a blockchain, which means
-// * blocks represents a slice of blocks that expands
+// * index is the tree of every known block connected to genesis
+// * active is the best chain (most cumulative work) through that tree
+// * orphans are blocks whose parent isn't known yet
+// * store is the backend every accepted block is written through to
+// * utxos, keyImages and outputs are the state of the active chain
+// * params are the consensus parameters the blocks are validated with
 // * a mutex that allows multi-threaded reads/writes
 type Chain struct {
-	blocks []*Block
-	mu     sync.RWMutex
+	index   map[crypto.FixedHash]*blockNode
+	active  []*blockNode
+	orphans map[crypto.FixedHash]*Block
+	// Validated headers whose blocks haven't been accepted yet and the
+	// tip of the header chain with the most work
+	headers    map[crypto.FixedHash]*blockNode
+	bestHeader *blockNode
+	// Blocks which failed validation, their descendants are rejected too
+	invalid map[crypto.FixedHash]struct{}
+	// Set when a failed reorganization couldn't be rolled back
+	inconsistent error
+	// Closed and replaced whenever the tip of the active chain changes
+	tipChanged chan struct{}
+	store      BlockStore
+	utxos      UtxoSet
+	keyImages  KeyImageSet
+	outputs    OutputIndex
+	params     Params
+	mu         sync.RWMutex
 }
 
 func (h Header) PrettyPrint() string {
@@ -42,21 +73,30 @@ func (h Header) PrettyPrint() string {
 	str.WriteString(fmt.Sprintf("  previous_hash: %v,\n", h.PreviousHash))
 	str.WriteString(fmt.Sprintf("  merkle_root:   %v,\n", h.MerkleRoot))
 	str.WriteString(fmt.Sprintf("  hash:          %v,\n", h.hash))
-	str.WriteString(fmt.Sprintf("  time:          %v\n}", h.Time))
+	str.WriteString(fmt.Sprintf("  time:          %v,\n", h.Time))
+	str.WriteString(fmt.Sprintf("  bits:          %08x,\n", h.Bits))
+	str.WriteString(fmt.Sprintf("  nonce:         %d\n}", h.Nonce))
 
 	return str.String()
 
 }
 
-// Bytes returns a byte array representation the Header
+// Bytes returns the canonical byte representation of the Header which the
+// block hash commits to. Every field has a fixed size and position, the
+// version comes first so future versions can change the layout. Hashes
+// are written as 32 bytes (shorter ones are zero padded) and the time
+// as big-endian Unix seconds
 func (h Header) Bytes() []byte {
-	var buf bytes.Buffer
+	buf := make([]byte, HeaderSize)
 
-	buf.WriteByte(byte(h.Version))
-	buf.Write(h.MerkleRoot)
-	buf.WriteString(strconv.Itoa(int(h.Time.Unix())))
+	buf[0] = h.Version
+	copy(buf[1:33], h.PreviousHash)
+	copy(buf[33:65], h.MerkleRoot)
+	binary.BigEndian.PutUint64(buf[65:73], uint64(h.Time.Unix()))
+	binary.BigEndian.PutUint32(buf[73:77], h.Bits)
+	binary.BigEndian.PutUint64(buf[77:85], h.Nonce)
 
-	return buf.Bytes()
+	return buf
 }
 
 // Hash computes the Hash of Header
@@ -75,57 +115,377 @@ func (b *Block) PrettyPrint() string {
 	return string(res)
 }
 
+// MerkleTree builds the merkle tree of the block transactions
+func (b *Block) MerkleTree() (*crypto.MerkleTree, error) {
+	txns := make([]crypto.Hashable, len(b.Transactions))
+	for i, txn := range b.Transactions {
+		txns[i] = txn
+	}
+	return crypto.NewMerkleTree(txns)
+}
+
+// decodeBlock parses a block written by a BlockStore in the binary encoding
+func decodeBlock(data []byte) (*Block, error) {
+	block := new(Block)
+	if err := block.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
 func (c *Chain) Length() int {
-	return len(c.blocks)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.active)
+}
+
+// Height returns the height of the tip, the genesis block is at height 0
+func (c *Chain) Height() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tip().height
 }
 
-func NewBlock(txns []crypto.Hashable) *Block {
-	merkleTree, _ := crypto.NewMerkleTree(txns)
-	header := Header{
-		Version:    1,
-		MerkleRoot: merkleTree.RootHash(),
-		Time:       time.Now(),
+// HaveBlock reports if the block is in the block tree or waiting as an orphan
+func (c *Chain) HaveBlock(hash crypto.Hash) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.index[hash.ToFixedHash()]; ok {
+		return true
 	}
+	_, ok := c.orphans[hash.ToFixedHash()]
+	return ok
+}
 
+// BlockByHash returns a block of the block tree, on the active chain or not
+func (c *Chain) BlockByHash(hash crypto.Hash) (*Block, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	node, ok := c.index[hash.ToFixedHash()]
+	if !ok {
+		return nil, BlockNotFoundError
+	}
+	return node.block, nil
+}
+
+// parentNode returns the node of the block tree the header extends or nil if
+// it isn't known. The index is keyed by a hash prefix so the full previous
+// hash has to match as well
+func (c *Chain) parentNode(header Header) *blockNode {
+	node, ok := c.index[header.PreviousHash.ToFixedHash()]
+	if !ok || !bytes.Equal(node.hash, header.PreviousHash) {
+		return nil
+	}
+	return node
+}
+
+// tip returns the last block node of the active chain
+func (c *Chain) tip() *blockNode {
+	return c.active[len(c.active)-1]
+}
+
+// NextBits returns the target a block extending the current tip has to meet
+func (c *Chain) NextBits() uint32 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nextBits(c.tip())
+}
+
+// nextBits returns the target of a block whose parent is the given node
+func (c *Chain) nextBits(parent *blockNode) uint32 {
+	headers := make([]Header, 0, c.params.RetargetWindow+1)
+	// The genesis timestamp is arbitrary so it's never part of the window
+	for n := parent; n != nil && n.height > 0 && len(headers) <= c.params.RetargetWindow; n = n.parent {
+		headers = append(headers, n.block.Header)
+	}
+	// Headers were collected newest first
+	for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1 {
+		headers[i], headers[j] = headers[j], headers[i]
+	}
+	return NextWorkRequired(headers, c.params)
+}
+
+// TipChanged returns a channel which gets closed once the tip of the active
+// chain changes, e.g. to stop mining on a stale template
+func (c *Chain) TipChanged() <-chan struct{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tipChanged
+}
+
+// TipHash returns the hash of the last block in the chain
+func (c *Chain) TipHash() (crypto.Hash, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tip().hash, nil
+}
+
+// NewBlockTemplate creates a block with the transactions extending the current
+// tip. Transactions which don't fit in MaxBlockSize anymore are left out, so
+// they should be ordered by priority. Only the nonce is left to be mined
+func (c *Chain) NewBlockTemplate(txns []transaction.Transaction) *Block {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	block := NewBlock(fitBlockSize(txns))
+	block.SetPreviousHash(c.tip().hash)
+	block.SetBits(c.nextBits(c.tip()))
+	// The timestamp has to be after the median time past
+	if minTime := medianTimePast(c.tip()).Add(time.Second); block.Header.Time.Before(minTime) {
+		block.SetTime(minTime)
+	}
+	return block
+}
+
+// fitBlockSize returns the transactions which fit in a block of MaxBlockSize,
+// taken in order
+func fitBlockSize(txns []transaction.Transaction) []transaction.Transaction {
+	// The header and the transaction count
+	size := HeaderSize + binary.MaxVarintLen64
+	fit := make([]transaction.Transaction, 0, len(txns))
+	for _, txn := range txns {
+		data, err := txn.MarshalBinary()
+		if err != nil {
+			continue
+		}
+		// Every transaction is prefixed with its length
+		if n := binary.MaxVarintLen64 + len(data); size+n <= MaxBlockSize {
+			size += n
+			fit = append(fit, txn)
+		}
+	}
+	return fit
+}
+
+func NewBlock(txns []transaction.Transaction) *Block {
 	block := Block{
-		Header:       header,
-		Transactions: *merkleTree,
+		Header: Header{
+			Version: 1,
+			// The header only commits to whole seconds
+			Time: time.Now().Truncate(time.Second),
+		},
+		Transactions: txns,
 	}
+	merkleTree, _ := block.MerkleTree()
+	block.Header.MerkleRoot = merkleTree.RootHash()
 	block.Header.hash, _ = block.Header.Hash()
 	return &block
 }
 
+// The setters below keep the cached header hash consistent with the
+// modified header
+
 func (b *Block) SetPreviousHash(h crypto.Hash) {
 	b.Header.PreviousHash = h
+	b.Header.hash, _ = b.Header.Hash()
+}
+
+func (b *Block) SetNonce(nonce uint64) {
+	b.Header.Nonce = nonce
+	b.Header.hash, _ = b.Header.Hash()
+}
+
+func (b *Block) SetBits(bits uint32) {
+	b.Header.Bits = bits
+	b.Header.hash, _ = b.Header.Hash()
+}
+
+func (b *Block) SetTime(t time.Time) {
+	b.Header.Time = t.Truncate(time.Second)
+	b.Header.hash, _ = b.Header.Hash()
+}
+
+// AddBlock validates the block and adds it to the block tree. Blocks with an
+// unknown parent are kept as orphans until the parent arrives. If the block
+// makes a branch heavier than the active chain, the chain is reorganized
+// to that branch. Returns OrphanBlockError for orphans
+func (c *Chain) AddBlock(block *Block) error {
+	_, err := c.ProcessBlock(block)
+	return err
+}
+
+// ProcessBlock adds the block like AddBlock and returns the blocks which got
+// disconnected from and connected to the active chain, including orphans
+// the block connected. The update is empty if the active chain didn't change
+func (c *Chain) ProcessBlock(block *Block) (TipUpdate, error) {
+	var update TipUpdate
+	err := c.processBlock(block, &update)
+	return update, err
 }
 
-func (c *Chain) AddBlock(block *Block) {
+func (c *Chain) processBlock(block *Block, update *TipUpdate) error {
 	c.mu.Lock()
-	prev_block_hash, err := c.blocks[len(c.blocks)-1].Header.Hash()
+	defer c.mu.Unlock()
+	tip := c.tip()
+	defer func() {
+		if c.tip() != tip {
+			close(c.tipChanged)
+			c.tipChanged = make(chan struct{})
+		}
+	}()
+
+	if c.inconsistent != nil {
+		return c.inconsistent
+	}
+	hash, err := block.Header.Hash()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if _, ok := c.index[hash.ToFixedHash()]; ok {
+		return blockError(DuplicateBlockError)
+	}
+	if _, ok := c.orphans[hash.ToFixedHash()]; ok {
+		return blockError(DuplicateBlockError)
+	}
+	if c.isInvalid(hash, block.Header.PreviousHash) {
+		return blockError(KnownInvalidBlockError)
+	}
+	if err := checkBlockSanity(block); err != nil {
+		// A merkle root mismatch means the transactions were swapped and
+		// not that the header is invalid, any other failure is committed to
+		if !errors.Is(err, InvalidMerkleRootError) {
+			c.invalidate(c.headers[hash.ToFixedHash()])
+		}
+		return err
 	}
-	block.SetPreviousHash(prev_block_hash)
-	c.blocks = append(c.blocks, block)
-	c.mu.Unlock()
+
+	if c.parentNode(block.Header) == nil {
+		c.addOrphan(hash, block)
+		return OrphanBlockError
+	}
+	if err := c.acceptBlock(block, false, update); err != nil {
+		return err
+	}
+	c.processOrphans(hash, update)
+	return nil
 }
 
-func NewChain() *Chain {
-	genesis := Block{
+func genesisBlock(params Params) *Block {
+	genesis := &Block{
 		Header: Header{
 			Version:      0,
 			PreviousHash: []byte{0},
 			MerkleRoot:   []byte{0},
-			hash:         []byte{0},
 			Time:         time.Time{},
+			Bits:         powLimitBits,
 		},
-		Transactions: crypto.MerkleTree{},
+		Transactions: []transaction.Transaction{},
 	}
-	return &Chain{
-		blocks: []*Block{&genesis},
-		mu:     sync.RWMutex{},
+	// The allocated outputs are created by a transaction without inputs.
+	// It has no single recipient so it points at the first output
+	if len(params.GenesisOutputs) != 0 {
+		genesis.Transactions = append(genesis.Transactions, transaction.Transaction{
+			UtxosOut: params.GenesisOutputs,
+			To:       params.GenesisOutputs[0].Keypair,
+		})
+		tree, _ := genesis.MerkleTree()
+		genesis.Header.MerkleRoot = tree.RootHash()
 	}
+	genesis.Header.hash, _ = genesis.Header.Hash()
+	return genesis
+}
 
+// NewChain creates a chain with the default parameters which only lives in memory
+func NewChain() *Chain {
+	c, err := NewChainWithStore(NewMemoryStore(), DefaultParams)
+	if err != nil {
+		// Writing to the memory store can't fail
+		panic(err)
+	}
+	return c
+}
+
+// LoadChain opens the block store in dir and reloads the chain from it
+func LoadChain(dir string, params Params) (*Chain, error) {
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewChainWithStore(store, params)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewChainWithStore reloads all blocks kept in the store. An empty
+// store gets initialized with the genesis block
+func NewChainWithStore(store BlockStore, params Params) (*Chain, error) {
+	c := &Chain{
+		index:      make(map[crypto.FixedHash]*blockNode),
+		orphans:    make(map[crypto.FixedHash]*Block),
+		headers:    make(map[crypto.FixedHash]*blockNode),
+		invalid:    make(map[crypto.FixedHash]struct{}),
+		tipChanged: make(chan struct{}),
+		store:      store,
+		utxos:      NewUtxoSet(),
+		keyImages:  NewKeyImageSet(),
+		outputs:    NewOutputIndex(),
+		params:     params,
+	}
+	if store.Len() == 0 {
+		genesis := genesisBlock(params)
+		if err := store.Put(0, genesis); err != nil {
+			return nil, err
+		}
+		return c, c.setGenesis(genesis)
+	}
+
+	genesisHash, err := genesisBlock(params).Header.Hash()
+	if err != nil {
+		return nil, err
+	}
+	err = store.ForEach(func(height uint64, block *Block) error {
+		if len(c.index) == 0 {
+			if height != 0 {
+				return fmt.Errorf("%w: first block isn't genesis", CorruptedStoreError)
+			}
+			// A store of another network, or one created with other
+			// parameters, would otherwise be replayed as our chain
+			hash, err := block.Header.Hash()
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(hash, genesisHash) {
+				return GenesisMismatchError
+			}
+			return c.setGenesis(block)
+		}
+		// Blocks in our own store passed the sanity checks before being
+		// written. A block which turned out invalid when connecting stays
+		// in the store marked as invalid so it's skipped here, it's only
+		// validated again if the marking didn't make it to disk. Any other
+		// failure means the store doesn't match the chain state.
+		// Descendants of invalid blocks are skipped as well
+		hash, err := block.Header.Hash()
+		if err != nil {
+			return err
+		}
+		if store.IsInvalid(hash) || c.isInvalid(hash, block.Header.PreviousHash) {
+			c.invalid[hash.ToFixedHash()] = struct{}{}
+			return nil
+		}
+		if c.parentNode(block.Header) == nil {
+			return fmt.Errorf("%w: block at height %d has unknown parent", CorruptedStoreError, height)
+		}
+		var invalid *ValidationError
+		if err := c.acceptBlock(block, true, nil); err != nil && !errors.As(err, &invalid) {
+			return fmt.Errorf("%w: block at height %d: %v", CorruptedStoreError, height, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close flushes and closes the underlying block store. Blocks being added
+// are written first
+func (c *Chain) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.store.Close()
 }
 
 type UtxoSet interface {
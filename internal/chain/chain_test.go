@@ -0,0 +1,150 @@
+package chain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// newTestParams returns parameters whose genesis block allocates an output
+// worth 5 to the owner for each of the n outputs. They can be spent from
+// height 1 on
+func newTestParams(t testing.TB, owner transaction.Address, n int) Params {
+	t.Helper()
+	params := DefaultParams
+	params.OutputMaturity = 1
+	for i := 0; i < n; i++ {
+		out, _, err := owner.NewOutput(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.GenesisOutputs = append(params.GenesisOutputs, *out)
+	}
+	return params
+}
+
+// newTestChain returns an in memory chain with the given parameters
+func newTestChain(t testing.TB, params Params) *Chain {
+	t.Helper()
+	c, err := NewChainWithStore(NewMemoryStore(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newSpend returns a transaction of the owner sending 3 of the real output
+// to a new address, with the decoys in the ring
+func newSpend(t testing.TB, c *Chain, owner transaction.Address, real transaction.Utxo, decoys ...transaction.Utxo) transaction.Transaction {
+	t.Helper()
+	receiver, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn, err := owner.NewTransaction([]transaction.Utxo{real}, [][]transaction.Utxo{decoys}, 3, 1, receiver, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.SignTransaction(&txn, []transaction.Utxo{real}); err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+// mineOn returns a mined block with the transactions extending the parent,
+// which has to be in the block tree
+func mineOn(t testing.TB, c *Chain, parent *Block, txns ...transaction.Transaction) *Block {
+	t.Helper()
+	parentHash, err := parent.Header.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mu.RLock()
+	node, ok := c.index[parentHash.ToFixedHash()]
+	var bits uint32
+	if ok {
+		bits = c.nextBits(node)
+	}
+	c.mu.RUnlock()
+	if !ok {
+		t.Fatal("parent isn't in the block tree")
+	}
+
+	block := NewBlock(txns)
+	block.SetPreviousHash(parentHash)
+	block.SetBits(bits)
+	// The genesis timestamp is arbitrary, blocks on top of it start now
+	if parent.Header.Time.IsZero() {
+		block.SetTime(time.Now().Add(-time.Hour))
+	} else {
+		block.SetTime(parent.Header.Time.Add(DefaultParams.TargetBlockTime))
+	}
+	NewMiner(1).MineBlock(block, nil)
+	return block
+}
+
+// tipBlock returns the last block of the active chain
+func tipBlock(c *Chain) *Block {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tip().block
+}
+
+// oversizedTransactions returns copies of the transaction which together
+// don't fit in a block
+func oversizedTransactions(t testing.TB, txn transaction.Transaction) []transaction.Transaction {
+	t.Helper()
+	data, err := txn.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txns := make([]transaction.Transaction, MaxBlockSize/len(data)+1)
+	for i := range txns {
+		txns[i] = txn
+	}
+	return txns
+}
+
+func TestNewBlockTemplateFitsBlockSize(t *testing.T) {
+	owner, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := newTestParams(t, owner, 2)
+	c := newTestChain(t, params)
+	txn := newSpend(t, c, owner, params.GenesisOutputs[0], params.GenesisOutputs[1])
+
+	txns := oversizedTransactions(t, txn)
+	block := c.NewBlockTemplate(txns)
+	data, err := block.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > MaxBlockSize {
+		t.Fatalf("template of %d bytes is larger than %d", len(data), MaxBlockSize)
+	}
+	if len(block.Transactions) == 0 || len(block.Transactions) == len(txns) {
+		t.Fatalf("expected some of the %d transactions, got %d", len(txns), len(block.Transactions))
+	}
+}
+
+// Mining on a stale template stops once another block extends the chain
+func TestTipChanged(t *testing.T) {
+	c := NewChain()
+	changed := c.TipChanged()
+	select {
+	case <-changed:
+		t.Fatal("tip didn't change yet")
+	default:
+	}
+	addBlocks(t, c, mineOn(t, c, tipBlock(c)))
+	select {
+	case <-changed:
+	default:
+		t.Fatal("expected the tip change to be signalled")
+	}
+	if c.TipChanged() == changed {
+		t.Fatal("expected a new channel for the next tip change")
+	}
+}
@@ -0,0 +1,85 @@
+package chain
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// Params holds the consensus parameters of a chain
+type Params struct {
+	// Block interval the difficulty retargeting aims for
+	TargetBlockTime time.Duration
+	// Number of previous block intervals used by the retargeting
+	RetargetWindow int
+	// Number of blocks after which an output can be a ring member i.e. an
+	// output of the block at height h can be spent from height h+OutputMaturity
+	OutputMaturity uint64
+	// Outputs allocated by the genesis block
+	GenesisOutputs []transaction.Utxo
+}
+
+// DefaultParams are the parameters of the learncoin network. They're part of
+// consensus, nodes with different parameters end up on different chains
+var DefaultParams = Params{
+	TargetBlockTime: 30 * time.Second,
+	RetargetWindow:  60,
+	OutputMaturity:  10,
+}
+
+// NextWorkRequired computes the target of the block following the given
+// headers (oldest first) using a linearly weighted moving average (LWMA)
+// of the last RetargetWindow solve times. Recent solve times weigh more
+// so the difficulty reacts quickly to hashrate changes while a single
+// block with a manipulated timestamp can only move it a little.
+// Headers which don't fit in the window are ignored
+func NextWorkRequired(headers []Header, params Params) uint32 {
+	window := params.RetargetWindow
+	if len(headers)-1 < window {
+		window = len(headers) - 1
+	}
+	// Not enough history, start from the easiest target
+	if window < 1 {
+		return powLimitBits
+	}
+	headers = headers[len(headers)-window-1:]
+
+	target := int64(params.TargetBlockTime / time.Second)
+	if target < 1 {
+		target = 1
+	}
+
+	weightedSolveTimes := int64(0)
+	sumTargets := new(big.Int)
+	for i := 1; i <= window; i++ {
+		solveTime := headers[i].Time.Unix() - headers[i-1].Time.Unix()
+		// Clamp the solve time to limit the effect of bogus timestamps
+		if solveTime > 6*target {
+			solveTime = 6 * target
+		} else if solveTime < -6*target {
+			solveTime = -6 * target
+		}
+		weightedSolveTimes += int64(i) * solveTime
+		sumTargets.Add(sumTargets, CompactToBig(headers[i].Bits))
+	}
+
+	// Don't let negative solve times drive the target to zero
+	expected := target * int64(window*(window+1)/2)
+	if weightedSolveTimes < expected/10 {
+		weightedSolveTimes = expected / 10
+	}
+
+	// next = avg(targets) * weightedSolveTimes / expected
+	next := sumTargets.Div(sumTargets, big.NewInt(int64(window)))
+	next.Mul(next, big.NewInt(weightedSolveTimes))
+	next.Div(next, big.NewInt(expected))
+
+	if limit := CompactToBig(powLimitBits); next.Cmp(limit) > 0 {
+		next = limit
+	}
+	if next.Sign() <= 0 {
+		next = big.NewInt(1)
+	}
+	return BigToCompact(next)
+}
@@ -0,0 +1,101 @@
+package chain
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Target of the synthetic chains, well below the limit so it can move both ways
+const testBits uint32 = 0x1d00ffff
+
+// syntheticHeaders returns n headers with the given bits whose timestamps
+// are spaced by the solve times, repeating the last one
+func syntheticHeaders(n int, bits uint32, solveTimes ...time.Duration) []Header {
+	headers := make([]Header, n)
+	at := time.Unix(1700000000, 0)
+	for i := range headers {
+		if i > 0 {
+			solveTime := solveTimes[len(solveTimes)-1]
+			if i-1 < len(solveTimes) {
+				solveTime = solveTimes[i-1]
+			}
+			at = at.Add(solveTime)
+		}
+		headers[i] = Header{Time: at, Bits: bits}
+	}
+	return headers
+}
+
+// ratio returns next/previous of the targets of the compact representations
+func ratio(next, previous uint32) float64 {
+	r, _ := new(big.Rat).SetFrac(CompactToBig(next), CompactToBig(previous)).Float64()
+	return r
+}
+
+func TestNextWorkRequired(t *testing.T) {
+	params := DefaultParams
+	window := params.RetargetWindow
+	target := params.TargetBlockTime
+
+	tests := []struct {
+		name       string
+		headers    []Header
+		minRatio   float64
+		maxRatio   float64
+		exactlyOld bool
+	}{
+		{"on target", syntheticHeaders(window+1, testBits, target), 1, 1, true},
+		{"twice as fast", syntheticHeaders(window+1, testBits, target/2), 0.49, 0.51, false},
+		{"twice as slow", syntheticHeaders(window+1, testBits, 2*target), 1.99, 2.01, false},
+		// Solve times are clamped to six times the target
+		{"stalled", syntheticHeaders(window+1, testBits, time.Hour), 5.99, 6.01, false},
+		// and the weighted sum to a tenth of the expected one
+		{"timestamps going back", syntheticHeaders(window+1, testBits, -target), 0.099, 0.101, false},
+		// Headers outside the window are ignored
+		{"longer history", syntheticHeaders(3*window, testBits, time.Hour, time.Hour, target), 1, 1, true},
+		// A short history uses all the intervals there are
+		{"short history", syntheticHeaders(5, testBits, target/2), 0.49, 0.51, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := NextWorkRequired(test.headers, params)
+			if next != NextWorkRequired(test.headers, params) {
+				t.Fatal("retargeting isn't deterministic")
+			}
+			if test.exactlyOld && next != testBits {
+				t.Fatalf("expected bits %08x, got %08x", testBits, next)
+			}
+			if r := ratio(next, testBits); r < test.minRatio || r > test.maxRatio {
+				t.Fatalf("target changed by %f, expected between %f and %f", r, test.minRatio, test.maxRatio)
+			}
+		})
+	}
+}
+
+func TestNextWorkRequiredLimits(t *testing.T) {
+	params := DefaultParams
+	// Without a solve time the easiest target is used
+	for _, n := range []int{0, 1} {
+		if next := NextWorkRequired(syntheticHeaders(n, testBits, params.TargetBlockTime), params); next != powLimitBits {
+			t.Fatalf("%d headers: expected bits %08x, got %08x", n, powLimitBits, next)
+		}
+	}
+	// The target never gets easier than the limit
+	headers := syntheticHeaders(params.RetargetWindow+1, powLimitBits, time.Hour)
+	if next := NextWorkRequired(headers, params); next != powLimitBits {
+		t.Fatalf("expected bits %08x, got %08x", powLimitBits, next)
+	}
+}
+
+// A single block with a timestamp far in the future only moves the target
+// a little since its solve time is clamped to six times the target
+func TestNextWorkRequiredBogusTimestamp(t *testing.T) {
+	params := DefaultParams
+	headers := syntheticHeaders(params.RetargetWindow+1, testBits, params.TargetBlockTime)
+	last := len(headers) - 1
+	headers[last].Time = headers[last].Time.Add(24 * time.Hour)
+	if r := ratio(NextWorkRequired(headers, params), testBits); r > 1.2 {
+		t.Fatalf("a single timestamp changed the target by %f", r)
+	}
+}
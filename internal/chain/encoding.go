@@ -0,0 +1,124 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/timcki/learncoin/internal/codec"
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// Canonical binary encoding of blocks, using the primitives of the codec package
+//
+//	block: header (HeaderSize) | transactions (count, length prefixed transaction)
+//
+// The JSON representation follows the one of the transactions, hashes are hex
+//
+//	header: {"hash": hex, "version": int, "previous_hash": hex, "merkle_root": hex, "time": RFC 3339, "bits": int, "nonce": int}
+//	block:  {"header": header, "transactions": [transaction]}
+
+// Newest header version with the layout of Header.Bytes
+const maxHeaderVersion = 1
+
+func (h Header) MarshalBinary() ([]byte, error) {
+	return h.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a header encoded by Bytes. The decoded hashes are
+// always 32 bytes long, shorter ones were zero padded by the encoding
+func (h *Header) UnmarshalBinary(data []byte) error {
+	if len(data) < HeaderSize {
+		return codec.ShortBufferError
+	}
+	if len(data) > HeaderSize {
+		return codec.TrailingBytesError
+	}
+	if data[0] > maxHeaderVersion {
+		return codec.UnsupportedVersionError
+	}
+	*h = Header{
+		Version:      data[0],
+		PreviousHash: append([]byte{}, data[1:33]...),
+		MerkleRoot:   append([]byte{}, data[33:65]...),
+		Time:         time.Unix(int64(binary.BigEndian.Uint64(data[65:73])), 0).UTC(),
+		Bits:         binary.BigEndian.Uint32(data[73:77]),
+		Nonce:        binary.BigEndian.Uint64(data[77:85]),
+	}
+	h.hash, _ = h.Hash()
+	return nil
+}
+
+func (b *Block) MarshalBinary() ([]byte, error) {
+	w := new(codec.Writer)
+	w.Fixed(b.Header.Bytes())
+	w.Uvarint(uint64(len(b.Transactions)))
+	for _, txn := range b.Transactions {
+		data, err := txn.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		w.Bytes(data)
+	}
+	return w.Result()
+}
+
+func (b *Block) UnmarshalBinary(data []byte) error {
+	r := codec.NewReader(data)
+	header := r.Fixed(HeaderSize)
+	if err := r.Err(); err != nil {
+		return err
+	}
+	if err := b.Header.UnmarshalBinary(header); err != nil {
+		return err
+	}
+	b.Transactions = make([]transaction.Transaction, r.Count(1))
+	for i := range b.Transactions {
+		txn := r.Bytes()
+		if err := r.Err(); err != nil {
+			return err
+		}
+		if err := b.Transactions[i].UnmarshalBinary(txn); err != nil {
+			return err
+		}
+	}
+	return r.Finish()
+}
+
+// headerFields has the fields of Header without its JSON methods
+type headerFields Header
+
+// headerJSON adds the hash, which is only informative, to the header fields
+type headerJSON struct {
+	Hash crypto.Hash `json:"hash,omitempty"`
+	headerFields
+}
+
+func (h Header) MarshalJSON() ([]byte, error) {
+	hash, err := h.Hash()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(headerJSON{Hash: hash, headerFields: headerFields(h)})
+}
+
+// UnmarshalJSON decodes the header and restores its cached hash
+func (h *Header) UnmarshalJSON(data []byte) error {
+	var v headerJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	header := Header(v.headerFields)
+	hash, err := header.Hash()
+	if err != nil {
+		return err
+	}
+	if v.Hash != nil && !bytes.Equal(v.Hash, hash) {
+		return transaction.HashMismatchError
+	}
+	header.hash = hash
+	*h = header
+	return nil
+}
@@ -0,0 +1,57 @@
+package chain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// fuzzGenesis returns a genesis block allocating an output
+func fuzzGenesis(f *testing.F) *Block {
+	addr, err := transaction.NewAddress()
+	if err != nil {
+		f.Fatal(err)
+	}
+	out, _, err := addr.NewOutput(50)
+	if err != nil {
+		f.Fatal(err)
+	}
+	params := DefaultParams
+	params.GenesisOutputs = []transaction.Utxo{*out}
+	return genesisBlock(params)
+}
+
+func FuzzDecodeHeader(f *testing.F) {
+	f.Add(fuzzGenesis(f).Header.Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var header Header
+		if err := header.UnmarshalBinary(data); err != nil {
+			return
+		}
+		if encoded := header.Bytes(); !bytes.Equal(encoded, data) {
+			t.Fatalf("%x re-encoded as %x", data, encoded)
+		}
+	})
+}
+
+func FuzzDecodeBlock(f *testing.F) {
+	data, err := fuzzGenesis(f).MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		block := new(Block)
+		if err := block.UnmarshalBinary(data); err != nil {
+			return
+		}
+		encoded, err := block.MarshalBinary()
+		if err != nil {
+			t.Fatalf("decoded block can't be encoded: %v", err)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Fatalf("%x re-encoded as %x", data, encoded)
+		}
+	})
+}
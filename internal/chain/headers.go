@@ -0,0 +1,205 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+// Headers-first sync validates the headers announced by peers before their
+// blocks get downloaded. Headers whose blocks aren't there yet are kept in a
+// tree of their own. Their nodes hold a block with only the header, so the
+// difficulty and timestamp checks walk them like the nodes of blocks.
+// Headers have to carry at least the work of the active chain
+// MaxHeaderForkDepth blocks below its tip, so they can't fork off old blocks
+// where the proof of work is cheap, and every source can only keep
+// MaxHeadersPerSource headers in the tree until their blocks arrive
+
+const (
+	// Number of hashes at the start of a locator before they get sparser
+	denseLocatorHashes = 10
+	// Depth below the tip of the active chain headers can fork off at most
+	MaxHeaderForkDepth = 100
+	// Headers of a single source whose blocks haven't arrived yet
+	MaxHeadersPerSource = 10000
+)
+
+var (
+	UnconnectedHeadersError = errors.New("Header doesn't extend a known header")
+	InsufficientWorkError   = errors.New("Header forks off the active chain too deep")
+	HeaderLimitError        = errors.New("Source has too many headers waiting for their blocks")
+)
+
+// headerNode returns the node of a block or of a header without its block.
+// The trees are keyed by a hash prefix so the full hash has to match as well
+func (c *Chain) headerNode(hash crypto.Hash) *blockNode {
+	node, ok := c.index[hash.ToFixedHash()]
+	if !ok {
+		node, ok = c.headers[hash.ToFixedHash()]
+	}
+	if !ok || !bytes.Equal(node.hash, hash) {
+		return nil
+	}
+	return node
+}
+
+// resetBestHeader picks the header with the most work after headers were removed
+func (c *Chain) resetBestHeader() {
+	c.bestHeader = c.tip()
+	for _, tree := range []map[crypto.FixedHash]*blockNode{c.index, c.headers} {
+		for _, node := range tree {
+			if node.work.Cmp(c.bestHeader.work) > 0 {
+				c.bestHeader = node
+			}
+		}
+	}
+}
+
+// minHeaderWork returns the work of the active chain MaxHeaderForkDepth
+// blocks below its tip, which a new header needs at least
+func (c *Chain) minHeaderWork() *big.Int {
+	tip := c.tip()
+	if tip.height <= MaxHeaderForkDepth {
+		return new(big.Int)
+	}
+	return c.active[tip.height-MaxHeaderForkDepth].work
+}
+
+// AcceptHeaders validates the headers sent by the source, usually the address
+// of a peer, and adds them to the header tree. Every header has to extend a
+// known header or the one before it. Returns the number of headers which
+// weren't known yet
+func (c *Chain) AcceptHeaders(headers []Header, source string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	kept := 0
+	for _, node := range c.headers {
+		if node.source == source {
+			kept++
+		}
+	}
+	added := 0
+	for _, header := range headers {
+		hash, err := header.Hash()
+		if err != nil {
+			return added, err
+		}
+		if c.headerNode(hash) != nil {
+			continue
+		}
+		if c.isInvalid(hash, header.PreviousHash) {
+			return added, blockError(KnownInvalidBlockError)
+		}
+		if err := checkHeaderSanity(header); err != nil {
+			return added, err
+		}
+		parent := c.headerNode(header.PreviousHash)
+		if parent == nil {
+			return added, blockError(UnconnectedHeadersError)
+		}
+		if err := c.checkHeaderContext(header, parent); err != nil {
+			return added, err
+		}
+		node := newBlockNode(&Block{Header: header}, hash, parent)
+		if node.work.Cmp(c.minHeaderWork()) < 0 {
+			return added, blockError(InsufficientWorkError)
+		}
+		if kept >= MaxHeadersPerSource {
+			return added, HeaderLimitError
+		}
+		node.source = source
+		c.headers[hash.ToFixedHash()] = node
+		kept++
+		if node.work.Cmp(c.bestHeader.work) > 0 {
+			c.bestHeader = node
+		}
+		added++
+	}
+	return added, nil
+}
+
+// HaveHeader reports if the header is in the block tree or the header tree
+func (c *Chain) HaveHeader(hash crypto.Hash) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.headerNode(hash) != nil
+}
+
+// BestHeaderHeight returns the height of the header chain with the most work
+func (c *Chain) BestHeaderHeight() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bestHeader.height
+}
+
+// MissingBlocks returns up to max hashes of blocks of the best header chain
+// which haven't been downloaded yet, lowest first
+func (c *Chain) MissingBlocks(max int) []crypto.Hash {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	missing := make([]crypto.Hash, 0)
+	for n := c.bestHeader; n != nil; n = n.parent {
+		if _, ok := c.index[n.hash.ToFixedHash()]; ok {
+			break
+		}
+		if _, ok := c.orphans[n.hash.ToFixedHash()]; !ok {
+			missing = append(missing, n.hash)
+		}
+	}
+	for i, j := 0, len(missing)-1; i < j; i, j = i+1, j-1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+	if len(missing) > max {
+		missing = missing[:max]
+	}
+	return missing
+}
+
+// BlockLocator lists hashes of the best header chain from its tip back to
+// genesis. The first hashes are consecutive, after them the gaps double so
+// a peer can find the fork point of long chains with few hashes
+func (c *Chain) BlockLocator() []crypto.Hash {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	locator := make([]crypto.Hash, 0, denseLocatorHashes+16)
+	step := 1
+	for n := c.bestHeader; ; {
+		locator = append(locator, n.hash)
+		if n.parent == nil {
+			return locator
+		}
+		if len(locator) >= denseLocatorHashes {
+			step *= 2
+		}
+		for i := 0; i < step && n.parent != nil; i++ {
+			n = n.parent
+		}
+	}
+}
+
+// LocateHeaders returns up to max headers of the active chain following the
+// first locator hash which is on it, stopping after the stop hash. Without
+// a match the headers follow genesis
+func (c *Chain) LocateHeaders(locator []crypto.Hash, stop crypto.Hash, max int) []Header {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	start := uint64(1)
+	for _, hash := range locator {
+		node, ok := c.index[hash.ToFixedHash()]
+		if ok && node.height < uint64(len(c.active)) && c.active[node.height] == node {
+			start = node.height + 1
+			break
+		}
+	}
+	headers := make([]Header, 0)
+	for h := start; h < uint64(len(c.active)) && len(headers) < max; h++ {
+		headers = append(headers, c.active[h].block.Header)
+		if bytes.Equal(c.active[h].hash, stop) {
+			break
+		}
+	}
+	return headers
+}
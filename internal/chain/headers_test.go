@@ -0,0 +1,55 @@
+package chain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+// Headers forking off the active chain deeper than MaxHeaderForkDepth don't
+// have enough work to be kept
+func TestRejectDeepForkHeaders(t *testing.T) {
+	c := NewChain()
+	for i := 0; i < MaxHeaderForkDepth+2; i++ {
+		addBlocks(t, c, mineOn(t, c, tipBlock(c)))
+	}
+	tip := c.Height()
+
+	deep := mineOn(t, c, c.active[tip-MaxHeaderForkDepth-2].block)
+	if _, err := c.AcceptHeaders([]Header{deep.Header}, "peer"); !errors.Is(err, InsufficientWorkError) {
+		t.Fatalf("expected %v, got %v", InsufficientWorkError, err)
+	}
+	if c.HaveHeader(deep.Header.hash) {
+		t.Fatal("header of a deep fork was kept")
+	}
+	shallow := mineOn(t, c, c.active[tip-MaxHeaderForkDepth].block)
+	if _, err := c.AcceptHeaders([]Header{shallow.Header}, "peer"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A source can't keep more than MaxHeadersPerSource headers without their
+// blocks, other sources aren't affected
+func TestHeaderLimitPerSource(t *testing.T) {
+	c := NewChain()
+	genesis := tipBlock(c)
+	// Stand-ins for headers the source sent before
+	for i := 0; i < MaxHeadersPerSource; i++ {
+		var hash crypto.FixedHash
+		hash[0], hash[1] = byte(i), byte(i>>8)
+		c.headers[hash] = &blockNode{hash: hash[:], work: c.tip().work, source: "peer"}
+	}
+
+	block := mineOn(t, c, genesis)
+	if _, err := c.AcceptHeaders([]Header{block.Header}, "peer"); !errors.Is(err, HeaderLimitError) {
+		t.Fatalf("expected %v, got %v", HeaderLimitError, err)
+	}
+	added, err := c.AcceptHeaders([]Header{block.Header}, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 {
+		t.Fatalf("expected 1 added header, got %d", added)
+	}
+}
@@ -0,0 +1,71 @@
+package chain
+
+import (
+	"filippo.io/edwards25519"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// KeyImageSet keeps the key images spent by the active chain. A key image
+// can only be spent once, which is what prevents double spends since the
+// real input of a ring is hidden. Like the UtxoSet it's part of the chain
+// state which gets rebuilt from the block store on startup and is updated
+// whenever a block is connected or disconnected
+type KeyImageSet interface {
+	// Add marks the key image as spent. Fails if it's already spent
+	// or isn't a valid point of the prime order subgroup
+	Add([]byte) error
+	Contains([]byte) bool
+	Remove([]byte)
+	Len() int
+}
+
+type keyImageSet struct {
+	set map[string]struct{}
+}
+
+func NewKeyImageSet() KeyImageSet {
+	return &keyImageSet{
+		set: make(map[string]struct{}),
+	}
+}
+
+func (k *keyImageSet) Add(image []byte) error {
+	if err := CheckKeyImage(image); err != nil {
+		return err
+	}
+	if _, ok := k.set[string(image)]; ok {
+		return DuplicateKeyImageError
+	}
+	k.set[string(image)] = struct{}{}
+	return nil
+}
+
+func (k *keyImageSet) Contains(image []byte) bool {
+	_, ok := k.set[string(image)]
+	return ok
+}
+
+func (k *keyImageSet) Remove(image []byte) {
+	delete(k.set, string(image))
+}
+
+func (k *keyImageSet) Len() int {
+	return len(k.set)
+}
+
+// CheckKeyImage checks the key image is a point of the prime order subgroup
+// other than the identity. A key image with a small order component added
+// would be a different encoding of the same spend and allow double spending
+func CheckKeyImage(image []byte) error {
+	I, err := edwards25519.NewIdentityPoint().SetBytes(image)
+	if err != nil {
+		return InvalidKeyImageError
+	}
+	if I.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return InvalidKeyImageError
+	}
+	if !transaction.InPrimeOrderSubgroup(I) {
+		return InvalidKeyImageError
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package chain
+
+import (
+	"math"
+	"sync"
+)
+
+// Miner searches for a nonce which makes the header hash meet its target.
+// The nonce space is split evenly between the worker goroutines
+type Miner struct {
+	workers int
+}
+
+func NewMiner(workers int) *Miner {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Miner{workers: workers}
+}
+
+func (m *Miner) Workers() int {
+	return m.workers
+}
+
+// Mine iterates nonces over the header until its hash meets the target in
+// Header.Bits. Returns the solved header or false if quit got closed first
+func (m *Miner) Mine(header Header, quit <-chan struct{}) (Header, bool) {
+	found := make(chan Header, m.workers)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func(start uint64) {
+			defer wg.Done()
+			h := header
+			for nonce := start; ; nonce += uint64(m.workers) {
+				// Check for cancellation every few thousand hashes
+				if nonce%4096 < uint64(m.workers) {
+					select {
+					case <-done:
+						return
+					case <-quit:
+						return
+					default:
+					}
+				}
+				h.Nonce = nonce
+				hash, err := h.Hash()
+				if err == nil && CheckProofOfWork(hash, h.Bits) {
+					found <- h
+					return
+				}
+				// Nonce space of this worker is exhausted
+				if nonce > math.MaxUint64-uint64(m.workers) {
+					return
+				}
+			}
+		}(uint64(i))
+	}
+
+	// Close found once every worker returned so we don't block forever
+	// when the nonce space gets exhausted
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	var result Header
+	var ok bool
+	select {
+	case result, ok = <-found:
+	case <-quit:
+	}
+	close(done)
+	wg.Wait()
+	return result, ok
+}
+
+// MineBlock mines the block header in place. Returns false if quit
+// got closed before a valid nonce was found
+func (m *Miner) MineBlock(block *Block, quit <-chan struct{}) bool {
+	header, ok := m.Mine(block.Header, quit)
+	if !ok {
+		return false
+	}
+	block.SetNonce(header.Nonce)
+	return true
+}
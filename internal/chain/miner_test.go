@@ -0,0 +1,42 @@
+package chain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMine(t *testing.T) {
+	header := Header{Time: time.Unix(1700000000, 0), Bits: powLimitBits}
+	solved, ok := NewMiner(4).Mine(header, nil)
+	if !ok {
+		t.Fatal("expected a solution")
+	}
+	hash, err := solved.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckProofOfWork(hash, solved.Bits) {
+		t.Fatal("solution doesn't meet the target")
+	}
+}
+
+func TestMineStopsOnQuit(t *testing.T) {
+	// A target of 1 is never met
+	header := Header{Time: time.Unix(1700000000, 0), Bits: 0x01010000}
+	quit := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(quit) })
+
+	result := make(chan bool)
+	go func() {
+		_, ok := NewMiner(4).Mine(header, quit)
+		result <- ok
+	}()
+	select {
+	case ok := <-result:
+		if ok {
+			t.Fatal("expected no solution")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("miner didn't stop on quit")
+	}
+}
@@ -0,0 +1,205 @@
+package chain
+
+import (
+	"errors"
+	"time"
+
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+var (
+	UnknownOutputError     = errors.New("Output isn't in the output index")
+	OutputIndexHeightError = errors.New("Outputs have to be indexed in block order")
+)
+
+// OutputEntry is an output of the active chain together with its global index
+// and the block which created it
+type OutputEntry struct {
+	Index  uint64
+	Height uint64
+	Time   time.Time
+	Utxo   transaction.Utxo
+}
+
+// OutputIndex numbers every output of the active chain. Outputs get the next
+// index when their block is connected, in the order of the transactions and
+// their outputs, so output #N always refers to the same output as long as its
+// block stays in the active chain. Like the UtxoSet it's chain state which is
+// rebuilt from the block store on startup
+type OutputIndex interface {
+	// Append indexes the outputs of the block connected at the given height,
+	// which has to be the height right after the last indexed block
+	Append(height uint64, block *Block) error
+	// Truncate removes the outputs of the blocks at height and above
+	Truncate(height uint64)
+	Get(index uint64) (OutputEntry, error)
+	// Range returns the outputs with indices in [start, end)
+	Range(start, end uint64) ([]OutputEntry, error)
+	AtHeight(height uint64) ([]OutputEntry, error)
+	// IndexOf returns the index of the output with the given hash
+	IndexOf(crypto.FixedHash) (uint64, bool)
+	// Below returns the number of outputs created by the blocks below height
+	Below(height uint64) uint64
+	Len() uint64
+}
+
+type outputIndex struct {
+	outputs []OutputEntry
+	// Index of the first output of the block at every height
+	heights []uint64
+	byHash  map[crypto.FixedHash]uint64
+}
+
+func NewOutputIndex() OutputIndex {
+	return &outputIndex{
+		byHash: make(map[crypto.FixedHash]uint64),
+	}
+}
+
+func (o *outputIndex) Append(height uint64, block *Block) error {
+	if height != uint64(len(o.heights)) {
+		return OutputIndexHeightError
+	}
+	start := len(o.outputs)
+	o.heights = append(o.heights, uint64(start))
+	for _, txn := range block.Transactions {
+		for _, utxo := range txn.UtxosOut {
+			hash, err := utxo.Hash()
+			if err != nil {
+				o.Truncate(height)
+				return err
+			}
+			index := uint64(len(o.outputs))
+			// A repeated output keeps referring to its first index
+			if _, ok := o.byHash[hash.ToFixedHash()]; !ok {
+				o.byHash[hash.ToFixedHash()] = index
+			}
+			o.outputs = append(o.outputs, OutputEntry{
+				Index:  index,
+				Height: height,
+				Time:   block.Header.Time,
+				Utxo:   utxo,
+			})
+		}
+	}
+	return nil
+}
+
+func (o *outputIndex) Truncate(height uint64) {
+	if height >= uint64(len(o.heights)) {
+		return
+	}
+	start := o.heights[height]
+	for _, entry := range o.outputs[start:] {
+		hash, _ := entry.Utxo.Hash()
+		if index, ok := o.byHash[hash.ToFixedHash()]; ok && index >= start {
+			delete(o.byHash, hash.ToFixedHash())
+		}
+	}
+	o.outputs = o.outputs[:start]
+	o.heights = o.heights[:height]
+}
+
+func (o *outputIndex) Get(index uint64) (OutputEntry, error) {
+	if index >= uint64(len(o.outputs)) {
+		return OutputEntry{}, UnknownOutputError
+	}
+	return o.outputs[index], nil
+}
+
+func (o *outputIndex) Range(start, end uint64) ([]OutputEntry, error) {
+	if start > end || end > uint64(len(o.outputs)) {
+		return nil, UnknownOutputError
+	}
+	return append([]OutputEntry{}, o.outputs[start:end]...), nil
+}
+
+func (o *outputIndex) AtHeight(height uint64) ([]OutputEntry, error) {
+	if height >= uint64(len(o.heights)) {
+		return nil, BlockNotFoundError
+	}
+	end := uint64(len(o.outputs))
+	if height+1 < uint64(len(o.heights)) {
+		end = o.heights[height+1]
+	}
+	return o.Range(o.heights[height], end)
+}
+
+func (o *outputIndex) IndexOf(hash crypto.FixedHash) (uint64, bool) {
+	index, ok := o.byHash[hash]
+	return index, ok
+}
+
+func (o *outputIndex) Below(height uint64) uint64 {
+	if height >= uint64(len(o.heights)) {
+		return uint64(len(o.outputs))
+	}
+	return o.heights[height]
+}
+
+func (o *outputIndex) Len() uint64 {
+	return uint64(len(o.outputs))
+}
+
+// The methods below give read access to the output index of the chain. The
+// chain implements transaction.OutputSource so decoys can be picked from it
+// and transaction.OutputIndexer so rings can reference its outputs
+
+// NumOutputs returns the number of outputs which are mature enough to be
+// ring members of the next block. They're always the oldest outputs
+func (c *Chain) NumOutputs() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	next := uint64(len(c.active))
+	if next < c.params.OutputMaturity {
+		return 0
+	}
+	return int(c.outputs.Below(next - c.params.OutputMaturity + 1))
+}
+
+func (c *Chain) Output(i int) (transaction.Utxo, time.Time, error) {
+	if i < 0 {
+		return transaction.Utxo{}, time.Time{}, UnknownOutputError
+	}
+	entry, err := c.OutputByIndex(uint64(i))
+	if err != nil {
+		return transaction.Utxo{}, time.Time{}, err
+	}
+	return entry.Utxo, entry.Time, nil
+}
+
+func (c *Chain) OutputByIndex(index uint64) (OutputEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.outputs.Get(index)
+}
+
+// OutputRange returns the outputs with indices in [start, end)
+func (c *Chain) OutputRange(start, end uint64) ([]OutputEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.outputs.Range(start, end)
+}
+
+// OutputsAtHeight returns the outputs created by the block at the given height
+func (c *Chain) OutputsAtHeight(height uint64) ([]OutputEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.outputs.AtHeight(height)
+}
+
+// OutputIndexOf returns the global index of the output
+func (c *Chain) OutputIndexOf(utxo transaction.Utxo) (uint64, error) {
+	hash, err := utxo.Hash()
+	if err != nil {
+		return 0, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	index, ok := c.outputs.IndexOf(hash.ToFixedHash())
+	if !ok {
+		return 0, UnknownOutputError
+	}
+	return index, nil
+}
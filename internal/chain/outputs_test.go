@@ -0,0 +1,201 @@
+package chain
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// blockWithOutputs returns a block whose single transaction creates n outputs
+func blockWithOutputs(t *testing.T, n int) *Block {
+	t.Helper()
+	addr, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var txn transaction.Transaction
+	for i := 0; i < n; i++ {
+		out, _, err := addr.NewOutput(transaction.Amount(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		txn.UtxosOut = append(txn.UtxosOut, *out)
+	}
+	return &Block{Header: Header{Time: time.Unix(1700000000, 0)}, Transactions: []transaction.Transaction{txn}}
+}
+
+// indexOf returns the index the output index has for the utxo
+func indexOf(t *testing.T, o OutputIndex, utxo transaction.Utxo) (uint64, bool) {
+	t.Helper()
+	hash, err := utxo.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.IndexOf(hash.ToFixedHash())
+}
+
+// newTestIndex returns an index of blocks with 2, 0 and 3 outputs
+func newTestIndex(t *testing.T) (OutputIndex, []*Block) {
+	t.Helper()
+	o := NewOutputIndex()
+	blocks := []*Block{blockWithOutputs(t, 2), blockWithOutputs(t, 0), blockWithOutputs(t, 3)}
+	for height, block := range blocks {
+		if err := o.Append(uint64(height), block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return o, blocks
+}
+
+func TestOutputIndexAppend(t *testing.T) {
+	o, blocks := newTestIndex(t)
+	if o.Len() != 5 {
+		t.Fatalf("expected 5 outputs, got %d", o.Len())
+	}
+	if err := o.Append(5, blockWithOutputs(t, 1)); !errors.Is(err, OutputIndexHeightError) {
+		t.Fatalf("expected %v, got %v", OutputIndexHeightError, err)
+	}
+
+	outputs := slices.Concat(blocks[0].Transactions[0].UtxosOut, blocks[2].Transactions[0].UtxosOut)
+	heights := []uint64{0, 0, 2, 2, 2}
+	for i, utxo := range outputs {
+		entry, err := o.Get(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Index != uint64(i) || entry.Height != heights[i] {
+			t.Fatalf("output %d: got index %d at height %d", i, entry.Index, entry.Height)
+		}
+		if index, ok := indexOf(t, o, utxo); !ok || index != uint64(i) {
+			t.Fatalf("output %d is found at %d", i, index)
+		}
+	}
+	if _, err := o.Get(5); !errors.Is(err, UnknownOutputError) {
+		t.Fatalf("expected %v, got %v", UnknownOutputError, err)
+	}
+
+	// Outputs below every height, past the last block it's all of them
+	for height, below := range []uint64{0, 2, 2, 5, 5} {
+		if got := o.Below(uint64(height)); got != below {
+			t.Fatalf("expected %d outputs below height %d, got %d", below, height, got)
+		}
+	}
+}
+
+func TestOutputIndexRange(t *testing.T) {
+	o, _ := newTestIndex(t)
+	entries, err := o.Range(1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Index != 1 || entries[2].Index != 3 {
+		t.Fatalf("expected outputs 1 to 3, got %d outputs", len(entries))
+	}
+	for _, bounds := range [][2]uint64{{3, 2}, {0, 6}} {
+		if _, err := o.Range(bounds[0], bounds[1]); !errors.Is(err, UnknownOutputError) {
+			t.Fatalf("%v: expected %v, got %v", bounds, UnknownOutputError, err)
+		}
+	}
+
+	for height, count := range []int{2, 0, 3} {
+		entries, err := o.AtHeight(uint64(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != count {
+			t.Fatalf("expected %d outputs at height %d, got %d", count, height, len(entries))
+		}
+	}
+	if _, err := o.AtHeight(3); !errors.Is(err, BlockNotFoundError) {
+		t.Fatalf("expected %v, got %v", BlockNotFoundError, err)
+	}
+}
+
+// Disconnecting blocks truncates their outputs, the next block gets their indices
+func TestOutputIndexTruncate(t *testing.T) {
+	o, blocks := newTestIndex(t)
+	o.Truncate(1)
+	if o.Len() != 2 {
+		t.Fatalf("expected 2 outputs, got %d", o.Len())
+	}
+	for _, utxo := range blocks[2].Transactions[0].UtxosOut {
+		if _, ok := indexOf(t, o, utxo); ok {
+			t.Fatal("truncated output is still indexed")
+		}
+	}
+	if _, err := o.AtHeight(1); !errors.Is(err, BlockNotFoundError) {
+		t.Fatalf("expected %v, got %v", BlockNotFoundError, err)
+	}
+	// Truncating above the last block does nothing
+	o.Truncate(5)
+	if o.Len() != 2 {
+		t.Fatalf("expected 2 outputs, got %d", o.Len())
+	}
+
+	other := blockWithOutputs(t, 1)
+	if err := o.Append(1, other); err != nil {
+		t.Fatal(err)
+	}
+	if index, ok := indexOf(t, o, other.Transactions[0].UtxosOut[0]); !ok || index != 2 {
+		t.Fatalf("expected the new output at 2, got %d", index)
+	}
+}
+
+// A repeated output keeps its first index, also after the repeat is truncated
+func TestOutputIndexRepeatedOutput(t *testing.T) {
+	o, blocks := newTestIndex(t)
+	if err := o.Append(3, blocks[0]); err != nil {
+		t.Fatal(err)
+	}
+	utxo := blocks[0].Transactions[0].UtxosOut[0]
+	if index, ok := indexOf(t, o, utxo); !ok || index != 0 {
+		t.Fatalf("expected the repeated output at 0, got %d", index)
+	}
+	o.Truncate(3)
+	if index, ok := indexOf(t, o, utxo); !ok || index != 0 {
+		t.Fatalf("expected the output at 0 after truncating the repeat, got %d", index)
+	}
+}
+
+// After a reorg the outputs of the disconnected branch are gone and the
+// outputs of the connected one follow those of the common blocks
+func TestOutputIndexAfterReorg(t *testing.T) {
+	f := newReorgFixture(t)
+	c := newTestChain(t, f.params)
+	addBlocks(t, c, f.main...)
+	addBlocks(t, c, f.fork...)
+
+	genesisOutputs := uint64(len(f.params.GenesisOutputs))
+	for _, utxo := range f.main[0].Transactions[0].UtxosOut {
+		if _, err := c.OutputIndexOf(utxo); !errors.Is(err, UnknownOutputError) {
+			t.Fatalf("expected %v, got %v", UnknownOutputError, err)
+		}
+	}
+	next := genesisOutputs
+	for height, block := range f.fork {
+		entries, err := c.OutputsAtHeight(uint64(height + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := next
+		for _, txn := range block.Transactions {
+			for _, utxo := range txn.UtxosOut {
+				index, err := c.OutputIndexOf(utxo)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if index != next {
+					t.Fatalf("expected output at %d, got %d", next, index)
+				}
+				next++
+			}
+		}
+		if uint64(len(entries)) != next-start {
+			t.Fatalf("expected %d outputs at height %d, got %d", next-start, height+1, len(entries))
+		}
+	}
+	checkSameOutputs(t, c.outputs, f.replay(t, f.fork).outputs)
+}
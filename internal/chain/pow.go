@@ -0,0 +1,91 @@
+package chain
+
+import (
+	"math/big"
+
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+// powLimitBits is the compact representation of the easiest target
+// a block hash has to meet. It requires ~2^16 hashes on average
+const powLimitBits uint32 = 0x1f00ffff
+
+// CompactToBig converts the compact representation of a target used in
+// Header.Bits to a big integer. The compact form is a base 256 float
+// where the most significant byte is the exponent and the lower
+// three bytes are the mantissa (with the 0x00800000 bit as the sign)
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	negative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var n *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		n = big.NewInt(int64(mantissa))
+	} else {
+		n = big.NewInt(int64(mantissa))
+		n.Lsh(n, 8*(exponent-3))
+	}
+	if negative {
+		n.Neg(n)
+	}
+	return n
+}
+
+// BigToCompact converts a target to its compact representation. Precision
+// is lost as only the three most significant bytes are kept
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Abs(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Bits()[0])
+	}
+
+	// The 0x00800000 bit is the sign so shift the mantissa
+	// and bump the exponent if it's already set
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// HashToBig interprets the hash as a big-endian unsigned integer
+func HashToBig(hash crypto.Hash) *big.Int {
+	return new(big.Int).SetBytes(hash)
+}
+
+// CheckProofOfWork checks if the hash is below the target encoded in bits
+// and that the target itself is in the allowed range
+func CheckProofOfWork(hash crypto.Hash, bits uint32) bool {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 || target.Cmp(CompactToBig(powLimitBits)) > 0 {
+		return false
+	}
+	return HashToBig(hash).Cmp(target) <= 0
+}
+
+// CalcWork returns the expected number of hashes needed to find a
+// block meeting the target in bits i.e. 2^256 / (target + 1)
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
@@ -0,0 +1,71 @@
+package chain
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		compact uint32
+		target  string
+		// Canonical compact form of the target
+		back uint32
+	}{
+		{0x00000000, "0", 0x00000000},
+		{0x00123456, "0", 0x00000000},
+		{0x01003456, "0", 0x00000000},
+		{0x01123456, "12", 0x01120000},
+		// The mantissa can't have the sign bit set, the exponent grows instead
+		{0x02008000, "80", 0x02008000},
+		{0x04123456, "12345600", 0x04123456},
+		{0x05009234, "92340000", 0x05009234},
+		{0x01fedcba, "-7e", 0x01fe0000},
+		{0x04923456, "-12345600", 0x04923456},
+		{powLimitBits, "ffff" + zeros(28), powLimitBits},
+		// Far above any target a header can have, but no overflow
+		{0xff123456, "123456" + zeros(252), 0xff123456},
+	} {
+		target := CompactToBig(test.compact)
+		expected, _ := new(big.Int).SetString(test.target, 16)
+		if target.Cmp(expected) != 0 {
+			t.Fatalf("%08x: expected %x, got %x", test.compact, expected, target)
+		}
+		if back := BigToCompact(target); back != test.back {
+			t.Fatalf("%08x: expected %08x back, got %08x", test.compact, test.back, back)
+		}
+	}
+}
+
+// zeros returns the hex of n zero bytes
+func zeros(n int) string {
+	return string(bytes.Repeat([]byte("00"), n))
+}
+
+func TestCheckProofOfWork(t *testing.T) {
+	target := CompactToBig(0x1d00ffff)
+	below := new(big.Int).Sub(target, big.NewInt(1)).FillBytes(make([]byte, 32))
+	at := target.FillBytes(make([]byte, 32))
+	above := new(big.Int).Add(target, big.NewInt(1)).FillBytes(make([]byte, 32))
+	zero := make([]byte, 32)
+
+	for _, test := range []struct {
+		name  string
+		hash  []byte
+		bits  uint32
+		valid bool
+	}{
+		{"below target", below, 0x1d00ffff, true},
+		{"at target", at, 0x1d00ffff, true},
+		{"above target", above, 0x1d00ffff, false},
+		{"zero target", zero, 0x00000000, false},
+		{"negative target", zero, 0x1d80ffff, false},
+		{"above the limit", zero, 0x2000ffff, false},
+		{"at the limit", zero, powLimitBits, true},
+	} {
+		if valid := CheckProofOfWork(test.hash, test.bits); valid != test.valid {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.valid, valid)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+// Maximum number of orphan blocks kept in memory
+const maxOrphans = 100
+
+// The chain state is only changed while connecting and disconnecting blocks,
+// if restoring it after a failed reorganization fails as well it doesn't
+// match the active chain anymore
+var InconsistentStateError = errors.New("Chain state couldn't be restored after a failed reorganization")
+
+// TipUpdate lists the blocks which left and joined the active chain while
+// adding a block, together with the orphans it connected
+type TipUpdate struct {
+	// Disconnected blocks, the old tip first
+	Disconnected []*Block
+	// Connected blocks, the new tip last
+	Connected []*Block
+}
+
+// blockNode is a block in the block tree. Every node knows its parent
+// so any branch can be walked back to genesis
+type blockNode struct {
+	block  *Block
+	hash   crypto.Hash
+	parent *blockNode
+	height uint64
+	// Cumulative work of the branch ending with this block
+	work *big.Int
+	// Changes made to the chain state while the block is connected
+	undo *BlockUndo
+	// Source of a header whose block hasn't arrived yet
+	source string
+}
+
+func newBlockNode(block *Block, hash crypto.Hash, parent *blockNode) *blockNode {
+	node := &blockNode{
+		block:  block,
+		hash:   hash,
+		parent: parent,
+		work:   CalcWork(block.Header.Bits),
+	}
+	if parent != nil {
+		node.height = parent.height + 1
+		node.work.Add(node.work, parent.work)
+	}
+	return node
+}
+
+// setGenesis makes the block the root of the block tree and connects it
+func (c *Chain) setGenesis(genesis *Block) error {
+	hash, err := genesis.Header.Hash()
+	if err != nil {
+		return err
+	}
+	node := newBlockNode(genesis, hash, nil)
+	if err := c.connectBlock(node); err != nil {
+		return err
+	}
+	c.index[hash.ToFixedHash()] = node
+	c.active = []*blockNode{node}
+	c.bestHeader = node
+	return nil
+}
+
+// acceptBlock adds a block whose parent is known to the block tree and
+// switches to its branch if it has more cumulative work than the active
+// chain. Blocks reloaded from the store skip the checks and writing.
+// Blocks are written before they're connected, so parents always come
+// before their children in the store. A block which turns out invalid
+// when its branch gets connected is marked in the store instead. Changes of
+// the active chain are recorded in the update if it isn't nil
+func (c *Chain) acceptBlock(block *Block, stored bool, update *TipUpdate) error {
+	hash, err := block.Header.Hash()
+	if err != nil {
+		return err
+	}
+	parent := c.parentNode(block.Header)
+	if !stored {
+		if err := c.checkHeaderContext(block.Header, parent); err != nil {
+			return err
+		}
+	}
+
+	node := newBlockNode(block, hash, parent)
+	if !stored {
+		if err := c.store.Put(node.height, block); err != nil {
+			return err
+		}
+	}
+	c.index[hash.ToFixedHash()] = node
+	delete(c.headers, hash.ToFixedHash())
+	if node.work.Cmp(c.bestHeader.work) > 0 {
+		c.bestHeader = node
+	}
+
+	// Ties keep the branch we've seen first
+	if node.work.Cmp(c.tip().work) <= 0 {
+		return nil
+	}
+	failed, err := c.reorganize(node, update)
+	var invalid *ValidationError
+	if err != nil && failed != nil && errors.As(err, &invalid) {
+		c.invalidate(failed)
+		if markErr := c.store.PutInvalid(failed.hash); markErr != nil {
+			return markErr
+		}
+	}
+	return err
+}
+
+// findFork returns the last block of the active chain which is an ancestor of node
+func (c *Chain) findFork(node *blockNode) *blockNode {
+	for node.height >= uint64(len(c.active)) || c.active[node.height] != node {
+		node = node.parent
+	}
+	return node
+}
+
+// reorganize makes newTip the tip of the active chain. Blocks of the current
+// chain are disconnected down to the fork point and the blocks of the new
+// branch are connected. Either the whole branch gets connected or the chain
+// is restored to its previous state, in which case the node which failed to
+// connect is returned. The node is nil if the current chain failed to be
+// disconnected, which isn't a fault of the new branch. If the previous state
+// can't be restored either, the chain stops accepting blocks and every
+// later call returns an InconsistentStateError
+func (c *Chain) reorganize(newTip *blockNode, update *TipUpdate) (*blockNode, error) {
+	fork := c.findFork(newTip)
+
+	attach := make([]*blockNode, newTip.height-fork.height)
+	for n := newTip; n != fork; n = n.parent {
+		attach[n.height-fork.height-1] = n
+	}
+	detach := append([]*blockNode{}, c.active[fork.height+1:]...)
+
+	for i := len(detach) - 1; i >= 0; i-- {
+		if err := c.disconnectBlock(detach[i]); err != nil {
+			// Reconnect the blocks disconnected so far
+			if rollbackErr := c.rollback(nil, detach[i+1:]); rollbackErr != nil {
+				return nil, c.fail(rollbackErr, err)
+			}
+			return nil, err
+		}
+	}
+	for i, node := range attach {
+		if err := c.connectBlock(node); err != nil {
+			// Roll back to the previous active chain
+			if rollbackErr := c.rollback(attach[:i], detach); rollbackErr != nil {
+				return node, c.fail(rollbackErr, err)
+			}
+			return node, err
+		}
+	}
+
+	c.active = append(c.active[:fork.height+1], attach...)
+	if update != nil {
+		for i := len(detach) - 1; i >= 0; i-- {
+			update.Disconnected = append(update.Disconnected, detach[i].block)
+		}
+		for _, node := range attach {
+			update.Connected = append(update.Connected, node.block)
+		}
+	}
+	return nil, nil
+}
+
+// rollback disconnects the connected blocks, newest first, and reconnects
+// the disconnected ones, oldest first
+func (c *Chain) rollback(connected, disconnected []*blockNode) error {
+	for i := len(connected) - 1; i >= 0; i-- {
+		if err := c.disconnectBlock(connected[i]); err != nil {
+			return fmt.Errorf("disconnecting block at height %d: %w", connected[i].height, err)
+		}
+	}
+	for _, node := range disconnected {
+		if err := c.connectBlock(node); err != nil {
+			return fmt.Errorf("reconnecting block at height %d: %w", node.height, err)
+		}
+	}
+	return nil
+}
+
+// fail stops the chain from accepting blocks after its state couldn't be
+// restored, the returned error explains why
+func (c *Chain) fail(rollbackErr, err error) error {
+	c.inconsistent = fmt.Errorf("%w: %w while rolling back after: %v", InconsistentStateError, rollbackErr, err)
+	return c.inconsistent
+}
+
+// connectBlock applies the block to the chain state and keeps its undo
+// record. Expects the parent of the block to be the current tip
+func (c *Chain) connectBlock(node *blockNode) error {
+	if err := c.checkBlockState(node.block, node.height); err != nil {
+		return err
+	}
+	undo, err := ConnectBlock(c.utxos, c.keyImages, node.block)
+	if err != nil {
+		return err
+	}
+	if !c.store.HasUndo(node.hash) {
+		if err := c.store.PutUndo(node.hash, undo); err != nil {
+			DisconnectBlock(c.utxos, c.keyImages, undo)
+			return err
+		}
+	}
+	if err := c.outputs.Append(node.height, node.block); err != nil {
+		DisconnectBlock(c.utxos, c.keyImages, undo)
+		return err
+	}
+	node.undo = undo
+	return nil
+}
+
+// disconnectBlock reverts the changes connectBlock made to the chain state
+func (c *Chain) disconnectBlock(node *blockNode) error {
+	undo := node.undo
+	if undo == nil {
+		var err error
+		if undo, err = c.store.GetUndo(node.hash); err != nil {
+			return err
+		}
+	}
+	if err := DisconnectBlock(c.utxos, c.keyImages, undo); err != nil {
+		return err
+	}
+	c.outputs.Truncate(node.height)
+	node.undo = nil
+	return nil
+}
+
+// invalidate removes the node and all of its descendants from the block tree
+// and the header tree
+func (c *Chain) invalidate(node *blockNode) {
+	if node == nil {
+		return
+	}
+	c.invalid[node.hash.ToFixedHash()] = struct{}{}
+	for _, tree := range []map[crypto.FixedHash]*blockNode{c.index, c.headers} {
+		for hash, n := range tree {
+			for a := n; a != nil && a.height >= node.height; a = a.parent {
+				if a == node {
+					delete(tree, hash)
+					c.invalid[hash] = struct{}{}
+					break
+				}
+			}
+		}
+	}
+	c.resetBestHeader()
+}
+
+// isInvalid reports if the block or its parent failed validation before
+func (c *Chain) isInvalid(hash, previous crypto.Hash) bool {
+	if _, ok := c.invalid[previous.ToFixedHash()]; ok {
+		return true
+	}
+	_, ok := c.invalid[hash.ToFixedHash()]
+	return ok
+}
+
+// addOrphan keeps the block until its parent arrives. When the orphan pool
+// is full an arbitrary orphan is evicted
+func (c *Chain) addOrphan(hash crypto.Hash, block *Block) {
+	if len(c.orphans) >= maxOrphans {
+		for h := range c.orphans {
+			delete(c.orphans, h)
+			break
+		}
+	}
+	c.orphans[hash.ToFixedHash()] = block
+}
+
+// processOrphans accepts all orphans which (transitively) descend from the given block
+func (c *Chain) processOrphans(hash crypto.Hash, update *TipUpdate) {
+	parents := []crypto.Hash{hash}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+		for h, orphan := range c.orphans {
+			if !bytes.Equal(orphan.Header.PreviousHash, parent) {
+				continue
+			}
+			delete(c.orphans, h)
+			if err := c.acceptBlock(orphan, false, update); err == nil {
+				parents = append(parents, orphan.Header.hash)
+			}
+		}
+	}
+}
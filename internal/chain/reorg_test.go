@@ -0,0 +1,323 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// addBlocks adds the blocks to the chain, which have to be accepted
+func addBlocks(t *testing.T, c *Chain, blocks ...*Block) {
+	t.Helper()
+	for _, block := range blocks {
+		if err := c.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// utxoHashes returns the sorted hashes of the utxo set
+func utxoHashes(t *testing.T, c *Chain) []string {
+	t.Helper()
+	var hashes []string
+	for _, utxo := range c.utxos.GetUtxos() {
+		hash, err := utxo.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash.String())
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// checkSameState checks the chain has the same active chain and chain state
+// as the replay, which only ever saw the blocks of its active chain
+func checkSameState(t *testing.T, c, replay *Chain) {
+	t.Helper()
+	if len(c.active) != len(replay.active) {
+		t.Fatalf("expected %d blocks, got %d", len(replay.active), len(c.active))
+	}
+	for i := range c.active {
+		if !bytes.Equal(c.active[i].hash, replay.active[i].hash) {
+			t.Fatalf("active chains differ at height %d", i)
+		}
+	}
+	if !reflect.DeepEqual(utxoHashes(t, c), utxoHashes(t, replay)) {
+		t.Fatal("utxo sets differ")
+	}
+	if !reflect.DeepEqual(c.keyImages.(*keyImageSet).set, replay.keyImages.(*keyImageSet).set) {
+		t.Fatal("spent key images differ")
+	}
+	checkSameOutputs(t, c.outputs, replay.outputs)
+}
+
+// checkSameOutputs checks both output indices number the same outputs
+func checkSameOutputs(t *testing.T, index, expected OutputIndex) {
+	t.Helper()
+	if index.Len() != expected.Len() {
+		t.Fatalf("expected %d indexed outputs, got %d", expected.Len(), index.Len())
+	}
+	outputs, err := index.Range(0, index.Len())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range outputs {
+		other, err := expected.Get(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := entry.Utxo.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherHash, err := other.Utxo.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Index != other.Index || entry.Height != other.Height || !entry.Time.Equal(other.Time) ||
+			!bytes.Equal(hash, otherHash) {
+			t.Fatalf("output %d differs", i)
+		}
+		if index, ok := index.IndexOf(hash.ToFixedHash()); !ok || index != entry.Index {
+			t.Fatalf("output %d isn't found by its hash", i)
+		}
+	}
+}
+
+// reorgFixture has an owner of genesis outputs, a main branch A-B-C and a
+// heavier fork A'-B'-C'-D' from genesis. The fork spends the output the
+// main branch spent in A again in C'
+type reorgFixture struct {
+	params  Params
+	owner   transaction.Address
+	genesis *Block
+	main    []*Block
+	fork    []*Block
+}
+
+func newReorgFixture(t *testing.T) reorgFixture {
+	t.Helper()
+	owner, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := reorgFixture{params: newTestParams(t, owner, 4), owner: owner}
+	outs := f.params.GenesisOutputs
+	c := newTestChain(t, f.params)
+	f.genesis = tipBlock(c)
+
+	a := mineOn(t, c, f.genesis, newSpend(t, c, owner, outs[0], outs[1]))
+	addBlocks(t, c, a)
+	b := mineOn(t, c, a, newSpend(t, c, owner, outs[1], outs[2]))
+	addBlocks(t, c, b)
+	f.main = []*Block{a, b, mineOn(t, c, b)}
+
+	forkA := mineOn(t, c, f.genesis, newSpend(t, c, owner, outs[2], outs[3]))
+	addBlocks(t, c, forkA)
+	forkB := mineOn(t, c, forkA)
+	addBlocks(t, c, forkB)
+	forkC := mineOn(t, c, forkB, newSpend(t, c, owner, outs[0], outs[3]))
+	addBlocks(t, c, forkC)
+	f.fork = []*Block{forkA, forkB, forkC, mineOn(t, c, forkC, newSpend(t, c, owner, outs[3], outs[0]))}
+	return f
+}
+
+// replay returns a new chain which only saw the blocks
+func (f reorgFixture) replay(t *testing.T, blocks []*Block) *Chain {
+	t.Helper()
+	c := newTestChain(t, f.params)
+	addBlocks(t, c, blocks...)
+	return c
+}
+
+func TestReorgMatchesReplay(t *testing.T) {
+	f := newReorgFixture(t)
+	dir := t.TempDir()
+	c, err := LoadChain(dir, f.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBlocks(t, c, f.main...)
+	checkSameState(t, c, f.replay(t, f.main))
+
+	addBlocks(t, c, f.fork[:3]...)
+	// Ties keep the branch seen first
+	checkSameState(t, c, f.replay(t, f.main))
+	addBlocks(t, c, f.fork[3])
+	checkSameState(t, c, f.replay(t, f.fork))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reloading replays the store, side branch included
+	c, err = LoadChain(dir, f.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameState(t, c, f.replay(t, f.fork))
+	c.Close()
+}
+
+// A block of the heavier branch which turns out invalid when its branch is
+// connected leaves the chain as it was before the reorg
+func TestReorgRollsBackInvalidBranch(t *testing.T) {
+	f := newReorgFixture(t)
+	dir := t.TempDir()
+	c, err := LoadChain(dir, f.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBlocks(t, c, f.main[:2]...)
+
+	// B' spends the output A' spent again
+	outs := f.params.GenesisOutputs
+	forkA := f.fork[0]
+	addBlocks(t, c, forkA)
+	forkB := mineOn(t, c, forkA, newSpend(t, c, f.owner, outs[2], outs[1]))
+	addBlocks(t, c, forkB)
+	forkC := mineOn(t, c, forkB)
+	if err := c.AddBlock(forkC); !errors.Is(err, DuplicateKeyImageError) {
+		t.Fatalf("expected %v, got %v", DuplicateKeyImageError, err)
+	}
+	checkSameState(t, c, f.replay(t, f.main[:2]))
+	for _, block := range []*Block{forkB, forkC} {
+		if c.HaveBlock(block.Header.hash) {
+			t.Fatal("invalid branch is still in the block tree")
+		}
+		if err := c.AddBlock(block); !errors.Is(err, KnownInvalidBlockError) {
+			t.Fatalf("expected %v, got %v", KnownInvalidBlockError, err)
+		}
+	}
+	if !c.store.IsInvalid(forkB.Header.hash) {
+		t.Fatal("invalid block isn't marked in the store")
+	}
+	// The main branch can still be extended
+	addBlocks(t, c, f.main[2])
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = LoadChain(dir, f.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameState(t, c, f.replay(t, f.main))
+	if !c.isInvalid(forkB.Header.hash, forkA.Header.hash) {
+		t.Fatal("invalid block was accepted when reloading")
+	}
+	c.Close()
+}
+
+// A block with a valid proof of work but an invalid state is kept in the
+// store marked as invalid, it isn't validated again on restart
+func TestInvalidBlockMarkedInStore(t *testing.T) {
+	f := newReorgFixture(t)
+	store := NewMemoryStore()
+	c, err := NewChainWithStore(store, f.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBlocks(t, c, f.main[0])
+	// Spends the output A spent again
+	outs := f.params.GenesisOutputs
+	double := mineOn(t, c, f.main[0], newSpend(t, c, f.owner, outs[0], outs[2]))
+	if err := c.AddBlock(double); !errors.Is(err, DuplicateKeyImageError) {
+		t.Fatalf("expected %v, got %v", DuplicateKeyImageError, err)
+	}
+	if !store.IsInvalid(double.Header.hash) {
+		t.Fatal("invalid block isn't marked in the store")
+	}
+
+	c, err = NewChainWithStore(store, f.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameState(t, c, f.replay(t, f.main[:1]))
+	if c.HaveBlock(double.Header.hash) {
+		t.Fatal("invalid block was reloaded")
+	}
+}
+
+// failingKeyImages fails to add the key image once it's set
+type failingKeyImages struct {
+	KeyImageSet
+	fail []byte
+}
+
+var errKeyImageFailure = errors.New("Failed to add key image")
+
+func (k *failingKeyImages) Add(image []byte) error {
+	if k.fail != nil && bytes.Equal(image, k.fail) {
+		return errKeyImageFailure
+	}
+	return k.KeyImageSet.Add(image)
+}
+
+// If the previous active chain can't be restored after a failed reorg the
+// chain state is broken, which is reported instead of ignored
+func TestReorgRollbackFailure(t *testing.T) {
+	f := newReorgFixture(t)
+	c := newTestChain(t, f.params)
+	keyImages := &failingKeyImages{KeyImageSet: c.keyImages}
+	c.keyImages = keyImages
+	addBlocks(t, c, f.main[:2]...)
+
+	outs := f.params.GenesisOutputs
+	forkA := f.fork[0]
+	addBlocks(t, c, forkA)
+	forkB := mineOn(t, c, forkA, newSpend(t, c, f.owner, outs[2], outs[1]))
+	addBlocks(t, c, forkB)
+	forkC := mineOn(t, c, forkB)
+
+	// Reconnecting A fails
+	keyImages.fail = f.main[0].Transactions[0].KeyImages()[0]
+	err := c.AddBlock(forkC)
+	if !errors.Is(err, InconsistentStateError) || !errors.Is(err, errKeyImageFailure) {
+		t.Fatalf("expected %v, got %v", InconsistentStateError, err)
+	}
+	if err := c.AddBlock(f.main[2]); !errors.Is(err, InconsistentStateError) {
+		t.Fatalf("expected %v, got %v", InconsistentStateError, err)
+	}
+}
+
+// The update of a block connecting orphans lists every block which left and
+// joined the active chain
+func TestProcessBlockUpdate(t *testing.T) {
+	f := newReorgFixture(t)
+	c := newTestChain(t, f.params)
+	addBlocks(t, c, f.main...)
+
+	for i := len(f.fork) - 1; i > 0; i-- {
+		update, err := c.ProcessBlock(f.fork[i])
+		if !errors.Is(err, OrphanBlockError) {
+			t.Fatalf("expected %v, got %v", OrphanBlockError, err)
+		}
+		if len(update.Connected) != 0 || len(update.Disconnected) != 0 {
+			t.Fatal("orphan changed the active chain")
+		}
+	}
+	update, err := c.ProcessBlock(f.fork[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := func(blocks []*Block) []string {
+		var hashes []string
+		for _, block := range blocks {
+			hashes = append(hashes, block.Header.hash.String())
+		}
+		return hashes
+	}
+	disconnected := []*Block{f.main[2], f.main[1], f.main[0]}
+	if !reflect.DeepEqual(hashes(update.Disconnected), hashes(disconnected)) {
+		t.Fatal("expected the main branch to be disconnected, tip first")
+	}
+	if !reflect.DeepEqual(hashes(update.Connected), hashes(f.fork)) {
+		t.Fatal("expected the fork to be connected, tip last")
+	}
+	checkSameState(t, c, f.replay(t, f.fork))
+}
@@ -0,0 +1,696 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+const (
+	blockFileName = "blocks.dat"
+	indexFileName = "index.dat"
+	undoFileName  = "undo.dat"
+	// Hashes of stored blocks which failed validation
+	invalidFileName = "invalid.dat"
+
+	// Every record in the block file starts with the magic bytes
+	// followed by the payload length and the payload checksum
+	// Size: 12 bytes
+	recordHeaderSize = 12
+	// Every entry in the index file has a fixed size
+	// hash (32) | height (8) | offset (8) | length (4)
+	// Size: 52 bytes
+	indexEntrySize = 52
+	// Largest payload of a record. Undo records are always smaller than
+	// the binary encoding of their block
+	maxRecordSize = MaxBlockSize
+)
+
+var recordMagic = [4]byte{'l', 'r', 'n', 'b'}
+
+var (
+	BlockNotFoundError   = errors.New("Block not found in store")
+	UndoNotFoundError    = errors.New("Undo record not found in store")
+	CorruptedStoreError  = errors.New("Block store is corrupted")
+	GenesisMismatchError = errors.New("Stored genesis block doesn't match the chain parameters")
+	// The record is cut short by the end of the file
+	TruncatedRecordError = errors.New("Record extends past the end of the file")
+)
+
+// BlockStore is the storage backend of the Chain. Blocks are written
+// through on every AddBlock and read back when the chain is loaded
+type BlockStore interface {
+	// Put stores the block at the given height
+	Put(height uint64, block *Block) error
+	// Get returns the block with the given header hash
+	Get(hash crypto.Hash) (*Block, error)
+	// GetByHeight returns all blocks stored at the given height. There's
+	// more than one if the chain forked at that height
+	GetByHeight(height uint64) ([]*Block, error)
+	// ForEach calls fn for every stored block in insertion order
+	ForEach(fn func(height uint64, block *Block) error) error
+	// Len returns the number of stored blocks
+	Len() int
+	// PutUndo stores the undo record of the block with the given hash
+	PutUndo(hash crypto.Hash, undo *BlockUndo) error
+	// GetUndo returns the undo record of the block with the given hash
+	GetUndo(hash crypto.Hash) (*BlockUndo, error)
+	HasUndo(hash crypto.Hash) bool
+	// PutInvalid marks the stored block with the given hash as invalid, so
+	// it's skipped instead of validated again when the chain is loaded
+	PutInvalid(hash crypto.Hash) error
+	IsInvalid(hash crypto.Hash) bool
+	Close() error
+}
+
+// undoRecord is the payload of a record in the undo file
+type undoRecord struct {
+	Hash crypto.Hash `json:"hash"`
+	Undo *BlockUndo  `json:"undo"`
+}
+
+// indexEntry points to a single block record in the block file
+type indexEntry struct {
+	hash   crypto.Hash
+	height uint64
+	offset int64
+	length uint32
+}
+
+func (e indexEntry) bytes() []byte {
+	buf := make([]byte, indexEntrySize)
+	copy(buf[:32], e.hash)
+	binary.BigEndian.PutUint64(buf[32:40], e.height)
+	binary.BigEndian.PutUint64(buf[40:48], uint64(e.offset))
+	binary.BigEndian.PutUint32(buf[48:52], e.length)
+	return buf
+}
+
+func parseIndexEntry(buf []byte) indexEntry {
+	return indexEntry{
+		hash:   append(crypto.Hash{}, buf[:32]...),
+		height: binary.BigEndian.Uint64(buf[32:40]),
+		offset: int64(binary.BigEndian.Uint64(buf[40:48])),
+		length: binary.BigEndian.Uint32(buf[48:52]),
+	}
+}
+
+// memoryStore keeps the blocks only in memory. It's the default
+// store for chains that don't need to survive a restart
+type memoryStore struct {
+	blocks  []*Block
+	heights []uint64
+	byHash  map[crypto.FixedHash]int
+	undo    map[crypto.FixedHash]*BlockUndo
+	invalid map[crypto.FixedHash]struct{}
+	mu      sync.RWMutex
+}
+
+func NewMemoryStore() BlockStore {
+	return &memoryStore{
+		byHash:  make(map[crypto.FixedHash]int),
+		undo:    make(map[crypto.FixedHash]*BlockUndo),
+		invalid: make(map[crypto.FixedHash]struct{}),
+	}
+}
+
+func (s *memoryStore) Put(height uint64, block *Block) error {
+	hash, err := block.Header.Hash()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHash[hash.ToFixedHash()] = len(s.blocks)
+	s.blocks = append(s.blocks, block)
+	s.heights = append(s.heights, height)
+	return nil
+}
+
+func (s *memoryStore) Get(hash crypto.Hash) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.byHash[hash.ToFixedHash()]
+	if !ok {
+		return nil, BlockNotFoundError
+	}
+	return s.blocks[i], nil
+}
+
+func (s *memoryStore) GetByHeight(height uint64) ([]*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var blocks []*Block
+	for i, h := range s.heights {
+		if h == height {
+			blocks = append(blocks, s.blocks[i])
+		}
+	}
+	if len(blocks) == 0 {
+		return nil, BlockNotFoundError
+	}
+	return blocks, nil
+}
+
+func (s *memoryStore) ForEach(fn func(uint64, *Block) error) error {
+	s.mu.RLock()
+	blocks, heights := s.blocks, s.heights
+	s.mu.RUnlock()
+	for i, block := range blocks {
+		if err := fn(heights[i], block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.blocks)
+}
+
+func (s *memoryStore) PutUndo(hash crypto.Hash, undo *BlockUndo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.undo[hash.ToFixedHash()] = undo
+	return nil
+}
+
+func (s *memoryStore) GetUndo(hash crypto.Hash) (*BlockUndo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	undo, ok := s.undo[hash.ToFixedHash()]
+	if !ok {
+		return nil, UndoNotFoundError
+	}
+	return undo, nil
+}
+
+func (s *memoryStore) HasUndo(hash crypto.Hash) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.undo[hash.ToFixedHash()]
+	return ok
+}
+
+func (s *memoryStore) PutInvalid(hash crypto.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invalid[hash.ToFixedHash()] = struct{}{}
+	return nil
+}
+
+func (s *memoryStore) IsInvalid(hash crypto.Hash) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.invalid[hash.ToFixedHash()]
+	return ok
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// fileStore persists blocks in an append-only block file and keeps an
+// append-only index file mapping block hashes and heights to records
+// in the block file. The block file is the source of truth, the index
+// is rebuilt from it whenever the two disagree. Undo records are kept
+// in a separate append-only file indexed in memory, the hashes of invalid
+// blocks in another one
+type fileStore struct {
+	blocks  *os.File
+	index   *os.File
+	undo    *os.File
+	invalid *os.File
+
+	entries  []indexEntry
+	byHash   map[crypto.FixedHash]int
+	byHeight map[uint64][]int
+	// Offset at which the next record will be appended
+	end int64
+
+	undoOffsets map[crypto.FixedHash]int64
+	undoEnd     int64
+
+	invalidHashes map[crypto.FixedHash]struct{}
+
+	mu sync.RWMutex
+}
+
+// OpenFileStore opens (or creates) the block store in the given directory.
+// A partially written record at the tail of a file (e.g. after a crash) is
+// truncated away, a corrupted record anywhere else fails with CorruptedStoreError
+func OpenFileStore(dir string) (BlockStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	blocks, err := os.OpenFile(filepath.Join(dir, blockFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(filepath.Join(dir, indexFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		blocks.Close()
+		return nil, err
+	}
+	undo, err := os.OpenFile(filepath.Join(dir, undoFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		blocks.Close()
+		index.Close()
+		return nil, err
+	}
+	invalid, err := os.OpenFile(filepath.Join(dir, invalidFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		blocks.Close()
+		index.Close()
+		undo.Close()
+		return nil, err
+	}
+	s := &fileStore{
+		blocks:        blocks,
+		index:         index,
+		undo:          undo,
+		invalid:       invalid,
+		byHash:        make(map[crypto.FixedHash]int),
+		byHeight:      make(map[uint64][]int),
+		undoOffsets:   make(map[crypto.FixedHash]int64),
+		invalidHashes: make(map[crypto.FixedHash]struct{}),
+	}
+	if err := s.recover(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover loads the index and reconciles it with the block file
+func (s *fileStore) recover() error {
+	blocksInfo, err := s.blocks.Stat()
+	if err != nil {
+		return err
+	}
+	raw, err := io.ReadAll(s.index)
+	if err != nil {
+		return err
+	}
+
+	// Load all complete index entries that point to complete records
+	for len(raw) >= indexEntrySize {
+		entry := parseIndexEntry(raw[:indexEntrySize])
+		if entry.offset != s.end || entry.offset+recordHeaderSize+int64(entry.length) > blocksInfo.Size() {
+			break
+		}
+		s.addEntry(entry)
+		s.end = entry.offset + recordHeaderSize + int64(entry.length)
+		raw = raw[indexEntrySize:]
+	}
+	// Drop everything from the index past the last valid entry
+	if err := s.index.Truncate(int64(len(s.entries)) * indexEntrySize); err != nil {
+		return err
+	}
+
+	// Scan records which were written to the block file but never indexed
+	for s.end < blocksInfo.Size() {
+		payload, err := readPayload(s.blocks, s.end, blocksInfo.Size())
+		if err != nil {
+			torn, tornErr := tornTail(s.blocks, s.end, blocksInfo.Size(), err)
+			if tornErr != nil {
+				return fmt.Errorf("reading block record at offset %d: %w", s.end, tornErr)
+			}
+			if !torn {
+				return fmt.Errorf("%w: block record at offset %d: %v", CorruptedStoreError, s.end, err)
+			}
+			// Partially written tail record, cut it off
+			break
+		}
+		block, err := decodeBlock(payload)
+		if err != nil {
+			return fmt.Errorf("%w: block record at offset %d: %v", CorruptedStoreError, s.end, err)
+		}
+		length := uint32(len(payload))
+		hash, err := block.Header.Hash()
+		if err != nil {
+			return err
+		}
+		entry := indexEntry{hash: hash, height: s.recoveredHeight(block), offset: s.end, length: length}
+		if _, err := s.index.WriteAt(entry.bytes(), int64(len(s.entries))*indexEntrySize); err != nil {
+			return err
+		}
+		s.addEntry(entry)
+		s.end += recordHeaderSize + int64(length)
+	}
+	if err := s.blocks.Truncate(s.end); err != nil {
+		return err
+	}
+
+	if err := s.recoverUndo(); err != nil {
+		return err
+	}
+	if err := s.recoverInvalid(); err != nil {
+		return err
+	}
+
+	if err := s.blocks.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+// recoverUndo indexes the records of the undo file and truncates
+// a partially written tail record
+func (s *fileStore) recoverUndo() error {
+	info, err := s.undo.Stat()
+	if err != nil {
+		return err
+	}
+	for s.undoEnd < info.Size() {
+		payload, err := readPayload(s.undo, s.undoEnd, info.Size())
+		if err != nil {
+			torn, tornErr := tornTail(s.undo, s.undoEnd, info.Size(), err)
+			if tornErr != nil {
+				return fmt.Errorf("reading undo record at offset %d: %w", s.undoEnd, tornErr)
+			}
+			if !torn {
+				return fmt.Errorf("%w: undo record at offset %d: %v", CorruptedStoreError, s.undoEnd, err)
+			}
+			break
+		}
+		var record undoRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return fmt.Errorf("%w: undo record at offset %d: %v", CorruptedStoreError, s.undoEnd, err)
+		}
+		s.undoOffsets[record.Hash.ToFixedHash()] = s.undoEnd
+		s.undoEnd += recordHeaderSize + int64(len(payload))
+	}
+	if err := s.undo.Truncate(s.undoEnd); err != nil {
+		return err
+	}
+	return s.undo.Sync()
+}
+
+// recoverInvalid loads the hashes of invalid blocks and truncates a partially
+// written tail hash
+func (s *fileStore) recoverInvalid() error {
+	raw, err := io.ReadAll(s.invalid)
+	if err != nil {
+		return err
+	}
+	complete := len(raw) - len(raw)%crypto.HashSize
+	for i := 0; i < complete; i += crypto.HashSize {
+		s.invalidHashes[crypto.Hash(raw[i:i+crypto.HashSize]).ToFixedHash()] = struct{}{}
+	}
+	if err := s.invalid.Truncate(int64(complete)); err != nil {
+		return err
+	}
+	return s.invalid.Sync()
+}
+
+// recoveredHeight computes the height of a block recovered without an
+// index entry from the height of its parent
+func (s *fileStore) recoveredHeight(block *Block) uint64 {
+	if i, ok := s.byHash[block.Header.PreviousHash.ToFixedHash()]; ok {
+		return s.entries[i].height + 1
+	}
+	return 0
+}
+
+func (s *fileStore) addEntry(entry indexEntry) {
+	s.byHash[entry.hash.ToFixedHash()] = len(s.entries)
+	s.byHeight[entry.height] = append(s.byHeight[entry.height], len(s.entries))
+	s.entries = append(s.entries, entry)
+}
+
+// readPayload reads and verifies the payload of the record at the given offset
+// of the file whose records end at size. The length of the record is checked
+// before the payload gets allocated, so a corrupted one can't exhaust memory
+func readPayload(f *os.File, offset, size int64) ([]byte, error) {
+	if offset+recordHeaderSize > size {
+		return nil, TruncatedRecordError
+	}
+	header := make([]byte, recordHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], recordMagic[:]) {
+		return nil, CorruptedStoreError
+	}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return nil, CorruptedStoreError
+	}
+	if offset+recordHeaderSize+int64(length) > size {
+		return nil, TruncatedRecordError
+	}
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return nil, err
+	}
+	checksum, err := crypto.HashData(payload)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[8:12], checksum[:4]) {
+		return nil, CorruptedStoreError
+	}
+	return payload, nil
+}
+
+// tornTail reports if the record at the given offset, which failed to be read
+// with err, was being appended when the process stopped. Such a record is the
+// last one of the file: it's cut short by the end of the file, its payload
+// ends exactly at the end of the file, or only zeros (space the file system
+// allocated but never got written) follow its start
+func tornTail(f *os.File, offset, size int64, err error) (bool, error) {
+	if errors.Is(err, TruncatedRecordError) {
+		return true, nil
+	}
+	if !errors.Is(err, CorruptedStoreError) {
+		return false, err
+	}
+	header := make([]byte, recordHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return false, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[4:8]))
+	if bytes.Equal(header[:4], recordMagic[:]) && offset+recordHeaderSize+length == size {
+		return true, nil
+	}
+	buf := make([]byte, 64<<10)
+	for at := offset; at < size; {
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), size-at)], at)
+		if err != nil {
+			return false, err
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		at += int64(n)
+	}
+	return true, nil
+}
+
+// newRecord frames the payload with the magic bytes, its length and checksum
+func newRecord(payload []byte) ([]byte, error) {
+	checksum, err := crypto.HashData(payload)
+	if err != nil {
+		return nil, err
+	}
+	var record bytes.Buffer
+	record.Write(recordMagic[:])
+	binary.Write(&record, binary.BigEndian, uint32(len(payload)))
+	record.Write(checksum[:4])
+	record.Write(payload)
+	return record.Bytes(), nil
+}
+
+// readRecord reads and decodes the block record at the given offset
+func (s *fileStore) readRecord(offset int64) (*Block, uint32, error) {
+	payload, err := readPayload(s.blocks, offset, s.end)
+	if err != nil {
+		return nil, 0, err
+	}
+	block, err := decodeBlock(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return block, uint32(len(payload)), nil
+}
+
+func (s *fileStore) Put(height uint64, block *Block) error {
+	hash, err := block.Header.Hash()
+	if err != nil {
+		return err
+	}
+	payload, err := block.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	record, err := newRecord(payload)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Write the block before the index so that a crash in between
+	// leaves a record which is picked up again by recover
+	if _, err := s.blocks.WriteAt(record, s.end); err != nil {
+		return err
+	}
+	if err := s.blocks.Sync(); err != nil {
+		return err
+	}
+	entry := indexEntry{hash: hash, height: height, offset: s.end, length: uint32(len(payload))}
+	if _, err := s.index.WriteAt(entry.bytes(), int64(len(s.entries))*indexEntrySize); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	s.addEntry(entry)
+	s.end += int64(len(record))
+	return nil
+}
+
+func (s *fileStore) Get(hash crypto.Hash) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.byHash[hash.ToFixedHash()]
+	if !ok {
+		return nil, BlockNotFoundError
+	}
+	block, _, err := s.readRecord(s.entries[i].offset)
+	return block, err
+}
+
+func (s *fileStore) GetByHeight(height uint64) ([]*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.byHeight[height]) == 0 {
+		return nil, BlockNotFoundError
+	}
+	blocks := make([]*Block, 0, len(s.byHeight[height]))
+	for _, i := range s.byHeight[height] {
+		block, _, err := s.readRecord(s.entries[i].offset)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func (s *fileStore) ForEach(fn func(uint64, *Block) error) error {
+	s.mu.RLock()
+	entries := s.entries
+	s.mu.RUnlock()
+	for _, entry := range entries {
+		block, _, err := s.readRecord(entry.offset)
+		if err != nil {
+			return fmt.Errorf("reading block at height %d: %w", entry.height, err)
+		}
+		if err := fn(entry.height, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries)
+}
+
+func (s *fileStore) PutUndo(hash crypto.Hash, undo *BlockUndo) error {
+	payload, err := json.Marshal(undoRecord{Hash: hash, Undo: undo})
+	if err != nil {
+		return err
+	}
+	record, err := newRecord(payload)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.undo.WriteAt(record, s.undoEnd); err != nil {
+		return err
+	}
+	if err := s.undo.Sync(); err != nil {
+		return err
+	}
+	s.undoOffsets[hash.ToFixedHash()] = s.undoEnd
+	s.undoEnd += int64(len(record))
+	return nil
+}
+
+func (s *fileStore) GetUndo(hash crypto.Hash) (*BlockUndo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	offset, ok := s.undoOffsets[hash.ToFixedHash()]
+	if !ok {
+		return nil, UndoNotFoundError
+	}
+	payload, err := readPayload(s.undo, offset, s.undoEnd)
+	if err != nil {
+		return nil, err
+	}
+	var record undoRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return nil, err
+	}
+	return record.Undo, nil
+}
+
+func (s *fileStore) HasUndo(hash crypto.Hash) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.undoOffsets[hash.ToFixedHash()]
+	return ok
+}
+
+func (s *fileStore) PutInvalid(hash crypto.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.invalidHashes[hash.ToFixedHash()]; ok {
+		return nil
+	}
+	if _, err := s.invalid.WriteAt(hash, int64(len(s.invalidHashes))*crypto.HashSize); err != nil {
+		return err
+	}
+	if err := s.invalid.Sync(); err != nil {
+		return err
+	}
+	s.invalidHashes[hash.ToFixedHash()] = struct{}{}
+	return nil
+}
+
+func (s *fileStore) IsInvalid(hash crypto.Hash) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.invalidHashes[hash.ToFixedHash()]
+	return ok
+}
+
+func (s *fileStore) Close() error {
+	var err error
+	for _, f := range []*os.File{s.blocks, s.index, s.undo, s.invalid} {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
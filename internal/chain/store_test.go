@@ -0,0 +1,465 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// newStoreBlocks returns a branch of n blocks without transactions. The
+// store doesn't validate blocks so they don't need to be mined
+func newStoreBlocks(n int) []*Block {
+	blocks := make([]*Block, n)
+	previous := crypto.Hash(make([]byte, crypto.HashSize))
+	for i := range blocks {
+		block := NewBlock(nil)
+		block.SetPreviousHash(previous)
+		block.SetNonce(uint64(i))
+		blocks[i] = block
+		previous = block.Header.hash
+	}
+	return blocks
+}
+
+func openTestFileStore(t *testing.T, dir string) *fileStore {
+	t.Helper()
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*fileStore)
+}
+
+// putBlocks stores the blocks at increasing heights
+func putBlocks(t *testing.T, store BlockStore, blocks []*Block) {
+	t.Helper()
+	for i, block := range blocks {
+		if err := store.Put(uint64(i), block); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func encodeBlock(t *testing.T, block *Block) []byte {
+	t.Helper()
+	data, err := block.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// checkStoredBlocks checks the store holds exactly the blocks at increasing
+// heights, in order
+func checkStoredBlocks(t *testing.T, store BlockStore, blocks []*Block) {
+	t.Helper()
+	if store.Len() != len(blocks) {
+		t.Fatalf("expected %d blocks, got %d", len(blocks), store.Len())
+	}
+	i := 0
+	err := store.ForEach(func(height uint64, block *Block) error {
+		if height != uint64(i) {
+			t.Fatalf("block %d: expected height %d, got %d", i, i, height)
+		}
+		if !bytes.Equal(encodeBlock(t, block), encodeBlock(t, blocks[i])) {
+			t.Fatalf("block %d differs from the stored one", i)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// modifyFile applies fn to the content of the file in the store dir
+func modifyFile(t *testing.T, dir, name string, fn func([]byte) []byte) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, fn(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A crash in the middle of appending a block leaves a partial record at the
+// end of the block file, only the complete records before it come back
+func TestFileStoreTruncatedRecord(t *testing.T) {
+	blocks := newStoreBlocks(5)
+	for k := range blocks {
+		for _, cut := range []int64{1, recordHeaderSize, recordHeaderSize + 1, -1} {
+			dir := t.TempDir()
+			store := openTestFileStore(t, dir)
+			putBlocks(t, store, blocks)
+			entry := store.entries[k]
+			end := entry.offset + cut
+			if cut < 0 {
+				end = entry.offset + recordHeaderSize + int64(entry.length) + cut
+			}
+			store.Close()
+
+			// Only the block file made it to disk
+			if err := os.Truncate(filepath.Join(dir, blockFileName), end); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(filepath.Join(dir, indexFileName)); err != nil {
+				t.Fatal(err)
+			}
+			store = openTestFileStore(t, dir)
+			checkStoredBlocks(t, store, blocks[:k])
+
+			// The store keeps appending after the complete prefix
+			for i := k; i < len(blocks); i++ {
+				if err := store.Put(uint64(i), blocks[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store.Close()
+			store = openTestFileStore(t, dir)
+			checkStoredBlocks(t, store, blocks)
+			store.Close()
+		}
+	}
+}
+
+// Space allocated for a record which was never written reads as zeros
+func TestFileStoreZeroedTail(t *testing.T) {
+	blocks := newStoreBlocks(3)
+	dir := t.TempDir()
+	store := openTestFileStore(t, dir)
+	putBlocks(t, store, blocks)
+	store.Close()
+
+	modifyFile(t, dir, blockFileName, func(data []byte) []byte {
+		return append(data, make([]byte, 100)...)
+	})
+	store = openTestFileStore(t, dir)
+	checkStoredBlocks(t, store, blocks)
+	store.Close()
+}
+
+// A record whose payload didn't make it to disk is the last one of the file
+func TestFileStoreTornTailPayload(t *testing.T) {
+	blocks := newStoreBlocks(3)
+	dir := t.TempDir()
+	store := openTestFileStore(t, dir)
+	putBlocks(t, store, blocks)
+	last := store.entries[len(blocks)-1]
+	store.Close()
+
+	modifyFile(t, dir, blockFileName, func(data []byte) []byte {
+		clear(data[last.offset+recordHeaderSize:])
+		return data
+	})
+	if err := os.Remove(filepath.Join(dir, indexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	store = openTestFileStore(t, dir)
+	checkStoredBlocks(t, store, blocks[:len(blocks)-1])
+	store.Close()
+}
+
+// Corruption before the last record isn't the result of a crash, cutting the
+// file there would silently drop every later block
+func TestFileStoreCorruptedRecord(t *testing.T) {
+	blocks := newStoreBlocks(3)
+	tests := []struct {
+		name    string
+		corrupt func(data []byte, entry indexEntry)
+	}{
+		{"payload", func(data []byte, entry indexEntry) {
+			data[entry.offset+recordHeaderSize+5] ^= 1
+		}},
+		{"magic", func(data []byte, entry indexEntry) {
+			data[entry.offset] ^= 1
+		}},
+		{"huge length", func(data []byte, entry indexEntry) {
+			copy(data[entry.offset+4:], []byte{0xff, 0xff, 0xff, 0xff})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openTestFileStore(t, dir)
+			putBlocks(t, store, blocks)
+			entry := store.entries[1]
+			store.Close()
+			modifyFile(t, dir, blockFileName, func(data []byte) []byte {
+				test.corrupt(data, entry)
+				return data
+			})
+
+			// The index still points to the record, reading it fails
+			store = openTestFileStore(t, dir)
+			if err := store.ForEach(func(uint64, *Block) error { return nil }); !errors.Is(err, CorruptedStoreError) {
+				t.Fatalf("expected %v, got %v", CorruptedStoreError, err)
+			}
+			store.Close()
+
+			// Without the index the block file is scanned
+			if err := os.Remove(filepath.Join(dir, indexFileName)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := OpenFileStore(dir); !errors.Is(err, CorruptedStoreError) {
+				t.Fatalf("expected %v, got %v", CorruptedStoreError, err)
+			}
+			info, err := os.Stat(filepath.Join(dir, blockFileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() <= entry.offset+recordHeaderSize+int64(entry.length) {
+				t.Fatal("block file got truncated")
+			}
+		})
+	}
+}
+
+// The block file is the source of truth, a missing or broken index is
+// rebuilt from it
+func TestFileStoreIndexMismatch(t *testing.T) {
+	blocks := newStoreBlocks(4)
+	tests := []struct {
+		name   string
+		modify func([]byte) []byte
+	}{
+		{"missing", func([]byte) []byte { return nil }},
+		{"partial entry", func(data []byte) []byte { return data[:len(data)-indexEntrySize/2] }},
+		{"missing entries", func(data []byte) []byte { return data[:indexEntrySize] }},
+		{"stale entry", func(data []byte) []byte {
+			stale := indexEntry{hash: make(crypto.Hash, crypto.HashSize), offset: 1 << 30, length: 10}
+			return append(data[:2*indexEntrySize], stale.bytes()...)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openTestFileStore(t, dir)
+			putBlocks(t, store, blocks)
+			store.Close()
+
+			modifyFile(t, dir, indexFileName, test.modify)
+			store = openTestFileStore(t, dir)
+			checkStoredBlocks(t, store, blocks)
+			for i, block := range blocks {
+				stored, err := store.GetByHeight(uint64(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(stored) != 1 || !bytes.Equal(stored[0].Header.hash, block.Header.hash) {
+					t.Fatalf("wrong block at height %d", i)
+				}
+			}
+			store.Close()
+		})
+	}
+}
+
+// newStoredChain mines a chain of n blocks on top of genesis into a file
+// store in dir and closes it
+func newStoredChain(t *testing.T, dir string, params Params, n int) {
+	t.Helper()
+	c, err := LoadChain(dir, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := c.AddBlock(mineOn(t, c, tipBlock(c))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Undo records are written when a block gets connected, the ones lost in a
+// crash are written again when the chain is reloaded
+func TestFileStoreUndoMismatch(t *testing.T) {
+	dir := t.TempDir()
+	params := DefaultParams
+	newStoredChain(t, dir, params, 3)
+	store := openTestFileStore(t, dir)
+	offsets := make([]int64, 0, len(store.undoOffsets))
+	for _, offset := range store.undoOffsets {
+		offsets = append(offsets, offset)
+	}
+	store.Close()
+	last := offsets[0]
+	for _, offset := range offsets {
+		last = max(last, offset)
+	}
+
+	modifyFile(t, dir, undoFileName, func(data []byte) []byte { return data[:last+3] })
+	c, err := LoadChain(dir, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Length() != 4 {
+		t.Fatalf("expected 4 blocks, got %d", c.Length())
+	}
+	for _, node := range c.active {
+		if !c.store.HasUndo(node.hash) {
+			t.Fatalf("undo record of block at height %d wasn't written again", node.height)
+		}
+	}
+	c.Close()
+
+	// A corrupted record followed by others isn't a crash
+	modifyFile(t, dir, undoFileName, func(data []byte) []byte {
+		data[recordHeaderSize+1] ^= 1
+		return data
+	})
+	if _, err := OpenFileStore(dir); !errors.Is(err, CorruptedStoreError) {
+		t.Fatalf("expected %v, got %v", CorruptedStoreError, err)
+	}
+}
+
+// Both stores implement the same BlockStore behavior, the file store also
+// after it's reopened
+func TestBlockStores(t *testing.T) {
+	blocks := newStoreBlocks(3)
+	// A second block at height 1
+	fork := NewBlock(nil)
+	fork.SetPreviousHash(blocks[0].Header.hash)
+	fork.SetNonce(100)
+	undo := &BlockUndo{
+		CreatedUtxos: []crypto.Hash{blocks[1].Header.hash},
+		KeyImages:    [][]byte{{1, 2, 3}},
+	}
+
+	tests := []struct {
+		name   string
+		open   func(t *testing.T) BlockStore
+		reopen func(t *testing.T, store BlockStore) BlockStore
+	}{
+		{
+			"memory",
+			func(*testing.T) BlockStore { return NewMemoryStore() },
+			func(_ *testing.T, store BlockStore) BlockStore { return store },
+		},
+		{
+			"file",
+			func(t *testing.T) BlockStore { return openTestFileStore(t, t.TempDir()) },
+			func(t *testing.T, store BlockStore) BlockStore {
+				dir := filepath.Dir(store.(*fileStore).blocks.Name())
+				store.Close()
+				return openTestFileStore(t, dir)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := test.open(t)
+			hash := blocks[2].Header.hash
+			if _, err := store.Get(hash); !errors.Is(err, BlockNotFoundError) {
+				t.Fatalf("expected %v, got %v", BlockNotFoundError, err)
+			}
+			if _, err := store.GetUndo(hash); !errors.Is(err, UndoNotFoundError) {
+				t.Fatalf("expected %v, got %v", UndoNotFoundError, err)
+			}
+			putBlocks(t, store, blocks)
+			if err := store.Put(1, fork); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.PutUndo(hash, undo); err != nil {
+				t.Fatal(err)
+			}
+			if store.IsInvalid(fork.Header.hash) {
+				t.Fatal("block is invalid before being marked")
+			}
+			if err := store.PutInvalid(fork.Header.hash); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, stage := range []string{"written", "reopened"} {
+				if stage == "reopened" {
+					store = test.reopen(t, store)
+				}
+				if store.Len() != 4 {
+					t.Fatalf("%s: expected 4 blocks, got %d", stage, store.Len())
+				}
+				var order []crypto.Hash
+				var heights []uint64
+				err := store.ForEach(func(height uint64, block *Block) error {
+					order = append(order, block.Header.hash)
+					heights = append(heights, height)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected := []crypto.Hash{blocks[0].Header.hash, blocks[1].Header.hash, blocks[2].Header.hash, fork.Header.hash}
+				if !reflect.DeepEqual(order, expected) || !reflect.DeepEqual(heights, []uint64{0, 1, 2, 1}) {
+					t.Fatalf("%s: blocks aren't iterated in insertion order", stage)
+				}
+
+				for _, block := range append([]*Block{fork}, blocks...) {
+					stored, err := store.Get(block.Header.hash)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(encodeBlock(t, stored), encodeBlock(t, block)) {
+						t.Fatalf("%s: stored block differs", stage)
+					}
+				}
+				atHeight, err := store.GetByHeight(1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(atHeight) != 2 || !bytes.Equal(atHeight[0].Header.hash, blocks[1].Header.hash) ||
+					!bytes.Equal(atHeight[1].Header.hash, fork.Header.hash) {
+					t.Fatalf("%s: expected both blocks at height 1", stage)
+				}
+				if _, err := store.GetByHeight(3); !errors.Is(err, BlockNotFoundError) {
+					t.Fatalf("%s: expected %v, got %v", stage, BlockNotFoundError, err)
+				}
+
+				if !store.HasUndo(hash) || store.HasUndo(fork.Header.hash) {
+					t.Fatalf("%s: wrong undo records", stage)
+				}
+				stored, err := store.GetUndo(hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(stored, undo) {
+					t.Fatalf("%s: expected undo %+v, got %+v", stage, undo, stored)
+				}
+				if !store.IsInvalid(fork.Header.hash) || store.IsInvalid(hash) {
+					t.Fatalf("%s: wrong invalid blocks", stage)
+				}
+			}
+			store.Close()
+		})
+	}
+}
+
+// A data dir created with other consensus parameters isn't replayed
+func TestLoadChainGenesisMismatch(t *testing.T) {
+	dir := t.TempDir()
+	newStoredChain(t, dir, DefaultParams, 1)
+
+	owner, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadChain(dir, newTestParams(t, owner, 1)); !errors.Is(err, GenesisMismatchError) {
+		t.Fatalf("expected %v, got %v", GenesisMismatchError, err)
+	}
+	c, err := LoadChain(dir, DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Length() != 2 {
+		t.Fatalf("expected 2 blocks, got %d", c.Length())
+	}
+	c.Close()
+}
@@ -0,0 +1,68 @@
+package chain
+
+import (
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+// BlockUndo records every change connecting a block made to the chain
+// state, so the block can be disconnected again during a reorg or when
+// recovering from a crash in the middle of connecting it. The utxo set is
+// append-only: the real input of a ring is hidden among the decoys so
+// spending never removes an output, only its key image marks it spent
+type BlockUndo struct {
+	// Hashes of the utxos the block added to the set
+	CreatedUtxos []crypto.Hash `json:"created_utxos"`
+	// Key images the block marked as spent
+	KeyImages [][]byte `json:"key_images"`
+}
+
+// ConnectBlock applies the transactions of the block to the utxo set and the
+// set of spent key images and returns the undo record of the changes. If it
+// fails midway the changes applied so far are reverted
+func ConnectBlock(utxos UtxoSet, keyImages KeyImageSet, block *Block) (*BlockUndo, error) {
+	undo := new(BlockUndo)
+	for _, txn := range block.Transactions {
+		for _, image := range txn.KeyImages() {
+			if err := keyImages.Add(image); err != nil {
+				DisconnectBlock(utxos, keyImages, undo)
+				return nil, err
+			}
+			undo.KeyImages = append(undo.KeyImages, image)
+		}
+
+		for _, utxo := range txn.UtxosOut {
+			hash, err := utxo.Hash()
+			if err != nil {
+				DisconnectBlock(utxos, keyImages, undo)
+				return nil, err
+			}
+			// An identical output is already in the set, the block doesn't
+			// change it so it mustn't be removed when disconnecting
+			if utxos.Get(hash.ToFixedHash()) != nil {
+				continue
+			}
+			if err := utxos.Add(utxo); err != nil {
+				DisconnectBlock(utxos, keyImages, undo)
+				return nil, err
+			}
+			undo.CreatedUtxos = append(undo.CreatedUtxos, hash)
+		}
+	}
+	return undo, nil
+}
+
+// DisconnectBlock reverts the changes recorded in the undo record, restoring
+// the utxo set and the set of spent key images to their exact previous state
+func DisconnectBlock(utxos UtxoSet, keyImages KeyImageSet, undo *BlockUndo) error {
+	for _, hash := range undo.CreatedUtxos {
+		if utxo := utxos.Get(hash.ToFixedHash()); utxo != nil {
+			if err := utxos.Remove(*utxo); err != nil {
+				return err
+			}
+		}
+	}
+	for _, image := range undo.KeyImages {
+		keyImages.Remove(image)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+const (
+	// Number of previous blocks used to compute the median time past
+	medianTimeBlocks = 11
+	// How far in the future a block timestamp is allowed to be
+	maxFutureBlockTime = 2 * time.Hour
+	// MaxBlockSize is the maximum size of the binary block encoding. The JSON
+	// sent on the wire is about 2.5 times larger, so a block always fits in a
+	// message of at most messages.MaxPayloadSize (4 MB)
+	MaxBlockSize = 1 << 20
+)
+
+// Verifies the signatures and range proofs of every block using all cores
+var blockVerifier = transaction.NewBatchVerifier(runtime.NumCPU())
+
+var (
+	InvalidPreviousHashError   = errors.New("Block doesn't extend the current tip")
+	MalformedPreviousHashError = errors.New("Previous hash isn't a full block hash")
+	DuplicateBlockError        = errors.New("Block is already known")
+	KnownInvalidBlockError     = errors.New("Block or its parent failed validation before")
+	OrphanBlockError           = errors.New("Block parent is unknown")
+	BlockTooLargeError         = errors.New("Block is larger than the maximum block size")
+	InvalidMerkleRootError     = errors.New("Merkle root doesn't match the transactions")
+	InvalidDifficultyError     = errors.New("Block target doesn't match the expected difficulty")
+	InvalidProofOfWorkError    = errors.New("Block hash doesn't meet its target")
+	TimestampTooOldError       = errors.New("Block timestamp isn't after the median time of previous blocks")
+	TimestampTooNewError       = errors.New("Block timestamp is too far in the future")
+	InvalidTransactionError    = errors.New("Transaction amounts are invalid")
+	InvalidRangeProofError     = errors.New("Range proof of the outputs is invalid")
+	UnknownRingMemberError     = errors.New("Ring member isn't a known output")
+	ImmatureRingMemberError    = errors.New("Ring member is too recent to be spent")
+	InvalidSignatureError      = errors.New("Ring signature is invalid")
+	LegacySignatureError       = errors.New("Ring signature uses the legacy key image hash")
+	UnboundSignatureError      = errors.New("Ring signature doesn't bind the pseudo output")
+	InvalidKeyImageError       = errors.New("Key image isn't a valid point")
+	DuplicateKeyImageError     = errors.New("Key image was already spent")
+)
+
+// ValidationError explains why a block got rejected. Reason is one of the
+// sentinel errors above so callers can match it with errors.Is
+type ValidationError struct {
+	// Index of the offending transaction in the block, -1 if
+	// the block itself is invalid
+	Tx     int
+	Reason error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Tx < 0 {
+		return fmt.Sprintf("invalid block: %v", e.Reason)
+	}
+	return fmt.Sprintf("invalid transaction %d: %v", e.Tx, e.Reason)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Reason
+}
+
+func blockError(reason error) error {
+	return &ValidationError{Tx: -1, Reason: reason}
+}
+
+func txError(i int, reason error) error {
+	return &ValidationError{Tx: i, Reason: reason}
+}
+
+// ValidateBlock checks if the block can be appended to the current tip
+// of the chain. The returned error is a *ValidationError
+func (c *Chain) ValidateBlock(block *Block) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !bytes.Equal(block.Header.PreviousHash, c.tip().hash) {
+		return blockError(InvalidPreviousHashError)
+	}
+	if err := checkBlockSanity(block); err != nil {
+		return err
+	}
+	if err := c.checkHeaderContext(block.Header, c.tip()); err != nil {
+		return err
+	}
+	return c.checkBlockState(block, uint64(len(c.active)))
+}
+
+// checkHeaderSanity runs the checks of the header which don't depend on the chain
+func checkHeaderSanity(header Header) error {
+	// The header encoding pads or truncates the previous hash, without the
+	// check a malformed one would still link to the parent under a new hash
+	if len(header.PreviousHash) != crypto.HashSize {
+		return blockError(MalformedPreviousHashError)
+	}
+	hash, err := header.Hash()
+	if err != nil {
+		return err
+	}
+	if !CheckProofOfWork(hash, header.Bits) {
+		return blockError(InvalidProofOfWorkError)
+	}
+	if header.Time.After(time.Now().Add(maxFutureBlockTime)) {
+		return blockError(TimestampTooNewError)
+	}
+	return nil
+}
+
+// checkBlockSanity runs the checks which don't depend on the chain
+func checkBlockSanity(block *Block) error {
+	if err := checkHeaderSanity(block.Header); err != nil {
+		return err
+	}
+	data, err := block.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxBlockSize {
+		return blockError(BlockTooLargeError)
+	}
+
+	tree, err := block.MerkleTree()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(tree.RootHash(), block.Header.MerkleRoot) {
+		return blockError(InvalidMerkleRootError)
+	}
+
+	blockImages := make(map[string]struct{})
+	for i, txn := range block.Transactions {
+		if err := checkTransactionSanity(txn); err != nil {
+			return txError(i, err)
+		}
+		for _, image := range txn.KeyImages() {
+			if _, ok := blockImages[string(image)]; ok {
+				return txError(i, DuplicateKeyImageError)
+			}
+			blockImages[string(image)] = struct{}{}
+		}
+	}
+
+	// The expensive cryptographic checks run for the whole block at once.
+	// Signatures need the ring members so they're checked with the state
+	if i := blockVerifier.VerifyRangeProofs(block.Transactions); i >= 0 {
+		return txError(i, InvalidRangeProofError)
+	}
+	return nil
+}
+
+// checkHeaderContext checks the header against the branch it extends
+func (c *Chain) checkHeaderContext(header Header, parent *blockNode) error {
+	if header.Bits != c.nextBits(parent) {
+		return blockError(InvalidDifficultyError)
+	}
+	if !header.Time.After(medianTimePast(parent)) {
+		return blockError(TimestampTooOldError)
+	}
+	return nil
+}
+
+// checkBlockState checks the block at the given height against the state of
+// the active chain: the key images can't be spent yet and the ring members
+// have to be mature outputs of the chain which the signatures are valid for.
+// Expects the parent of the block to be the current tip
+func (c *Chain) checkBlockState(block *Block, height uint64) error {
+	resolved := make([]transaction.Transaction, len(block.Transactions))
+	for i, txn := range block.Transactions {
+		for _, image := range txn.KeyImages() {
+			if c.keyImages.Contains(image) {
+				return txError(i, DuplicateKeyImageError)
+			}
+		}
+		var err error
+		if resolved[i], err = c.resolveRings(txn, height); err != nil {
+			return txError(i, err)
+		}
+	}
+	if i := blockVerifier.VerifySignatures(resolved); i >= 0 {
+		return txError(i, InvalidSignatureError)
+	}
+	return nil
+}
+
+// resolveRings returns a copy of the transaction with the ring members of its
+// inputs looked up in the output index. Every member has to be spendable by a
+// block at the given height
+func (c *Chain) resolveRings(txn transaction.Transaction, height uint64) (transaction.Transaction, error) {
+	inputs := make([]transaction.TxInput, len(txn.Inputs))
+	for i, in := range txn.Inputs {
+		indices, err := transaction.DecodeRingOffsets(in.RingOffsets)
+		if err != nil {
+			return txn, err
+		}
+		ring := make([]transaction.Utxo, len(indices))
+		for j, index := range indices {
+			entry, err := c.outputs.Get(index)
+			if err != nil {
+				return txn, UnknownRingMemberError
+			}
+			if entry.Height+c.params.OutputMaturity > height {
+				return txn, ImmatureRingMemberError
+			}
+			ring[j] = entry.Utxo
+		}
+		in.SetRing(ring)
+		inputs[i] = in
+	}
+	txn.Inputs = inputs
+	return txn, nil
+}
+
+// CheckTransaction checks if the transaction could be included in a block
+// on top of the active chain: it has to be valid, can't spend any key image
+// which is already spent and its ring members have to be mature outputs
+func (c *Chain) CheckTransaction(txn transaction.Transaction) error {
+	if err := validateTransaction(txn); err != nil {
+		return err
+	}
+	c.mu.RLock()
+	for _, image := range txn.KeyImages() {
+		if c.keyImages.Contains(image) {
+			c.mu.RUnlock()
+			return DuplicateKeyImageError
+		}
+	}
+	resolved, err := c.resolveRings(txn, uint64(len(c.active)))
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	message := resolved.SignatureMessage()
+	for _, in := range resolved.Inputs {
+		if !in.Signature.Verify(message, in.PseudoOutput) {
+			return InvalidSignatureError
+		}
+	}
+	return nil
+}
+
+// validateTransaction runs the context free checks of a single transaction,
+// everything but the ring signatures which need the ring members
+func validateTransaction(txn transaction.Transaction) error {
+	if err := checkTransactionSanity(txn); err != nil {
+		return err
+	}
+	if !txn.CheckRangeProof() {
+		return InvalidRangeProofError
+	}
+	return nil
+}
+
+// checkTransactionSanity runs the cheap checks of a single transaction,
+// leaving out the range proof and the ring signatures
+func checkTransactionSanity(txn transaction.Transaction) error {
+	if !txn.CheckValidity() {
+		return InvalidTransactionError
+	}
+	images := make(map[string]struct{})
+	for _, in := range txn.Inputs {
+		if _, ok := images[string(in.Signature.Image)]; ok {
+			return DuplicateKeyImageError
+		}
+		images[string(in.Signature.Image)] = struct{}{}
+		if in.Signature.Legacy() {
+			return LegacySignatureError
+		}
+		// Only CLSAG proves the pseudo output commits to the amount of the
+		// real input, with any other scheme it could be picked freely
+		if in.Signature.Version != transaction.CLSAGV2SignatureVersion {
+			return UnboundSignatureError
+		}
+		if _, err := transaction.DecodeRingOffsets(in.RingOffsets); err != nil {
+			return err
+		}
+		if err := CheckKeyImage(in.Signature.Image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// medianTimePast returns the median timestamp of the last medianTimeBlocks
+// blocks of the branch ending with the given node
+func medianTimePast(node *blockNode) time.Time {
+	times := make([]time.Time, 0, medianTimeBlocks)
+	for n := node; n != nil && len(times) < medianTimeBlocks; n = n.parent {
+		times = append(times, n.block.Header.Time)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times[len(times)/2]
+}
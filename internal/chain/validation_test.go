@@ -0,0 +1,152 @@
+package chain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"filippo.io/edwards25519"
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// An LSAG signature only proves ownership of a ring member, so a spender
+// could commit to any amount in the pseudo output and mint coins
+func TestRejectUnboundSignature(t *testing.T) {
+	sender, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	real, _, err := sender.NewOutput(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := DefaultParams
+	params.GenesisOutputs = []transaction.Utxo{*real}
+	c, err := NewChainWithStore(NewMemoryStore(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Spend the output worth 5 as if it was worth 1000
+	out, outMask, err := receiver.NewOutput(999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeProof, err := transaction.NewRangeProof([]transaction.Amount{999}, []*edwards25519.Scalar{outMask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := transaction.Transaction{
+		Inputs: []transaction.TxInput{{
+			RingOffsets:  transaction.EncodeRingOffsets([]uint64{0}),
+			Ring:         []transaction.Utxo{*real},
+			PseudoOutput: transaction.Commit(1000, outMask).Bytes(),
+		}},
+		UtxosOut:   []transaction.Utxo{*out},
+		RangeProof: rangeProof,
+		Fee:        1,
+		To:         out.Keypair,
+	}
+	message := txn.SignatureMessage()
+	txn.Inputs[0].Signature = sender.NewRingSignature(*real, nil, message)
+
+	if !txn.CheckValidity() {
+		t.Fatal("inflated commitments should balance")
+	}
+	if err := txn.Inputs[0].Signature.CheckSignatureValidity(message); err != nil {
+		t.Fatalf("LSAG signature should be valid on its own: %v", err)
+	}
+	if err := c.CheckTransaction(txn); !errors.Is(err, UnboundSignatureError) {
+		t.Fatalf("expected %v, got %v", UnboundSignatureError, err)
+	}
+}
+
+// Parents are indexed by a hash prefix, a truncated or padded previous hash
+// must not link to them
+func TestRejectMalformedPreviousHash(t *testing.T) {
+	c := NewChain()
+	tip, err := c.TipHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, previous := range []crypto.Hash{tip[:16], append(append(crypto.Hash{}, tip...), 1)} {
+		block := NewBlock(nil)
+		block.SetPreviousHash(previous)
+		if err := c.AddBlock(block); !errors.Is(err, MalformedPreviousHashError) {
+			t.Fatalf("expected %v, got %v", MalformedPreviousHashError, err)
+		}
+	}
+}
+
+func TestRejectMalformedPreviousHeaderHash(t *testing.T) {
+	c := NewChain()
+	tip, err := c.TipHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := NewBlock(nil)
+	block.SetPreviousHash(tip[:16])
+	if _, err := c.AcceptHeaders([]Header{block.Header}, "peer"); !errors.Is(err, MalformedPreviousHashError) {
+		t.Fatalf("expected %v, got %v", MalformedPreviousHashError, err)
+	}
+}
+
+// A header whose block turns out invalid must not stay the best header,
+// otherwise the node keeps waiting for its block
+func TestInvalidBlockResetsBestHeader(t *testing.T) {
+	c := NewChain()
+	tip, err := c.TipHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := addr.NewOutput(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Outputs created out of thin air
+	block := NewBlock([]transaction.Transaction{{UtxosOut: []transaction.Utxo{*out}, To: out.Keypair}})
+	block.SetPreviousHash(tip)
+	block.Header.Time = time.Now()
+	block.Header.Bits = c.NextBits()
+	NewMiner(1).MineBlock(block, nil)
+
+	if _, err := c.AcceptHeaders([]Header{block.Header}, "peer"); err != nil {
+		t.Fatal(err)
+	}
+	if c.BestHeaderHeight() != 1 {
+		t.Fatalf("expected best header at height 1, got %d", c.BestHeaderHeight())
+	}
+	if err := c.AddBlock(block); !errors.Is(err, InvalidTransactionError) {
+		t.Fatalf("expected %v, got %v", InvalidTransactionError, err)
+	}
+	if c.BestHeaderHeight() != 0 {
+		t.Fatalf("expected best header at height 0, got %d", c.BestHeaderHeight())
+	}
+	if _, err := c.AcceptHeaders([]Header{block.Header}, "peer"); !errors.Is(err, KnownInvalidBlockError) {
+		t.Fatalf("expected %v, got %v", KnownInvalidBlockError, err)
+	}
+}
+
+func TestRejectOversizedBlock(t *testing.T) {
+	owner, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := newTestParams(t, owner, 2)
+	c := newTestChain(t, params)
+	txn := newSpend(t, c, owner, params.GenesisOutputs[0], params.GenesisOutputs[1])
+
+	block := mineOn(t, c, tipBlock(c), oversizedTransactions(t, txn)...)
+	if err := c.AddBlock(block); !errors.Is(err, BlockTooLargeError) {
+		t.Fatalf("expected %v, got %v", BlockTooLargeError, err)
+	}
+}
@@ -0,0 +1,258 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"filippo.io/edwards25519"
+)
+
+// Primitives of the canonical binary encoding of transactions and blocks.
+// Integers and lengths are unsigned LEB128 varints using the fewest bytes
+// possible, points and scalars are written as their fixed 32 byte encoding
+// and variable length byte strings are prefixed with their length. Every
+// value has exactly one encoding so it can be hashed, encodings of points
+// and scalars which aren't the canonical ones are rejected
+
+// Size of an encoded point or scalar
+const ElementSize = 32
+
+var (
+	ShortBufferError        = errors.New("Unexpected end of the encoded data")
+	NonCanonicalError       = errors.New("Value isn't canonically encoded")
+	TrailingBytesError      = errors.New("Trailing bytes after the encoded value")
+	InvalidLengthError      = errors.New("Length is larger than the remaining data")
+	InvalidElementError     = errors.New("Point or scalar has to be 32 bytes long")
+	InvalidPointError       = errors.New("Encoded point isn't a valid point")
+	UnsupportedVersionError = errors.New("Unsupported encoding version")
+)
+
+// Writer builds an encoding. The first error is kept and every write after it is ignored
+type Writer struct {
+	buf bytes.Buffer
+	err error
+}
+
+func (w *Writer) Byte(b byte) {
+	if w.err == nil {
+		w.buf.WriteByte(b)
+	}
+}
+
+func (w *Writer) Uvarint(v uint64) {
+	if w.err == nil {
+		w.buf.Write(binary.AppendUvarint(nil, v))
+	}
+}
+
+// Element writes a point or scalar, which has to be exactly ElementSize bytes
+func (w *Writer) Element(e []byte) {
+	if w.err != nil {
+		return
+	}
+	if len(e) != ElementSize {
+		w.err = InvalidElementError
+		return
+	}
+	w.buf.Write(e)
+}
+
+// Elements writes the number of elements followed by the elements
+func (w *Writer) Elements(es [][]byte) {
+	w.Uvarint(uint64(len(es)))
+	for _, e := range es {
+		w.Element(e)
+	}
+}
+
+// Fixed writes bytes whose length is known to the reader
+func (w *Writer) Fixed(b []byte) {
+	if w.err == nil {
+		w.buf.Write(b)
+	}
+}
+
+// Bytes writes a length prefixed byte string
+func (w *Writer) Bytes(b []byte) {
+	w.Uvarint(uint64(len(b)))
+	w.Fixed(b)
+}
+
+// Fail records an error of the caller, e.g. a value which can't be encoded
+func (w *Writer) Fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Result returns the encoding or the first error
+func (w *Writer) Result() ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// Reader decodes an encoding. The first error is kept, every read after it
+// returns zero values
+type Reader struct {
+	data []byte
+	err  error
+}
+
+func NewReader(data []byte) *Reader {
+	return &Reader{data: data}
+}
+
+func (r *Reader) Byte() byte {
+	b := r.Fixed(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *Reader) Uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n == 0 {
+		r.err = ShortBufferError
+		return 0
+	}
+	// Overflows and padded encodings have more than one representation
+	if n < 0 || n != len(binary.AppendUvarint(nil, v)) {
+		r.err = NonCanonicalError
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// Count reads the number of items which follow, each taking at least minSize
+// bytes. Counts which can't fit in the remaining data are rejected before
+// anything gets allocated for them
+func (r *Reader) Count(minSize int) int {
+	count := r.Uvarint()
+	if r.err != nil {
+		return 0
+	}
+	if minSize < 1 {
+		minSize = 1
+	}
+	if count > uint64(len(r.data)/minSize) {
+		r.err = InvalidLengthError
+		return 0
+	}
+	return int(count)
+}
+
+func (r *Reader) Element() []byte {
+	return r.Fixed(ElementSize)
+}
+
+func (r *Reader) Elements() [][]byte {
+	return r.elements(r.Element)
+}
+
+func (r *Reader) elements(read func() []byte) [][]byte {
+	count := r.Count(ElementSize)
+	if r.err != nil || count == 0 {
+		return nil
+	}
+	es := make([][]byte, count)
+	for i := range es {
+		es[i] = read()
+	}
+	return es
+}
+
+// Point reads an element which has to be the canonical encoding of a point.
+// Points also decode from encodings with y >= p or with the sign bit set
+// for x = 0, re-encoding the point catches those
+func (r *Reader) Point() []byte {
+	e := r.Element()
+	if r.err != nil {
+		return nil
+	}
+	p, err := new(edwards25519.Point).SetBytes(e)
+	if err != nil {
+		r.err = InvalidPointError
+		return nil
+	}
+	if !bytes.Equal(p.Bytes(), e) {
+		r.err = NonCanonicalError
+		return nil
+	}
+	return e
+}
+
+// Points reads the number of points followed by the points
+func (r *Reader) Points() [][]byte {
+	return r.elements(r.Point)
+}
+
+// Scalar reads an element which has to be a scalar reduced modulo l
+func (r *Reader) Scalar() []byte {
+	e := r.Element()
+	if r.err != nil {
+		return nil
+	}
+	if _, err := edwards25519.NewScalar().SetCanonicalBytes(e); err != nil {
+		r.err = NonCanonicalError
+		return nil
+	}
+	return e
+}
+
+// Scalars reads the number of scalars followed by the scalars
+func (r *Reader) Scalars() [][]byte {
+	return r.elements(r.Scalar)
+}
+
+// Fixed reads n bytes. The returned slice is a copy
+func (r *Reader) Fixed(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = ShortBufferError
+		return nil
+	}
+	b := append([]byte{}, r.data[:n]...)
+	r.data = r.data[n:]
+	return b
+}
+
+// Bytes reads a length prefixed byte string
+func (r *Reader) Bytes() []byte {
+	n := r.Count(1)
+	if r.err != nil {
+		return nil
+	}
+	return r.Fixed(n)
+}
+
+// Fail records an error of the caller, e.g. a decoded value which is invalid
+func (r *Reader) Fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Finish returns the first error or TrailingBytesError if some data wasn't read
+func (r *Reader) Finish() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.data) != 0 {
+		return TrailingBytesError
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestNonCanonicalElements(t *testing.T) {
+	tests := []struct {
+		name     string
+		read     func(*Reader) []byte
+		encoding string
+		expected error
+	}{
+		// y = p decodes like y = 0
+		{"point with y = p", (*Reader).Point, "edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f", NonCanonicalError},
+		{"canonical point", (*Reader).Point, "0000000000000000000000000000000000000000000000000000000000000000", nil},
+		// y = 2 isn't on the curve
+		{"invalid point", (*Reader).Point, "0200000000000000000000000000000000000000000000000000000000000000", InvalidPointError},
+		{"scalar l", (*Reader).Scalar, "edd3f55c1a631258d69cf7a2def9de1400000000000000000000000000000010", NonCanonicalError},
+		{"scalar l - 1", (*Reader).Scalar, "ecd3f55c1a631258d69cf7a2def9de1400000000000000000000000000000010", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := hex.DecodeString(test.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(data)
+			test.read(r)
+			if err := r.Finish(); !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestNonCanonicalUvarint(t *testing.T) {
+	for _, data := range [][]byte{{0x80, 0x00}, {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}} {
+		r := NewReader(data)
+		r.Uvarint()
+		if err := r.Finish(); !errors.Is(err, NonCanonicalError) {
+			t.Fatalf("%x: expected %v, got %v", data, NonCanonicalError, err)
+		}
+	}
+}
+
+// FuzzDecodeElements checks that every decodable sequence of a varint, a
+// point, a scalar and a byte string has exactly one encoding
+func FuzzDecodeElements(f *testing.F) {
+	w := new(Writer)
+	w.Uvarint(300)
+	w.Element(make([]byte, ElementSize))
+	w.Element(make([]byte, ElementSize))
+	w.Bytes([]byte("learncoin"))
+	seed, err := w.Result()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(seed)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewReader(data)
+		v, point, scalar, b := r.Uvarint(), r.Point(), r.Scalar(), r.Bytes()
+		if r.Finish() != nil {
+			return
+		}
+		w := new(Writer)
+		w.Uvarint(v)
+		w.Element(point)
+		w.Element(scalar)
+		w.Bytes(b)
+		encoded, err := w.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Fatalf("%x re-encoded as %x", data, encoded)
+		}
+	})
+}
@@ -1,7 +1,13 @@
 package constants
 
 const (
-	Version  = "learncoind/v0.1"
-	ConnAddr = "0.0.0.0"
-	ConnType = "tcp"
+	Version = "learncoind/v0.1"
+	// Version of the wire protocol and the oldest one still supported
+	ProtocolVersion    uint32 = 1
+	MinProtocolVersion uint32 = 1
+	ConnAddr                  = "0.0.0.0"
+	ConnType                  = "tcp"
+
+	// Directory holding the node config and the chain data
+	DataDir = "data"
 )
@@ -0,0 +1,174 @@
+package ed25519
+
+import (
+	"crypto/sha512"
+	"errors"
+	"math/big"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+)
+
+// Hashing to edwards25519 as specified by RFC 9380 with the
+// edwards25519_XMD:SHA-512_ELL2_RO_ suite: the message is expanded into two
+// field elements, both get mapped to the curve with Elligator 2, and the sum
+// of the points is multiplied by the cofactor. Nobody knows the discrete
+// logarithm of the result with respect to any other point
+
+const (
+	// Bytes per field element in hash_to_field, L = ceil((ceil(log2(p)) + k) / 8)
+	fieldElementLength = 48
+	// Input block size of SHA-512
+	sha512BlockSize = 128
+)
+
+var InvalidDSTError = errors.New("Domain separation tag must be 1 to 255 bytes long")
+
+var (
+	// Field prime p = 2^255 - 19
+	fieldPrime, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+	// Montgomery curve25519 constant J = 486662
+	montgomeryJ = feFromUint64(486662)
+	// sqrt(-486664) with sgn0 = 0, used by the rational map to edwards25519
+	edwardsMapConstant = func() *field.Element {
+		minus := new(field.Element).Negate(feFromUint64(486664))
+		c, _ := new(field.Element).SqrtRatio(minus, new(field.Element).One())
+		return c
+	}()
+)
+
+func feFromUint64(v uint64) *field.Element {
+	buf := make([]byte, 32)
+	for i := 0; i < 8; i++ {
+		buf[i] = byte(v >> (8 * i))
+	}
+	fe, _ := new(field.Element).SetBytes(buf)
+	return fe
+}
+
+// ExpandMessageXMD implements expand_message_xmd with SHA-512
+func ExpandMessageXMD(msg, dst []byte, length int) ([]byte, error) {
+	if len(dst) == 0 || len(dst) > 255 {
+		return nil, InvalidDSTError
+	}
+	ell := (length + sha512.Size - 1) / sha512.Size
+	if ell > 255 || length > 65535 {
+		return nil, errors.New("Requested too many bytes from expand_message_xmd")
+	}
+	dstPrime := append(append([]byte{}, dst...), byte(len(dst)))
+
+	h := sha512.New()
+	h.Write(make([]byte, sha512BlockSize))
+	h.Write(msg)
+	h.Write([]byte{byte(length >> 8), byte(length), 0})
+	h.Write(dstPrime)
+	b0 := h.Sum(nil)
+
+	h.Reset()
+	h.Write(b0)
+	h.Write([]byte{1})
+	h.Write(dstPrime)
+	bi := h.Sum(nil)
+
+	uniform := append([]byte{}, bi...)
+	for i := 2; i <= ell; i++ {
+		h.Reset()
+		for j := range bi {
+			bi[j] ^= b0[j]
+		}
+		h.Write(bi)
+		h.Write([]byte{byte(i)})
+		h.Write(dstPrime)
+		bi = h.Sum(nil)
+		uniform = append(uniform, bi...)
+	}
+	return uniform[:length], nil
+}
+
+// hashToField hashes the message to count field elements
+func hashToField(msg, dst []byte, count int) ([]*field.Element, error) {
+	uniform, err := ExpandMessageXMD(msg, dst, count*fieldElementLength)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*field.Element, count)
+	for i := range res {
+		e := new(big.Int).SetBytes(uniform[i*fieldElementLength : (i+1)*fieldElementLength])
+		e.Mod(e, fieldPrime)
+		// big.Int is big-endian while field elements are little-endian
+		buf := make([]byte, 32)
+		e.FillBytes(buf)
+		for l, r := 0, len(buf)-1; l < r; l, r = l+1, r-1 {
+			buf[l], buf[r] = buf[r], buf[l]
+		}
+		if res[i], err = new(field.Element).SetBytes(buf); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// montgomeryCurve returns x^3 + Jx^2 + x
+func montgomeryCurve(x *field.Element) *field.Element {
+	x2 := new(field.Element).Square(x)
+	res := new(field.Element).Multiply(x2, x)
+	res.Add(res, new(field.Element).Multiply(montgomeryJ, x2))
+	return res.Add(res, x)
+}
+
+// mapToCurveElligator2 maps the field element to curve25519 with Elligator 2
+// (Z = 2) and then to edwards25519 with the rational map from RFC 9380.
+// Inputs are public so it doesn't need to run in constant time
+func mapToCurveElligator2(u *field.Element) *edwards25519.Point {
+	one := new(field.Element).One()
+	minusJ := new(field.Element).Negate(montgomeryJ)
+
+	// x1 = -J / (1 + 2u^2), or -J if the denominator is zero
+	den := new(field.Element).Square(u)
+	den.Add(den, den)
+	den.Add(den, one)
+	x1 := new(field.Element).Set(minusJ)
+	if den.Equal(new(field.Element).Zero()) == 0 {
+		x1.Multiply(x1, new(field.Element).Invert(den))
+	}
+	// x2 = -x1 - J
+	x2 := new(field.Element).Subtract(minusJ, x1)
+
+	var s, t *field.Element
+	if y, isSquare := new(field.Element).SqrtRatio(montgomeryCurve(x1), one); isSquare == 1 {
+		// SqrtRatio returns the root with sgn0 = 0 and we need sgn0 = 1
+		s, t = x1, y.Negate(y)
+	} else {
+		y, _ := new(field.Element).SqrtRatio(montgomeryCurve(x2), one)
+		s, t = x2, y
+	}
+
+	// v = sqrt(-486664) * s / t, w = (s - 1) / (s + 1)
+	sPlusOne := new(field.Element).Add(s, one)
+	zero := new(field.Element).Zero()
+	if t.Equal(zero) == 1 || sPlusOne.Equal(zero) == 1 {
+		return edwards25519.NewIdentityPoint()
+	}
+	v := new(field.Element).Multiply(edwardsMapConstant, s)
+	v.Multiply(v, new(field.Element).Invert(t))
+	w := new(field.Element).Subtract(s, one)
+	w.Multiply(w, new(field.Element).Invert(sPlusOne))
+
+	p, err := new(edwards25519.Point).SetExtendedCoordinates(v, w, one, new(field.Element).Multiply(v, w))
+	if err != nil {
+		// The map always lands on the curve
+		panic(err)
+	}
+	return p
+}
+
+// HashToCurve hashes the message to a point of the prime order subgroup
+// of edwards25519. dst separates the different uses of the hash
+func HashToCurve(msg, dst []byte) (*edwards25519.Point, error) {
+	u, err := hashToField(msg, dst, 2)
+	if err != nil {
+		return nil, err
+	}
+	p := new(edwards25519.Point).Add(mapToCurveElligator2(u[0]), mapToCurveElligator2(u[1]))
+	return p.MultByCofactor(p), nil
+}
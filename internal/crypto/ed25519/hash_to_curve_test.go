@@ -0,0 +1,94 @@
+package ed25519
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// encodePoint returns the compressed encoding of the point with the affine
+// coordinates given as big-endian hex like in the RFC: y in little-endian
+// with the sign of x in the top bit
+func encodePoint(t *testing.T, x, y string) []byte {
+	t.Helper()
+	xBytes, err := hex.DecodeString(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := hex.DecodeString(y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for l, r := 0, len(encoded)-1; l < r; l, r = l+1, r-1 {
+		encoded[l], encoded[r] = encoded[r], encoded[l]
+	}
+	encoded[31] |= (xBytes[31] & 1) << 7
+	return encoded
+}
+
+// Test vectors of RFC 9380 appendix K.3, expand_message_xmd(SHA-512)
+func TestExpandMessageXMD(t *testing.T) {
+	dst := []byte("QUUX-V01-CS02-with-expander-SHA512-256")
+	tests := []struct {
+		msg      string
+		length   int
+		expected string
+	}{
+		{"", 0x20, "6b9a7312411d92f921c6f68ca0b6380730a1a4d982c507211a90964c394179ba"},
+		{"abc", 0x20, "0da749f12fbe5483eb066a5f595055679b976e93abe9be6f0f6318bce7aca8dc"},
+	}
+	for _, test := range tests {
+		out, err := ExpandMessageXMD([]byte(test.msg), dst, test.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(out); got != test.expected {
+			t.Errorf("msg %q: expected %s, got %s", test.msg, test.expected, got)
+		}
+	}
+}
+
+// Test vectors of RFC 9380 appendix J.5.1, edwards25519_XMD:SHA-512_ELL2_RO_
+func TestHashToCurve(t *testing.T) {
+	dst := []byte("QUUX-V01-CS02-with-edwards25519_XMD:SHA-512_ELL2_RO_")
+	tests := []struct {
+		msg  string
+		x, y string
+	}{
+		{
+			"",
+			"3c3da6925a3c3c268448dcabb47ccde5439559d9599646a8260e47b1e4822fc6",
+			"09a6c8561a0b22bef63124c588ce4c62ea83a3c899763af26d795302e115dc21",
+		},
+		{
+			"abc",
+			"608040b42285cc0d72cbb3985c6b04c935370c7361f4b7fbdb1ae7f8c1a8ecad",
+			"1a8395b88338f22e435bbd301183e7f20a5f9de643f11882fb237f88268a5531",
+		},
+		{
+			"abcdef0123456789",
+			"6d7fabf47a2dc03fe7d47f7dddd21082c5fb8f86743cd020f3fb147d57161472",
+			"53060a3d140e7fbcda641ed3cf42c88a75411e648a1add71217f70ea8ec561a6",
+		},
+		{
+			"q128_" + strings.Repeat("q", 128),
+			"5fb0b92acedd16f3bcb0ef83f5c7b7a9466b5f1e0d8d217421878ea3686f8524",
+			"2eca15e355fcfa39d2982f67ddb0eea138e2994f5956ed37b7f72eea5e89d2f7",
+		},
+		{
+			"a512_" + strings.Repeat("a", 512),
+			"0efcfde5898a839b00997fbe40d2ebe950bc81181afbd5cd6b9618aa336c1e8c",
+			"6dc2fc04f266c5c27f236a80b14f92ccd051ef1ff027f26a07f8c0f327d8f995",
+		},
+	}
+	for _, test := range tests {
+		p, err := HashToCurve([]byte(test.msg), dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := encodePoint(t, test.x, test.y); !bytes.Equal(p.Bytes(), expected) {
+			t.Errorf("msg %q: expected %x, got %x", test.msg, expected, p.Bytes())
+		}
+	}
+}
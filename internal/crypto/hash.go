@@ -1,9 +1,13 @@
 package crypto
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 )
 
+// HashSize is the size of the digests computed by HashData
+const HashSize = sha256.Size
+
 // Hashable guarantees that a given type implements
 // the Hash function
 type Hashable interface {
@@ -24,3 +28,17 @@ func (h Hash) ToFixedHash() FixedHash {
 	copy(fixed[:], h[:])
 	return fixed
 }
+
+// MarshalText encodes the hash as hex, e.g. in JSON
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *Hash) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*h = data
+	return nil
+}
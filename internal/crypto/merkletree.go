@@ -61,6 +61,10 @@ func NewMerkleTree(elements []Hashable) (*MerkleTree, error) {
 // fillElements rounds the number of leafs to the nearest
 // power of 2 greater than the length
 func fillElements(el []Hashable) ([]Hashable, float64) {
+	// An empty tree has a single empty leaf as its root
+	if len(el) == 0 {
+		return []Hashable{EmptyLeaf(0)}, 0
+	}
 	l := len(el)
 	// Calculate the nearest power of two greater than the len of our tx list
 	pow := math.Ceil(math.Log2(float64(l)))
@@ -0,0 +1,216 @@
+package mempool
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/timcki/learncoin/internal/chain"
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// Maximum number of transactions in the mempool. When it's full a new
+// transaction has to pay a higher fee than the cheapest one, which is evicted
+const MaxTransactions = 5000
+
+var (
+	AlreadyKnownError = errors.New("Transaction is already in the mempool")
+	DoubleSpendError  = errors.New("Transaction spends a key image already spent by another transaction in the mempool")
+	MempoolFullError  = errors.New("Mempool is full and the transaction doesn't pay more than the cheapest one")
+)
+
+// Mempool holds valid transactions waiting to be included in a block. No two
+// transactions in the mempool spend the same key image and none of them spends
+// a key image already spent by the active chain. Transactions are validated
+// without holding the lock, so readers don't wait for the signature checks
+type Mempool struct {
+	chain *chain.Chain
+	// Maximum number of transactions, MaxTransactions unless changed in tests
+	limit int
+	txns  map[crypto.FixedHash]transaction.Transaction
+	// Hashes of the transactions in the order they arrived
+	order []crypto.FixedHash
+	// Key image -> hash of the transaction spending it
+	images map[string]crypto.FixedHash
+	mu     sync.Mutex
+}
+
+func NewMempool(c *chain.Chain) *Mempool {
+	return &Mempool{
+		chain:  c,
+		limit:  MaxTransactions,
+		txns:   make(map[crypto.FixedHash]transaction.Transaction),
+		images: make(map[string]crypto.FixedHash),
+	}
+}
+
+// Add validates the transaction against the chain and the transactions
+// already in the mempool and adds it if it doesn't double spend. A full
+// mempool evicts its cheapest transaction for one with a higher fee
+func (m *Mempool) Add(txn transaction.Transaction) error {
+	h, err := txn.Hash()
+	if err != nil {
+		return err
+	}
+	hash := h.ToFixedHash()
+
+	// The cheap checks run before the expensive validation
+	m.mu.Lock()
+	err = m.check(hash, txn)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := m.chain.CheckTransaction(txn); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Other transactions could have been added during the validation
+	if err := m.check(hash, txn); err != nil {
+		return err
+	}
+	if cheapest, full := m.cheapest(); full {
+		m.remove(cheapest)
+	}
+	m.txns[hash] = txn
+	m.order = append(m.order, hash)
+	for _, image := range txn.KeyImages() {
+		m.images[string(image)] = hash
+	}
+	return nil
+}
+
+// check checks the transaction against the transactions in the mempool.
+// Expects the lock to be held
+func (m *Mempool) check(hash crypto.FixedHash, txn transaction.Transaction) error {
+	if _, ok := m.txns[hash]; ok {
+		return AlreadyKnownError
+	}
+	for _, image := range txn.KeyImages() {
+		if _, ok := m.images[string(image)]; ok {
+			return DoubleSpendError
+		}
+	}
+	if cheapest, full := m.cheapest(); full && txn.Fee <= m.txns[cheapest].Fee {
+		return MempoolFullError
+	}
+	return nil
+}
+
+// Transactions returns the transactions in the mempool in arrival order
+func (m *Mempool) Transactions() []transaction.Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txns := make([]transaction.Transaction, 0, len(m.order))
+	for _, hash := range m.order {
+		txns = append(txns, m.txns[hash])
+	}
+	return txns
+}
+
+// Get returns the transaction with the given hash if it's in the mempool
+func (m *Mempool) Get(hash crypto.Hash) (transaction.Transaction, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txn, ok := m.txns[hash.ToFixedHash()]
+	return txn, ok
+}
+
+func (m *Mempool) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.txns)
+}
+
+// RemoveBlock drops the transactions of a connected block together with
+// any transaction spending a key image the block spent
+func (m *Mempool) RemoveBlock(block *chain.Block) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, txn := range block.Transactions {
+		for _, image := range txn.KeyImages() {
+			if hash, ok := m.images[string(image)]; ok {
+				m.remove(hash)
+			}
+		}
+	}
+}
+
+// ReturnBlock adds the transactions of a block which got disconnected from
+// the active chain back to the mempool, unless they're invalid on the new
+// active chain. Returns the number of transactions added back
+func (m *Mempool) ReturnBlock(block *chain.Block) int {
+	returned := 0
+	for _, txn := range block.Transactions {
+		if m.Add(txn) == nil {
+			returned++
+		}
+	}
+	return returned
+}
+
+// Revalidate checks every transaction against the chain again and drops the
+// ones which became invalid. After a reorg the new branch can spend their
+// key images or miss their ring members. Returns the number of dropped
+// transactions
+func (m *Mempool) Revalidate() int {
+	m.mu.Lock()
+	txns := make(map[crypto.FixedHash]transaction.Transaction, len(m.txns))
+	for hash, txn := range m.txns {
+		txns[hash] = txn
+	}
+	m.mu.Unlock()
+
+	var invalid []crypto.FixedHash
+	for hash, txn := range txns {
+		if err := m.chain.CheckTransaction(txn); err != nil {
+			invalid = append(invalid, hash)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dropped := 0
+	for _, hash := range invalid {
+		if _, ok := m.txns[hash]; ok {
+			m.remove(hash)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// cheapest returns the oldest of the transactions paying the lowest fee and
+// if the mempool is full. Expects the lock to be held
+func (m *Mempool) cheapest() (crypto.FixedHash, bool) {
+	if len(m.txns) < m.limit {
+		return crypto.FixedHash{}, false
+	}
+	cheapest := m.order[0]
+	for _, hash := range m.order[1:] {
+		if m.txns[hash].Fee < m.txns[cheapest].Fee {
+			cheapest = hash
+		}
+	}
+	return cheapest, true
+}
+
+// remove drops the transaction from the mempool. Expects the lock to be held
+func (m *Mempool) remove(hash crypto.FixedHash) {
+	txn, ok := m.txns[hash]
+	if !ok {
+		return
+	}
+	delete(m.txns, hash)
+	for _, image := range txn.KeyImages() {
+		delete(m.images, string(image))
+	}
+	for i, h := range m.order {
+		if h == hash {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package mempool
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/timcki/learncoin/internal/chain"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// newTestChain returns an in memory chain whose genesis block allocates an
+// output worth 5 to the owner for each of the n outputs, which it returns
+func newTestChain(t *testing.T, owner transaction.Address, n int) (*chain.Chain, []transaction.Utxo) {
+	t.Helper()
+	params := chain.DefaultParams
+	params.OutputMaturity = 1
+	for i := 0; i < n; i++ {
+		out, _, err := owner.NewOutput(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.GenesisOutputs = append(params.GenesisOutputs, *out)
+	}
+	c, err := chain.NewChainWithStore(chain.NewMemoryStore(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, params.GenesisOutputs
+}
+
+// newSpend returns a transaction of the owner sending the amount of the real
+// output to the receiver and paying the fee, with the decoys in the ring
+func newSpend(t *testing.T, c *chain.Chain, owner, receiver transaction.Address, amount, fee transaction.Amount, real transaction.Utxo, decoys ...transaction.Utxo) transaction.Transaction {
+	t.Helper()
+	txn, err := owner.NewTransaction([]transaction.Utxo{real}, [][]transaction.Utxo{decoys}, amount, fee, receiver, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.SignTransaction(&txn, []transaction.Utxo{real}); err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+// mineOn returns a mined block with the transactions extending the parent.
+// Blocks close to genesis all use the easiest target
+func mineOn(t *testing.T, parent *chain.Block, txns ...transaction.Transaction) *chain.Block {
+	t.Helper()
+	parentHash, err := parent.Header.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := chain.NewBlock(txns)
+	block.SetPreviousHash(parentHash)
+	block.SetBits(parent.Header.Bits)
+	if parent.Header.Time.IsZero() {
+		block.SetTime(time.Now().Add(-time.Hour))
+	} else {
+		block.SetTime(parent.Header.Time.Add(chain.DefaultParams.TargetBlockTime))
+	}
+	chain.NewMiner(1).MineBlock(block, nil)
+	return block
+}
+
+// tipBlock returns the last block of the active chain
+func tipBlock(t *testing.T, c *chain.Chain) *chain.Block {
+	t.Helper()
+	hash, err := c.TipHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := c.BlockByHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// contains reports whether exactly the transactions are in the mempool
+func contains(t *testing.T, m *Mempool, txns ...transaction.Transaction) bool {
+	t.Helper()
+	if m.Len() != len(txns) {
+		return false
+	}
+	for _, txn := range txns {
+		hash, err := txn.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.Get(hash); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEvictCheapest(t *testing.T) {
+	owner, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, outs := newTestChain(t, owner, 5)
+	m := NewMempool(c)
+	m.limit = 2
+
+	cheap := newSpend(t, c, owner, owner, 1, 2, outs[0], outs[4])
+	expensive := newSpend(t, c, owner, owner, 1, 3, outs[1], outs[4])
+	for _, txn := range []transaction.Transaction{cheap, expensive} {
+		if err := m.Add(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Paying as much as the cheapest transaction isn't enough
+	if err := m.Add(newSpend(t, c, owner, owner, 1, 2, outs[2], outs[4])); !errors.Is(err, MempoolFullError) {
+		t.Fatalf("expected %v, got %v", MempoolFullError, err)
+	}
+	higher := newSpend(t, c, owner, owner, 1, 4, outs[3], outs[4])
+	if err := m.Add(higher); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(t, m, expensive, higher) {
+		t.Fatal("expected the cheapest transaction to be evicted")
+	}
+	// The evicted transaction doesn't pay enough to come back
+	if err := m.Add(cheap); !errors.Is(err, MempoolFullError) {
+		t.Fatalf("expected %v, got %v", MempoolFullError, err)
+	}
+}
+
+func TestRejectDoubleSpend(t *testing.T) {
+	owner, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, outs := newTestChain(t, owner, 2)
+	m := NewMempool(c)
+
+	txn := newSpend(t, c, owner, owner, 1, 1, outs[0], outs[1])
+	if err := m.Add(txn); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(txn); !errors.Is(err, AlreadyKnownError) {
+		t.Fatalf("expected %v, got %v", AlreadyKnownError, err)
+	}
+	if err := m.Add(newSpend(t, c, owner, owner, 1, 2, outs[0], outs[1])); !errors.Is(err, DoubleSpendError) {
+		t.Fatalf("expected %v, got %v", DoubleSpendError, err)
+	}
+}
+
+// After a reorg the transactions of the disconnected block go back to the
+// mempool, the ones the new branch conflicts with or whose ring members it
+// lacks are dropped
+func TestReorg(t *testing.T) {
+	owner, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, outs := newTestChain(t, owner, 3)
+	genesis := tipBlock(t, c)
+	m := NewMempool(c)
+
+	// A confirms the first transaction
+	mined := newSpend(t, c, owner, receiver, 3, 1, outs[0], outs[2])
+	a := mineOn(t, genesis, mined)
+	if _, err := c.ProcessBlock(a); err != nil {
+		t.Fatal(err)
+	}
+	// Spends the output A created
+	var created transaction.Utxo
+	for _, out := range mined.UtxosOut {
+		if _, _, err := receiver.OpenUtxo(out); err == nil {
+			created = out
+		}
+	}
+	dependent := newSpend(t, c, receiver, owner, 1, 1, created, outs[2])
+	conflicting := newSpend(t, c, owner, owner, 1, 1, outs[1], outs[2])
+	for _, txn := range []transaction.Transaction{dependent, conflicting} {
+		if err := m.Add(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The heavier fork spends the output of the conflicting transaction
+	forkA := mineOn(t, genesis)
+	if _, err := c.ProcessBlock(forkA); err != nil {
+		t.Fatal(err)
+	}
+	forkB := mineOn(t, forkA, newSpend(t, c, owner, owner, 1, 2, outs[1], outs[2]))
+	update, err := c.ProcessBlock(forkB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(update.Disconnected) != 1 || len(update.Connected) != 2 {
+		t.Fatalf("expected a reorg, got %d disconnected and %d connected blocks", len(update.Disconnected), len(update.Connected))
+	}
+
+	if returned := m.ReturnBlock(update.Disconnected[0]); returned != 1 {
+		t.Fatalf("expected 1 returned transaction, got %d", returned)
+	}
+	for _, block := range update.Connected {
+		m.RemoveBlock(block)
+	}
+	if dropped := m.Revalidate(); dropped != 1 {
+		t.Fatalf("expected 1 dropped transaction, got %d", dropped)
+	}
+	if !contains(t, m, mined) {
+		t.Fatal("expected only the transaction of the disconnected block")
+	}
+}
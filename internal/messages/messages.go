@@ -1,6 +1,11 @@
 package messages
 
-import "github.com/timcki/learncoin/internal/crypto"
+import (
+	"github.com/timcki/learncoin/internal/chain"
+	"github.com/timcki/learncoin/internal/constants"
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/transaction"
+)
 
 const (
 	// Used to identify new nodes in the network
@@ -13,23 +18,68 @@ const (
 	CmdPing    = "ping"
 	CmdPong    = "pong"
 
-	// Placeholder to exchange some data between nodes when connected
-	CmdTx = "tx"
+	// Used to relay transactions and blocks. Peers announce what they have
+	// with an inv, the data is requested with getdata and sent back as tx or
+	// block, or notfound if it's gone
+	CmdInv      = "inv"
+	CmdGetData  = "getdata"
+	CmdNotFound = "notfound"
+	CmdTx       = "tx"
+	CmdBlock    = "block"
+
+	// Used to download the headers of the chain before its blocks
+	CmdGetHeaders = "getheaders"
+	CmdHeaders    = "headers"
+)
+
+const (
+	// Maximum number of items in a single inventory message
+	MaxInvItems = 10000
+	// Maximum number of headers in a single headers message
+	MaxHeaders = 2000
+	// Maximum number of addresses in a single addr message
+	MaxAddrs = 1000
 )
 
+type InvType uint8
+
+const (
+	InvTypeTx InvType = iota + 1
+	InvTypeBlock
+)
+
+// InvVect identifies a transaction or a block by its hash
+type InvVect struct {
+	Type InvType
+	Hash crypto.Hash
+}
+
+func NewInvVect(t InvType, hash crypto.Hash) InvVect {
+	return InvVect{Type: t, Hash: hash}
+}
+
+// Key returns a comparable representation of the item, e.g. for maps
+func (v InvVect) Key() string {
+	return string(append([]byte{byte(v.Type)}, v.Hash...))
+}
+
 type VersionMessage struct {
-	Version string
-	Address string
-	ID      crypto.FixedHash
-	Nonce   uint64 // Random nonce to detect connections to self
+	Version         string // User agent of the node
+	ProtocolVersion uint32
+	Address         string
+	ID              crypto.FixedHash
+	Nonce           uint64 // Random nonce to detect connections to self
+	BestHeight      uint64 // Height of the tip of the sender's chain
 }
 
-func NewVersionMessage(version, addr string, id crypto.FixedHash) Message {
+func NewVersionMessage(version, addr string, id crypto.FixedHash, nonce, bestHeight uint64) *VersionMessage {
 	return &VersionMessage{
-		Version: version,
-		Address: addr,
-		ID:      id,
-		Nonce:   0,
+		Version:         version,
+		ProtocolVersion: constants.ProtocolVersion,
+		Address:         addr,
+		ID:              id,
+		Nonce:           nonce,
+		BestHeight:      bestHeight,
 	}
 }
 
@@ -94,6 +144,93 @@ func NewPongMessage() Message {
 	return new(PongMessage)
 }
 
+type InvMessage struct {
+	Items []InvVect
+}
+
+func NewInvMessage(items []InvVect) Message {
+	return &InvMessage{Items: items}
+}
+
+func (m InvMessage) Command() string {
+	return CmdInv
+}
+
+type GetDataMessage struct {
+	Items []InvVect
+}
+
+func NewGetDataMessage(items []InvVect) Message {
+	return &GetDataMessage{Items: items}
+}
+
+func (m GetDataMessage) Command() string {
+	return CmdGetData
+}
+
+type NotFoundMessage struct {
+	Items []InvVect
+}
+
+func NewNotFoundMessage(items []InvVect) Message {
+	return &NotFoundMessage{Items: items}
+}
+
+func (m NotFoundMessage) Command() string {
+	return CmdNotFound
+}
+
+type TxMessage struct {
+	Transaction transaction.Transaction
+}
+
+func NewTxMessage(txn transaction.Transaction) Message {
+	return &TxMessage{Transaction: txn}
+}
+
+func (m TxMessage) Command() string {
+	return CmdTx
+}
+
+type BlockMessage struct {
+	Block *chain.Block
+}
+
+func NewBlockMessage(block *chain.Block) Message {
+	return &BlockMessage{Block: block}
+}
+
+func (m BlockMessage) Command() string {
+	return CmdBlock
+}
+
+// GetHeadersMessage asks for the headers after the first locator hash the
+// peer has on its chain, up to the stop hash or MaxHeaders
+type GetHeadersMessage struct {
+	Locator []crypto.Hash
+	Stop    crypto.Hash
+}
+
+func NewGetHeadersMessage(locator []crypto.Hash, stop crypto.Hash) Message {
+	return &GetHeadersMessage{Locator: locator, Stop: stop}
+}
+
+func (m GetHeadersMessage) Command() string {
+	return CmdGetHeaders
+}
+
+type HeadersMessage struct {
+	Headers []chain.Header
+}
+
+func NewHeadersMessage(headers []chain.Header) Message {
+	return &HeadersMessage{Headers: headers}
+}
+
+func (m HeadersMessage) Command() string {
+	return CmdHeaders
+}
+
 type Msg interface {
 	MessageHeader | PingMessage | PongMessage | AddrMessage | GetAddrMessage | VerAckMessage | VersionMessage
 }
@@ -104,14 +241,15 @@ type Message interface {
 	Command() string
 }
 
-// messageHeader defines the header structure of all
+// MessageHeader defines the header structure of all
 // messages in the learncoin protocol. It has a fixed
 // size which simplifies marshalling/unmarshalling
-// Size: 14 bytes
+// Size: 24 bytes
 type MessageHeader struct {
-	Cmd string // 10 bytes (fixed)
-	// length   uint32  // 4 bytes
-	// checksum [4]byte // 4 bytes
+	Magic    uint32  // 4 bytes
+	Cmd      string  // 12 bytes (fixed, zero padded)
+	Length   uint32  // 4 bytes
+	Checksum [4]byte // 4 bytes
 }
 
 func (h MessageHeader) Command() string {
@@ -0,0 +1,159 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+// Every message is sent as a frame of a header followed by the payload
+//
+//	magic (4) | command (12, zero padded) | payload length (4) | checksum (4) | payload
+//
+// Integers are big endian, the checksum is the start of the sha256 of the
+// payload and payloads are the JSON of the message. A frame with a bad
+// checksum, an unknown command or a payload which doesn't decode is fully
+// read before it's rejected, so the next frame can still be read. A bad magic
+// or a length over MaxPayloadSize means the stream can't be trusted anymore
+
+const (
+	// Magic marks the start of every frame of the learncoin network
+	Magic uint32 = 0x6c726e63
+
+	CommandSize    = 12
+	HeaderSize     = 4 + CommandSize + 4 + 4
+	MaxPayloadSize = 4 << 20
+)
+
+var (
+	MagicMismatchError    = errors.New("Frame doesn't start with the network magic")
+	PayloadTooLargeError  = errors.New("Payload is larger than the maximum message size")
+	InvalidCommandError   = errors.New("Command doesn't fit in the frame header")
+	ChecksumMismatchError = errors.New("Payload doesn't match the checksum")
+	UnknownCommandError   = errors.New("Unknown command")
+	MalformedPayloadError = errors.New("Payload doesn't decode to the message of its command")
+)
+
+// registry holds the payload decoder of every command
+var registry = make(map[string]func([]byte) (Message, error))
+
+// Register adds the decoder of a message type, which is decoded as a value
+func Register[T Message](cmd string) {
+	if len(cmd) > CommandSize {
+		panic(InvalidCommandError)
+	}
+	registry[cmd] = func(payload []byte) (Message, error) {
+		var msg T
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
+
+func init() {
+	Register[VersionMessage](CmdVersion)
+	Register[VerAckMessage](CmdVerAck)
+	Register[GetAddrMessage](CmdGetAddr)
+	Register[AddrMessage](CmdAddr)
+	Register[PingMessage](CmdPing)
+	Register[PongMessage](CmdPong)
+	Register[InvMessage](CmdInv)
+	Register[GetDataMessage](CmdGetData)
+	Register[NotFoundMessage](CmdNotFound)
+	Register[TxMessage](CmdTx)
+	Register[BlockMessage](CmdBlock)
+	Register[GetHeadersMessage](CmdGetHeaders)
+	Register[HeadersMessage](CmdHeaders)
+}
+
+// IsFrameError reports if the error only affected a single frame and the
+// stream is still in sync for the next one
+func IsFrameError(err error) bool {
+	return errors.Is(err, ChecksumMismatchError) || errors.Is(err, UnknownCommandError) ||
+		errors.Is(err, MalformedPayloadError)
+}
+
+func checksum(payload []byte) (sum [4]byte) {
+	hash, _ := crypto.HashData(payload)
+	copy(sum[:], hash)
+	return
+}
+
+func (h MessageHeader) Bytes() []byte {
+	buf := make([]byte, HeaderSize)
+	binary.BigEndian.PutUint32(buf[0:4], h.Magic)
+	copy(buf[4:4+CommandSize], h.Cmd)
+	binary.BigEndian.PutUint32(buf[16:20], h.Length)
+	copy(buf[20:24], h.Checksum[:])
+	return buf
+}
+
+func parseHeader(buf []byte) MessageHeader {
+	return MessageHeader{
+		Magic:    binary.BigEndian.Uint32(buf[0:4]),
+		Cmd:      string(bytes.TrimRight(buf[4:4+CommandSize], "\x00")),
+		Length:   binary.BigEndian.Uint32(buf[16:20]),
+		Checksum: [4]byte(buf[20:24]),
+	}
+}
+
+// WriteMessage writes the message as a single frame, so concurrent writers
+// on a connection don't interleave
+func WriteMessage(w io.Writer, msg Message) error {
+	cmd := msg.Command()
+	if len(cmd) > CommandSize {
+		return InvalidCommandError
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) > MaxPayloadSize {
+		return PayloadTooLargeError
+	}
+	header := MessageHeader{
+		Magic:    Magic,
+		Cmd:      cmd,
+		Length:   uint32(len(payload)),
+		Checksum: checksum(payload),
+	}
+	_, err = w.Write(append(header.Bytes(), payload...))
+	return err
+}
+
+// ReadMessage reads the next frame and decodes its message. Errors for which
+// IsFrameError is true leave the stream at the start of the next frame
+func ReadMessage(r io.Reader) (Message, error) {
+	buf := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	header := parseHeader(buf)
+	if header.Magic != Magic {
+		return nil, MagicMismatchError
+	}
+	if header.Length > MaxPayloadSize {
+		return nil, PayloadTooLargeError
+	}
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if checksum(payload) != header.Checksum {
+		return nil, ChecksumMismatchError
+	}
+	decode, ok := registry[header.Cmd]
+	if !ok {
+		return nil, UnknownCommandError
+	}
+	msg, err := decode(payload)
+	if err != nil {
+		return nil, MalformedPayloadError
+	}
+	return msg, nil
+}
@@ -0,0 +1,222 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timcki/learncoin/internal/chain"
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// frame returns a well formed frame of the command and payload
+func frame(cmd string, payload []byte) []byte {
+	header := MessageHeader{
+		Magic:    Magic,
+		Cmd:      cmd,
+		Length:   uint32(len(payload)),
+		Checksum: checksum(payload),
+	}
+	return append(header.Bytes(), payload...)
+}
+
+// encode returns the frame of the message
+func encode(t *testing.T, msg Message) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestTransaction returns a signed transaction spending a genesis output of
+// a new chain
+func newTestTransaction(t *testing.T) transaction.Transaction {
+	t.Helper()
+	owner, err := transaction.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := chain.DefaultParams
+	for i := 0; i < 2; i++ {
+		out, _, err := owner.NewOutput(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.GenesisOutputs = append(params.GenesisOutputs, *out)
+	}
+	c, err := chain.NewChainWithStore(chain.NewMemoryStore(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	real := params.GenesisOutputs[:1]
+	txn, err := owner.NewTransaction(real, [][]transaction.Utxo{params.GenesisOutputs[1:]}, 3, 1, owner, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.SignTransaction(&txn, real); err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+func TestRoundTrip(t *testing.T) {
+	txn := newTestTransaction(t)
+	block := chain.NewBlock([]transaction.Transaction{txn})
+	block.SetPreviousHash(bytes.Repeat([]byte{1}, 32))
+	block.SetTime(time.Unix(1700000000, 0))
+	hash := crypto.Hash(bytes.Repeat([]byte{2}, 32))
+	items := []InvVect{NewInvVect(InvTypeBlock, hash), NewInvVect(InvTypeTx, hash)}
+
+	msgs := []Message{
+		NewVersionMessage("learncoind/test", "127.0.0.1:8333", crypto.FixedHash{1}, 42, 7),
+		NewVerAckMessage(),
+		NewGetAddrMessage(),
+		NewAddrMessage([]string{"127.0.0.1:8333", "10.0.0.1:8333"}),
+		NewPingMessage(),
+		NewPongMessage(),
+		NewInvMessage(items),
+		NewGetDataMessage(items),
+		NewNotFoundMessage(items),
+		NewTxMessage(txn),
+		NewBlockMessage(block),
+		NewGetHeadersMessage([]crypto.Hash{hash}, nil),
+		NewHeadersMessage([]chain.Header{block.Header}),
+	}
+	tested := make(map[string]bool)
+	for _, msg := range msgs {
+		tested[msg.Command()] = true
+		decoded, err := ReadMessage(bytes.NewReader(encode(t, msg)))
+		if err != nil {
+			t.Fatalf("%s: %v", msg.Command(), err)
+		}
+		if decoded.Command() != msg.Command() {
+			t.Fatalf("%s: decoded %s", msg.Command(), decoded.Command())
+		}
+		// Messages are compared by their JSON as decoding drops cached fields
+		expected, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.Marshal(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Fatalf("%s: decoded %s, expected %s", msg.Command(), got, expected)
+		}
+	}
+	for cmd := range registry {
+		if !tested[cmd] {
+			t.Fatalf("%s isn't round tripped", cmd)
+		}
+	}
+}
+
+func TestRejectBadMagic(t *testing.T) {
+	data := encode(t, NewPingMessage())
+	binary.BigEndian.PutUint32(data, Magic+1)
+	if _, err := ReadMessage(bytes.NewReader(data)); !errors.Is(err, MagicMismatchError) {
+		t.Fatalf("expected %v, got %v", MagicMismatchError, err)
+	}
+	if IsFrameError(MagicMismatchError) {
+		t.Fatal("stream can't be trusted after a bad magic")
+	}
+}
+
+// Frames which fail on their own leave the stream at the next frame
+func TestSkipBadFrame(t *testing.T) {
+	corrupted := encode(t, NewAddrMessage([]string{"127.0.0.1:8333"}))
+	corrupted[HeaderSize+2] ^= 1
+	for _, test := range []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"checksum", corrupted, ChecksumMismatchError},
+		{"unknown command", frame("nope", []byte("{}")), UnknownCommandError},
+		{"malformed payload", frame(CmdPing, []byte("{")), MalformedPayloadError},
+	} {
+		r := bytes.NewReader(append(test.frame, encode(t, NewPingMessage())...))
+		if _, err := ReadMessage(r); !errors.Is(err, test.err) || !IsFrameError(err) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		msg, err := ReadMessage(r)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if _, ok := msg.(PingMessage); !ok {
+			t.Fatalf("%s: expected the next frame, got %T", test.name, msg)
+		}
+	}
+}
+
+func TestRejectPayloadTooLarge(t *testing.T) {
+	// Rejected before the payload is read
+	header := MessageHeader{Magic: Magic, Cmd: CmdAddr, Length: MaxPayloadSize + 1}
+	if _, err := ReadMessage(bytes.NewReader(header.Bytes())); !errors.Is(err, PayloadTooLargeError) {
+		t.Fatalf("expected %v, got %v", PayloadTooLargeError, err)
+	}
+	msg := NewAddrMessage([]string{strings.Repeat("a", MaxPayloadSize)})
+	if err := WriteMessage(io.Discard, msg); !errors.Is(err, PayloadTooLargeError) {
+		t.Fatalf("expected %v, got %v", PayloadTooLargeError, err)
+	}
+}
+
+func TestShortRead(t *testing.T) {
+	data := encode(t, NewAddrMessage([]string{"127.0.0.1:8333"}))
+	if _, err := ReadMessage(bytes.NewReader(nil)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected %v, got %v", io.EOF, err)
+	}
+	for _, n := range []int{HeaderSize - 1, len(data) - 1} {
+		if _, err := ReadMessage(bytes.NewReader(data[:n])); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("%d bytes: expected %v, got %v", n, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+type longCommandMessage struct{}
+
+func (longCommandMessage) Command() string {
+	return "averylongcommand"
+}
+
+func TestRejectLongCommand(t *testing.T) {
+	if err := WriteMessage(io.Discard, longCommandMessage{}); !errors.Is(err, InvalidCommandError) {
+		t.Fatalf("expected %v, got %v", InvalidCommandError, err)
+	}
+}
+
+// A block of chain.MaxBlockSize fits in a single message
+func TestMaxBlockSizeFits(t *testing.T) {
+	txn := newTestTransaction(t)
+	data, err := txn.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txns := make([]transaction.Transaction, chain.MaxBlockSize/len(data))
+	for i := range txns {
+		txns[i] = txn
+	}
+	block := chain.NewBlock(txns)
+	for {
+		data, err := block.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) <= chain.MaxBlockSize {
+			break
+		}
+		block.Transactions = block.Transactions[1:]
+	}
+	if _, err := ReadMessage(bytes.NewReader(encode(t, NewBlockMessage(block)))); err != nil {
+		t.Fatal(err)
+	}
+}
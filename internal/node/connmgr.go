@@ -0,0 +1,74 @@
+package node
+
+import (
+	"time"
+
+	"github.com/timcki/learncoin/internal/addrmgr"
+)
+
+const (
+	// Number of outbound peers the node keeps
+	targetOutbound = 8
+	dialTimeout    = 5 * time.Second
+	// How often missing outbound peers are replaced and the addresses saved
+	connectInterval = 5 * time.Second
+	saveInterval    = time.Minute
+)
+
+// maintainPeers keeps the node connected to targetOutbound peers picked by
+// the address manager and saves the addresses from time to time
+func (n *Node) maintainPeers() {
+	connect := time.NewTicker(connectInterval)
+	save := time.NewTicker(saveInterval)
+	defer connect.Stop()
+	defer save.Stop()
+	for {
+		select {
+		case <-connect.C:
+			n.connectPeers()
+		case <-save.C:
+			if err := n.addrs.Save(); err != nil {
+				n.logger.Error("Failed to save addresses", "err", err)
+			}
+		}
+	}
+}
+
+// connectPeers dials new outbound peers until there are enough of them.
+// Addresses from network groups we're not connected to yet are preferred
+// so a single network can't surround the node
+func (n *Node) connectPeers() {
+	connected := make(map[string]bool)
+	groups := make(map[string]bool)
+	outbound := 0
+	for _, p := range n.GetPeers() {
+		addr := p.GetAddr().ToString()
+		connected[addr] = true
+		if !p.IsInboud() {
+			groups[addrmgr.Group(addr)] = true
+			outbound++
+		}
+	}
+
+	for outbound < targetOutbound {
+		addr, ok := n.addrs.Select(func(addr string) bool {
+			return connected[addr] || groups[addrmgr.Group(addr)] || n.isSelf(addr)
+		})
+		if !ok {
+			// Small networks, e.g. a single subnet, only have a few groups
+			addr, ok = n.addrs.Select(func(addr string) bool {
+				return connected[addr] || n.isSelf(addr)
+			})
+		}
+		if !ok {
+			return
+		}
+		connected[addr] = true
+		if err := n.NewOutboundPeer(addr); err != nil {
+			n.logger.Debug("Failed connection to peer", "peer", addr, "err", err)
+			continue
+		}
+		groups[addrmgr.Group(addr)] = true
+		outbound++
+	}
+}
@@ -1,110 +1,211 @@
 package node
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"net"
+	"sync"
+	"time"
 
 	log "github.com/inconshreveable/log15"
+	"github.com/timcki/learncoin/internal/addrmgr"
+	"github.com/timcki/learncoin/internal/chain"
 	"github.com/timcki/learncoin/internal/config"
 	"github.com/timcki/learncoin/internal/constants"
-	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/mempool"
 	"github.com/timcki/learncoin/internal/messages"
 	"github.com/timcki/learncoin/internal/peer"
 )
 
+var (
+	DuplicatePeerError = errors.New("Already connected to the peer")
+	SelfAddressError   = errors.New("Address is one of our own")
+)
+
 type Node struct {
 	config config.NodeConfig
 	logger log.Logger
-	peers  map[crypto.FixedHash]peer.Peer
+	chain  *chain.Chain
+	pool   *mempool.Mempool
+	addrs  *addrmgr.AddrManager
+
+	// Random nonce sent in our version messages to detect connections to self
+	nonce uint64
+
+	// Peers get added from the listener and from the peers' goroutines
+	mu sync.RWMutex
+	// Peers by the remote address of their connection
+	peers map[string]peer.Peer
+	// Addresses which turned out to be our own
+	self map[string]struct{}
+
+	// Blocks requested during the sync and the peers which stalled on them
+	syncMu   sync.Mutex
+	inFlight map[string]blockRequest
+	stalled  map[string]string
+	// Time the sync started or last connected a requested block
+	syncProgress time.Time
+}
+
+// GetPeers returns a copy of the connected peers
+func (n *Node) GetPeers() map[string]peer.Peer {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	peers := make(map[string]peer.Peer, len(n.peers))
+	for key, p := range n.peers {
+		peers[key] = p
+	}
+	return peers
+}
+
+func (n *Node) GetPeer(key string) peer.Peer {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.peers[key]
+}
+
+// AddPeer registers the peer until it disconnects. Peers are keyed by the
+// address they're connected from rather than the ID they advertise, so a
+// peer can't take the place of another one by claiming its ID
+func (n *Node) AddPeer(p peer.Peer) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := p.GetKey()
+	if _, ok := n.peers[key]; ok {
+		return DuplicatePeerError
+	}
+	n.peers[key] = p
+	go func() {
+		<-p.Done()
+		n.mu.Lock()
+		delete(n.peers, key)
+		n.mu.Unlock()
+		n.logger.Info("Peer disconnected", "peer", p.GetAddr().ToString())
+	}()
+	return nil
 }
 
-func (n Node) GetPeers() map[crypto.FixedHash]peer.Peer {
-	return n.peers
+func (n *Node) isSelf(addr string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	_, ok := n.self[addr]
+	return ok
 }
 
-func (n Node) GetPeer(id crypto.FixedHash) peer.Peer {
-	return n.peers[id]
+// markSelf remembers the address as our own so it's never dialed again
+func (n *Node) markSelf(addr string) {
+	n.mu.Lock()
+	n.self[addr] = struct{}{}
+	n.mu.Unlock()
+	n.addrs.Remove(addr)
 }
 
-func (n *Node) AddPeer(p peer.Peer) {
-	n.peers[p.GetID()] = p
+// versionMessage advertises the node and the tip of its chain
+func (n *Node) versionMessage() *messages.VersionMessage {
+	return messages.NewVersionMessage(
+		n.config.GetVersion(),
+		n.config.GetAddr().ToString(),
+		n.config.GetID().ToFixedHash(),
+		n.nonce,
+		n.chain.Height(),
+	)
 }
 
 // Connects to a new peer (sends CmdVersion and waits for CmdVerAck)
 func (n *Node) NewOutboundPeer(address string) (err error) {
+	if n.isSelf(address) {
+		return SelfAddressError
+	}
 	var conn net.Conn
-	//n.logger.New()
-	p := peer.NewPeer(n.logger.New("peer", address), n.getOtherPeers, n.NewOutboundPeer)
-	conn, err = net.Dial(constants.ConnType, address)
+	p := peer.NewPeer(n.logger.New("peer", address), n.getOtherPeers, n.addAddresses, n)
+	n.addrs.Attempt(address)
+	conn, err = net.DialTimeout(constants.ConnType, address, dialTimeout)
 	if err != nil {
-		//n.logger.Error().Err(err).Str("addr", address).Msg("Failed connection to peer")
 		return
 	}
 	p.SetConn(conn)
+	p.SetInbound(false)
 
-	msg := messages.NewVersionMessage(n.config.GetVersion(), n.config.GetAddr().ToString(), p.GetID())
-	if err = p.WriteMessage(msg); err != nil {
-		panic(err)
-	}
-
-	if err = p.HandleVersionMessage(); err != nil {
+	if err = p.Handshake(n.versionMessage()); err != nil {
+		conn.Close()
+		if errors.Is(err, peer.SelfConnectionError) {
+			n.markSelf(address)
+		}
 		return
 	}
-
-	p.SetInbound(false)
 	p.SetAlive(true)
 
 	// Add peer to peerlist and start inbound and outbound connections on it
-	n.AddPeer(p)
+	if err = n.AddPeer(p); err != nil {
+		conn.Close()
+		return
+	}
+	n.addrs.Good(address)
 	p.Start()
-	n.logger.Info("Succesfully registered outbound peer", "peer", p.GetAddr().ToString())
+	n.logger.Info("Succesfully registered outbound peer", "peer", p.GetAddr().ToString(), "height", p.GetBestHeight())
+	n.syncWith(p)
 
 	return err
 }
 
 // NewInboundPeer handles the connection of a new peer
 func (n *Node) NewInboundPeer(conn net.Conn) (err error) {
-	p := peer.NewPeer(n.logger.New("peer", conn.RemoteAddr().String()), n.getOtherPeers, n.NewOutboundPeer)
+	p := peer.NewPeer(n.logger.New("peer", conn.RemoteAddr().String()), n.getOtherPeers, n.addAddresses, n)
 	p.SetConn(conn)
+	p.SetInbound(true)
 
-	var msg messages.Message
-	if msg, err = p.ReadMessage(); err != nil {
+	if err = p.Handshake(n.versionMessage()); err != nil {
+		conn.Close()
 		return
 	}
+	p.SetAlive(true)
 
-	if msg.Command() == messages.CmdVersion {
-		ver := msg.(messages.VersionMessage)
-		port := config.NewAddressFromString(ver.Address).Port
-		addr := config.NewAddressFromString(p.GetConn().RemoteAddr().String()).Addr
-		finalAddr := config.NewAddress(addr, port)
-		p.SetAddr(finalAddr)
-	}
-
-	msgg := messages.NewVersionMessage(n.config.GetVersion(), n.config.GetAddr().ToString(), p.GetID())
-	if err = p.WriteMessage(msgg); err != nil {
-		n.logger.Error("Failed send to peer", "err", err)
+	if err = n.AddPeer(p); err != nil {
+		conn.Close()
 		return
 	}
-	p.SetInbound(true)
-	p.SetAlive(true)
-
 	p.Start()
-	n.AddPeer(p)
-	n.logger.Info("Got new inbound peer", "peer", p.GetAddr().ToString())
+	// The peer listens on the address it advertised
+	n.addAddresses([]string{p.GetAddr().ToString()}, p.GetAddr().ToString())
+	n.logger.Info("Got new inbound peer", "peer", p.GetAddr().ToString(), "height", p.GetBestHeight())
+	n.syncWith(p)
 	return
 }
 
-// getOtherPeers creates a list of all known addresses (except for peer calling the callback)
-// and returns it a slice
-func (n Node) getOtherPeers(id crypto.FixedHash) []string {
+// syncWith requests the headers of a new peer whose chain is ahead of ours
+func (n *Node) syncWith(p peer.Peer) {
+	if p.GetBestHeight() <= n.chain.BestHeaderHeight() {
+		return
+	}
+	if err := n.RequestHeaders(p); err != nil {
+		n.logger.Warn("Failed to request headers", "peer", p.GetAddr().ToString(), "err", err)
+	}
+}
+
+// getOtherPeers creates a random sample of known addresses (except for the
+// address of the peer calling the callback) and returns it a slice
+func (n *Node) getOtherPeers(caller string) []string {
 	trueList := make([]string, 0)
-	for _, p := range n.GetPeers() {
-		if p.GetID() != id {
-			trueList = append(trueList, p.GetAddr().ToString())
+	for _, addr := range n.addrs.Sample() {
+		if addr != caller {
+			trueList = append(trueList, addr)
 		}
 	}
 	return trueList
 }
 
+// addAddresses hands the addresses learned from a peer to the address manager
+func (n *Node) addAddresses(addrs []string, source string) {
+	learned := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !n.isSelf(addr) {
+			learned = append(learned, addr)
+		}
+	}
+	n.addrs.AddAddresses(learned, source)
+}
+
 // Start starts listening for new connections on the port specified
 // in the config file
 func (n *Node) Start() {
@@ -117,20 +218,47 @@ func (n *Node) Start() {
 	defer listener.Close()
 	n.logger.Info("Started server", "addr", n.config.GetAddr().ToString())
 
+	go n.monitorDownloads()
+	go n.maintainPeers()
+
 	for {
 		if conn, err := listener.Accept(); err != nil {
 			n.logger.Error("Error while accepting connection", "err", err)
 		} else {
 			n.logger.Info("Got new inbound connection")
-			if err := n.NewInboundPeer(conn); err != nil {
-				n.logger.Error("Error while accepting connection", "err", err)
-			} else {
-			}
+			// The handshake can take until its timeout so it doesn't block the listener
+			go func() {
+				if err := n.NewInboundPeer(conn); err != nil {
+					n.logger.Error("Error while accepting connection", "err", err)
+				}
+			}()
 		}
 	}
 
 }
 
-func NewNode(config config.NodeConfig, logger log.Logger) *Node {
-	return &Node{config: config, logger: logger, peers: make(map[crypto.FixedHash]peer.Peer)}
+func NewNode(
+	config config.NodeConfig,
+	blockchain *chain.Chain,
+	pool *mempool.Mempool,
+	addrs *addrmgr.AddrManager,
+	logger log.Logger,
+) *Node {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	return &Node{
+		config: config,
+		logger: logger,
+		chain:  blockchain,
+		pool:   pool,
+		addrs:  addrs,
+		nonce:  binary.BigEndian.Uint64(nonce[:]),
+		peers:  make(map[string]peer.Peer),
+		self:   make(map[string]struct{}),
+
+		inFlight: make(map[string]blockRequest),
+		stalled:  make(map[string]string),
+	}
 }
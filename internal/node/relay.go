@@ -0,0 +1,99 @@
+package node
+
+import (
+	"github.com/timcki/learncoin/internal/chain"
+	"github.com/timcki/learncoin/internal/messages"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// HaveInventory reports if the transaction or block doesn't have to be requested
+func (n *Node) HaveInventory(item messages.InvVect) bool {
+	switch item.Type {
+	case messages.InvTypeTx:
+		_, ok := n.pool.Get(item.Hash)
+		return ok
+	case messages.InvTypeBlock:
+		return n.chain.HaveBlock(item.Hash)
+	}
+	// Unknown types are never requested
+	return true
+}
+
+// GetInventory returns the message carrying the requested transaction or block
+func (n *Node) GetInventory(item messages.InvVect) (messages.Message, bool) {
+	switch item.Type {
+	case messages.InvTypeTx:
+		if txn, ok := n.pool.Get(item.Hash); ok {
+			return messages.NewTxMessage(txn), true
+		}
+	case messages.InvTypeBlock:
+		if block, err := n.chain.BlockByHash(item.Hash); err == nil {
+			return messages.NewBlockMessage(block), true
+		}
+	}
+	return nil, false
+}
+
+// SubmitTransaction adds the transaction to the mempool and announces it to
+// the peers which don't know about it yet
+func (n *Node) SubmitTransaction(txn transaction.Transaction) error {
+	if err := n.pool.Add(txn); err != nil {
+		return err
+	}
+	hash, err := txn.Hash()
+	if err != nil {
+		return err
+	}
+	n.logger.Info("Accepted transaction", "hash", hash)
+	n.announce(messages.NewInvVect(messages.InvTypeTx, hash))
+	return nil
+}
+
+// SubmitBlock adds the block to the chain, drops the transactions of every
+// block it connected from the mempool and announces it to the peers which
+// don't know about it yet
+func (n *Node) SubmitBlock(block *chain.Block) error {
+	hash, err := block.Header.Hash()
+	if err != nil {
+		return err
+	}
+	requested := n.blockReceived(hash)
+	update, err := n.chain.ProcessBlock(block)
+	if err != nil {
+		return err
+	}
+	if requested {
+		n.markSyncProgress()
+	}
+	// Transactions of blocks a reorg disconnected aren't lost, they go back
+	// to the mempool unless the new branch includes or conflicts with them.
+	// The oldest block goes first so the transactions keep their order
+	returned := 0
+	for i := len(update.Disconnected) - 1; i >= 0; i-- {
+		returned += n.pool.ReturnBlock(update.Disconnected[i])
+	}
+	// The block can connect orphans waiting for it, or a whole branch
+	for _, connected := range update.Connected {
+		n.pool.RemoveBlock(connected)
+	}
+	// The pool was validated against the disconnected blocks
+	if len(update.Disconnected) > 0 {
+		dropped := n.pool.Revalidate()
+		n.logger.Info("Updated mempool after a reorg", "returned", returned, "dropped", dropped)
+	}
+	n.logger.Info("Accepted block", "hash", hash, "length", n.chain.Length())
+	// Blocks downloaded while catching up are old news for the peers
+	if !n.syncing() {
+		n.announce(messages.NewInvVect(messages.InvTypeBlock, hash))
+	}
+	return nil
+}
+
+// announce sends the item to every peer, peers which already know it are skipped
+func (n *Node) announce(item messages.InvVect) {
+	for _, p := range n.GetPeers() {
+		if err := p.AnnounceInventory(item); err != nil {
+			n.logger.Warn("Failed to announce inventory", "peer", p.GetAddr().ToString(), "err", err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package node
+
+import (
+	"errors"
+	"time"
+
+	"github.com/timcki/learncoin/internal/chain"
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/messages"
+	"github.com/timcki/learncoin/internal/peer"
+)
+
+// Initial block download is headers first. The node asks peers which are
+// ahead of it for their headers, validates the header chain and then
+// downloads the missing blocks from all peers in parallel. Requests a peer
+// doesn't answer in time are sent to another peer
+
+const (
+	// Blocks requested from a single peer at once
+	maxBlocksPerPeer = 16
+	// Time a peer has to deliver a requested block
+	blockStallTimeout = 15 * time.Second
+	// Time without a connected block after which the node stops syncing.
+	// Headers are cheap, so a header chain whose blocks never arrive must
+	// not keep the node from announcing blocks
+	maxSyncStall = 2 * time.Minute
+)
+
+// blockRequest is a block requested from a peer
+type blockRequest struct {
+	peer string
+	time time.Time
+}
+
+// RequestHeaders asks the peer for the headers following our best header chain
+func (n *Node) RequestHeaders(p peer.Peer) error {
+	return p.WriteMessage(messages.NewGetHeadersMessage(n.chain.BlockLocator(), nil))
+}
+
+func (n *Node) LocateHeaders(locator []crypto.Hash, stop crypto.Hash) []chain.Header {
+	return n.chain.LocateHeaders(locator, stop, messages.MaxHeaders)
+}
+
+// ReceiveHeaders validates the headers sent by the peer and downloads their
+// blocks. A full message means the peer has more so they're requested too,
+// unless the peer reached its limit of headers waiting for their blocks.
+// Then the next headers are requested once the blocks caught up
+func (n *Node) ReceiveHeaders(from peer.Peer, headers []chain.Header) error {
+	behind := n.chain.Height() < n.chain.BestHeaderHeight()
+	added, err := n.chain.AcceptHeaders(headers, from.GetKey())
+	limited := errors.Is(err, chain.HeaderLimitError)
+	if err != nil && !limited {
+		return err
+	}
+	if !behind && n.chain.Height() < n.chain.BestHeaderHeight() {
+		n.markSyncProgress()
+	}
+	if added > 0 {
+		n.logger.Info("Accepted headers", "count", added, "height", n.chain.BestHeaderHeight())
+	}
+	if len(headers) == messages.MaxHeaders && !limited {
+		if err := n.RequestHeaders(from); err != nil {
+			return err
+		}
+	}
+	n.requestBlocks()
+	return err
+}
+
+// ReceiveBlock submits a block sent by the peer. An orphan which isn't part
+// of our header chain means the peer is ahead of us, so we ask for its headers
+func (n *Node) ReceiveBlock(from peer.Peer, block *chain.Block) error {
+	hash, err := block.Header.Hash()
+	if err != nil {
+		return err
+	}
+	known := n.chain.HaveHeader(hash)
+	err = n.SubmitBlock(block)
+	if errors.Is(err, chain.OrphanBlockError) && !known {
+		if err := n.RequestHeaders(from); err != nil {
+			n.logger.Warn("Failed to request headers", "err", err)
+		}
+	}
+	if n.syncing() {
+		n.requestBlocks()
+	} else if err == nil && n.chain.Height() == n.chain.BestHeaderHeight() {
+		// The blocks caught up with the headers, which could have been
+		// limited before the peer sent all of them
+		n.syncWith(from)
+	}
+	return err
+}
+
+// syncing reports if the blocks of the best header chain aren't all connected
+// yet and the download didn't stall for longer than maxSyncStall
+func (n *Node) syncing() bool {
+	if n.chain.Height() >= n.chain.BestHeaderHeight() {
+		return false
+	}
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+	return time.Since(n.syncProgress) < maxSyncStall
+}
+
+// markSyncProgress restarts the time the sync may stall for
+func (n *Node) markSyncProgress() {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+	n.syncProgress = time.Now()
+}
+
+// blockReceived marks the request of the block as done. Returns if the block
+// was requested
+func (n *Node) blockReceived(hash crypto.Hash) bool {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+	_, requested := n.inFlight[string(hash)]
+	_, stalled := n.stalled[string(hash)]
+	delete(n.inFlight, string(hash))
+	delete(n.stalled, string(hash))
+	return requested || stalled
+}
+
+// requestBlocks requests the missing blocks of the best header chain, lowest
+// first, from the least busy peers. Blocks are requested again from another
+// peer than the one which stalled on them if there's one
+func (n *Node) requestBlocks() {
+	peers := n.GetPeers()
+	if len(peers) == 0 {
+		return
+	}
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+
+	load := make(map[string]int)
+	for _, req := range n.inFlight {
+		load[req.peer]++
+	}
+	batches := make(map[string][]messages.InvVect)
+	for _, hash := range n.chain.MissingBlocks(maxBlocksPerPeer * len(peers)) {
+		if _, ok := n.inFlight[string(hash)]; ok {
+			continue
+		}
+		stalled, hasStalled := n.stalled[string(hash)]
+		var best string
+		found := false
+		for key := range peers {
+			if load[key] >= maxBlocksPerPeer || (hasStalled && key == stalled && len(peers) > 1) {
+				continue
+			}
+			if !found || load[key] < load[best] {
+				best, found = key, true
+			}
+		}
+		if !found {
+			break
+		}
+		load[best]++
+		n.inFlight[string(hash)] = blockRequest{peer: best, time: time.Now()}
+		batches[best] = append(batches[best], messages.NewInvVect(messages.InvTypeBlock, hash))
+	}
+
+	for key, items := range batches {
+		p := peers[key]
+		if err := p.WriteMessage(messages.NewGetDataMessage(items)); err != nil {
+			n.logger.Warn("Failed to request blocks", "peer", p.GetAddr().ToString(), "err", err)
+			for _, item := range items {
+				delete(n.inFlight, string(item.Hash))
+			}
+		}
+	}
+}
+
+// monitorDownloads releases the requests which stalled and requests the
+// missing blocks again
+func (n *Node) monitorDownloads() {
+	for range time.Tick(time.Second) {
+		n.syncMu.Lock()
+		for key, req := range n.inFlight {
+			if time.Since(req.time) > blockStallTimeout {
+				delete(n.inFlight, key)
+				n.stalled[key] = req.peer
+				n.logger.Warn("Block download stalled", "hash", crypto.Hash(key))
+			}
+		}
+		n.syncMu.Unlock()
+		n.requestBlocks()
+	}
+}
@@ -0,0 +1,105 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/timcki/learncoin/internal/config"
+	"github.com/timcki/learncoin/internal/constants"
+	"github.com/timcki/learncoin/internal/messages"
+)
+
+// Time the peer has to complete the handshake
+var HandshakeTimeout = 10 * time.Second
+
+var (
+	SelfConnectionError      = errors.New("Connected to ourselves")
+	UnsupportedProtocolError = errors.New("Peer's protocol version isn't supported")
+	DuplicateVersionError    = errors.New("Received VersionMessage twice during the handshake")
+	UnexpectedMessageError   = errors.New("Received message before the handshake completed")
+)
+
+// Handshake exchanges version and verack messages with the peer. The outbound
+// side sends its version first and the inbound side answers it. Both sides
+// acknowledge the version they got with a verack and the handshake completes
+// once we got both, any other message before is an error
+func (p *Peer) Handshake(local *messages.VersionMessage) error {
+	if err := p.conn.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return err
+	}
+	defer p.conn.SetDeadline(time.Time{})
+
+	if !p.inbound {
+		if err := p.WriteMessage(local); err != nil {
+			return err
+		}
+	}
+	gotVersion, gotVerAck := false, false
+	for !gotVersion || !gotVerAck {
+		msg, err := p.ReadMessage()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case messages.VersionMessage:
+			if gotVersion {
+				return DuplicateVersionError
+			}
+			if err := p.handleVersion(msg, local); err != nil {
+				return err
+			}
+			if p.inbound {
+				if err := p.WriteMessage(local); err != nil {
+					return err
+				}
+			}
+			if err := p.WriteMessage(messages.NewVerAckMessage()); err != nil {
+				return err
+			}
+			gotVersion = true
+		case messages.VerAckMessage:
+			// Inbound peers only send their version after getting the remote one
+			if p.inbound && !gotVersion {
+				return UnexpectedMessageError
+			}
+			gotVerAck = true
+		default:
+			if !gotVersion {
+				return NoVersionMessageOnInitError
+			}
+			return UnexpectedMessageError
+		}
+	}
+	p.logger.Debug("Completed handshake", "agent", p.userAgent, "protocol", p.protocolVersion, "height", p.bestHeight)
+	return nil
+}
+
+// handleVersion checks the remote version and stores what it advertises
+func (p *Peer) handleVersion(ver messages.VersionMessage, local *messages.VersionMessage) error {
+	if ver.Nonce == local.Nonce {
+		return SelfConnectionError
+	}
+	if ver.ProtocolVersion < constants.MinProtocolVersion {
+		return UnsupportedProtocolError
+	}
+	_, port, err := net.SplitHostPort(ver.Address)
+	if err != nil {
+		return MalformedVersionMessageError
+	}
+	host, remotePort, err := net.SplitHostPort(p.conn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	if p.inbound {
+		// Inbound connections come from an ephemeral port, the peer listens on the advertised one
+		p.addr = config.NewAddress(host, port)
+	} else {
+		p.addr = config.NewAddress(host, remotePort)
+	}
+	p.id = ver.ID
+	p.userAgent = ver.Version
+	p.protocolVersion = min(local.ProtocolVersion, ver.ProtocolVersion)
+	p.bestHeight = ver.BestHeight
+	return nil
+}
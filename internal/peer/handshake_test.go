@@ -0,0 +1,166 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/messages"
+)
+
+// pipeConn is one end of a pipe which looks like a TCP connection from
+// 127.0.0.1:40000
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+// newTestPeer returns a peer on one end of a pipe and the other end
+func newTestPeer(t *testing.T, inbound bool) (*Peer, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	p := NewPeer(logger, nil, nil, nil)
+	p.SetConn(pipeConn{local})
+	p.SetInbound(inbound)
+	return &p, remote
+}
+
+func newTestVersion(nonce uint64, protocol uint32) *messages.VersionMessage {
+	ver := messages.NewVersionMessage("test", "10.0.0.1:9000", crypto.FixedHash{1}, nonce, 7)
+	ver.ProtocolVersion = protocol
+	return ver
+}
+
+// remote plays the other side of the handshake, sending the messages after
+// reading the given number of messages. It keeps reading since writes to a
+// pipe block until they're read. Errors end it, the peer reports them
+func remote(conn net.Conn, reads int, msgs ...messages.Message) {
+	read := make(chan struct{}, 16)
+	go func() {
+		for {
+			if _, err := messages.ReadMessage(conn); err != nil {
+				close(read)
+				return
+			}
+			read <- struct{}{}
+		}
+	}()
+	go func() {
+		for i := 0; i < reads; i++ {
+			if _, ok := <-read; !ok {
+				return
+			}
+		}
+		for _, msg := range msgs {
+			if err := messages.WriteMessage(conn, msg); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestHandshakeOutbound(t *testing.T) {
+	p, conn := newTestPeer(t, false)
+	remote(conn, 1, newTestVersion(2, 2), messages.NewVerAckMessage())
+
+	if err := p.Handshake(newTestVersion(1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	// Both sides speak the lower protocol version
+	if p.GetProtocolVersion() != 2 {
+		t.Fatalf("expected protocol version 2, got %d", p.GetProtocolVersion())
+	}
+	if p.GetBestHeight() != 7 {
+		t.Fatalf("expected best height 7, got %d", p.GetBestHeight())
+	}
+	// The dialed address, not the advertised one
+	if addr := p.GetAddr().ToString(); addr != "127.0.0.1:40000" {
+		t.Fatalf("expected address 127.0.0.1:40000, got %s", addr)
+	}
+}
+
+func TestHandshakeInbound(t *testing.T) {
+	p, conn := newTestPeer(t, true)
+	remote(conn, 0, newTestVersion(2, 3), messages.NewVerAckMessage())
+
+	if err := p.Handshake(newTestVersion(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if p.GetProtocolVersion() != 2 {
+		t.Fatalf("expected protocol version 2, got %d", p.GetProtocolVersion())
+	}
+	// The connection comes from an ephemeral port, the peer listens on the advertised one
+	if addr := p.GetAddr().ToString(); addr != "127.0.0.1:9000" {
+		t.Fatalf("expected address 127.0.0.1:9000, got %s", addr)
+	}
+}
+
+// Our own version coming back means we dialed ourselves
+func TestHandshakeSelfConnection(t *testing.T) {
+	p, conn := newTestPeer(t, false)
+	local := newTestVersion(1, 2)
+	remote(conn, 1, local)
+
+	if err := p.Handshake(local); !errors.Is(err, SelfConnectionError) {
+		t.Fatalf("expected %v, got %v", SelfConnectionError, err)
+	}
+}
+
+func TestHandshakeUnsupportedProtocol(t *testing.T) {
+	p, conn := newTestPeer(t, true)
+	remote(conn, 0, newTestVersion(2, 0))
+
+	if err := p.Handshake(newTestVersion(1, 2)); !errors.Is(err, UnsupportedProtocolError) {
+		t.Fatalf("expected %v, got %v", UnsupportedProtocolError, err)
+	}
+}
+
+// An inbound peer can't acknowledge a version it didn't get yet
+func TestHandshakeVerAckBeforeVersion(t *testing.T) {
+	p, conn := newTestPeer(t, true)
+	remote(conn, 0, messages.NewVerAckMessage(), newTestVersion(2, 2))
+
+	if err := p.Handshake(newTestVersion(1, 2)); !errors.Is(err, UnexpectedMessageError) {
+		t.Fatalf("expected %v, got %v", UnexpectedMessageError, err)
+	}
+}
+
+func TestHandshakeOtherMessage(t *testing.T) {
+	p, conn := newTestPeer(t, false)
+	remote(conn, 1, messages.NewPingMessage())
+
+	if err := p.Handshake(newTestVersion(1, 2)); !errors.Is(err, NoVersionMessageOnInitError) {
+		t.Fatalf("expected %v, got %v", NoVersionMessageOnInitError, err)
+	}
+}
+
+// A peer which never answers can't hold the connection open
+func TestHandshakeTimeout(t *testing.T) {
+	timeout := HandshakeTimeout
+	HandshakeTimeout = 50 * time.Millisecond
+	defer func() { HandshakeTimeout = timeout }()
+
+	p, conn := newTestPeer(t, true)
+	remote(conn, 0)
+
+	start := time.Now()
+	if err := p.Handshake(newTestVersion(1, 2)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", os.ErrDeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handshake took %v", elapsed)
+	}
+}
@@ -0,0 +1,169 @@
+package peer
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/timcki/learncoin/internal/chain"
+	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/messages"
+	"github.com/timcki/learncoin/internal/transaction"
+)
+
+// Number of inventory items remembered per peer, the oldest ones are
+// forgotten first
+const maxKnownInventory = 20000
+
+var (
+	TooManyInvItemsError = errors.New("Inventory message has too many items")
+	TooManyHeadersError  = errors.New("Headers message has too many headers")
+)
+
+// Relay gives the peers access to the node's chain and mempool
+type Relay interface {
+	HaveInventory(messages.InvVect) bool
+	GetInventory(messages.InvVect) (messages.Message, bool)
+	SubmitTransaction(transaction.Transaction) error
+	ReceiveBlock(Peer, *chain.Block) error
+	LocateHeaders(locator []crypto.Hash, stop crypto.Hash) []chain.Header
+	ReceiveHeaders(Peer, []chain.Header) error
+}
+
+// inventorySet remembers the transactions and blocks a peer is known to
+// have. It's shared by all copies of the peer
+type inventorySet struct {
+	mu    sync.Mutex
+	items map[string]struct{}
+	// Keys in the order they were added
+	order []string
+}
+
+func newInventorySet() *inventorySet {
+	return &inventorySet{items: make(map[string]struct{})}
+}
+
+// add marks the item as known and reports if it was known before
+func (s *inventorySet) add(item messages.InvVect) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := item.Key()
+	if _, ok := s.items[key]; ok {
+		return true
+	}
+	if len(s.order) >= maxKnownInventory {
+		delete(s.items, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.items[key] = struct{}{}
+	s.order = append(s.order, key)
+	return false
+}
+
+func (s *inventorySet) has(item messages.InvVect) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.items[item.Key()]
+	return ok
+}
+
+// AnnounceInventory sends an inv with the items the peer doesn't know about
+// yet. Items only become known once the inv was written, so the ones which
+// failed to be sent are announced again the next time
+func (p Peer) AnnounceInventory(items ...messages.InvVect) error {
+	unknown := make([]messages.InvVect, 0, len(items))
+	for _, item := range items {
+		if !p.known.has(item) {
+			unknown = append(unknown, item)
+		}
+	}
+	for len(unknown) > 0 {
+		n := min(len(unknown), messages.MaxInvItems)
+		if err := p.WriteMessage(messages.NewInvMessage(unknown[:n])); err != nil {
+			return err
+		}
+		for _, item := range unknown[:n] {
+			p.known.add(item)
+		}
+		unknown = unknown[n:]
+	}
+	return nil
+}
+
+// HandleInvMessage requests the announced items we don't have yet
+func (p *Peer) HandleInvMessage(msg messages.InvMessage) error {
+	if len(msg.Items) > messages.MaxInvItems {
+		return TooManyInvItemsError
+	}
+	request := make([]messages.InvVect, 0, len(msg.Items))
+	for _, item := range msg.Items {
+		p.known.add(item)
+		if !p.relay.HaveInventory(item) {
+			request = append(request, item)
+		}
+	}
+	if len(request) == 0 {
+		return nil
+	}
+	return p.WriteMessage(messages.NewGetDataMessage(request))
+}
+
+// HandleGetDataMessage sends the requested items, the missing ones are
+// listed in a notfound
+func (p *Peer) HandleGetDataMessage(msg messages.GetDataMessage) error {
+	if len(msg.Items) > messages.MaxInvItems {
+		return TooManyInvItemsError
+	}
+	notFound := make([]messages.InvVect, 0)
+	for _, item := range msg.Items {
+		data, ok := p.relay.GetInventory(item)
+		if !ok {
+			notFound = append(notFound, item)
+			continue
+		}
+		p.known.add(item)
+		if err := p.WriteMessage(data); err != nil {
+			return err
+		}
+	}
+	if len(notFound) == 0 {
+		return nil
+	}
+	return p.WriteMessage(messages.NewNotFoundMessage(notFound))
+}
+
+// HandleTxMessage hands the transaction to the node which relays it if it's valid
+func (p *Peer) HandleTxMessage(msg messages.TxMessage) error {
+	hash, err := msg.Transaction.Hash()
+	if err != nil {
+		return err
+	}
+	p.known.add(messages.NewInvVect(messages.InvTypeTx, hash))
+	return p.relay.SubmitTransaction(msg.Transaction)
+}
+
+// HandleBlockMessage hands the block to the node which relays it if it's valid
+func (p *Peer) HandleBlockMessage(msg messages.BlockMessage) error {
+	if msg.Block == nil {
+		return messages.MalformedPayloadError
+	}
+	hash, err := msg.Block.Header.Hash()
+	if err != nil {
+		return err
+	}
+	p.known.add(messages.NewInvVect(messages.InvTypeBlock, hash))
+	return p.relay.ReceiveBlock(*p, msg.Block)
+}
+
+// HandleGetHeadersMessage sends the headers of our chain following the locator
+func (p *Peer) HandleGetHeadersMessage(msg messages.GetHeadersMessage) error {
+	return p.WriteMessage(messages.NewHeadersMessage(p.relay.LocateHeaders(msg.Locator, msg.Stop)))
+}
+
+// HandleHeadersMessage hands the headers to the node which validates them
+// and downloads their blocks
+func (p *Peer) HandleHeadersMessage(msg messages.HeadersMessage) error {
+	if len(msg.Headers) > messages.MaxHeaders {
+		return TooManyHeadersError
+	}
+	return p.relay.ReceiveHeaders(*p, msg.Headers)
+}
@@ -1,11 +1,10 @@
 package peer
 
 import (
-	"encoding/gob"
-	"encoding/json"
 	"errors"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	log "github.com/inconshreveable/log15"
@@ -14,11 +13,6 @@ import (
 	"github.com/timcki/learncoin/internal/messages"
 )
 
-const (
-	connHost string = "localhost"
-	connType string = "tcp"
-)
-
 var (
 	NoVersionMessageOnInitError  = errors.New("Didn't receive VersionMessage on initial connection")
 	MalformedVersionMessageError = errors.New("Malformed VersionMessage on initial connection")
@@ -39,6 +33,9 @@ type Peer struct {
 	inbound bool
 
 	// Stats that arrive from node with the version flag
+	userAgent       string
+	protocolVersion uint32
+	bestHeight      uint64
 
 	// Channels for internal message communication
 	// network handler -> internal executor
@@ -52,9 +49,17 @@ type Peer struct {
 	// safe for concurrent access (I think?)
 	alive bool
 
+	// Transactions and blocks the peer has
+	known *inventorySet
+
+	// Closed once the connection is gone, shared by all copies of the peer
+	done      chan struct{}
+	closeOnce *sync.Once
+
 	// Callbacks to node
-	getPeers                func(crypto.FixedHash) []string
-	newOutboundPeerCallback func(string) error
+	getPeers     func(exclude string) []string
+	addAddresses func(addrs []string, source string)
+	relay        Relay
 }
 
 func (p *Peer) SetConn(conn net.Conn) {
@@ -81,10 +86,32 @@ func (p Peer) GetAddr() config.Address {
 	return p.addr
 }
 
+// GetID returns the ID the peer advertised in its version. Any peer can
+// claim any ID, so it doesn't identify the peer
 func (p Peer) GetID() crypto.FixedHash {
 	return p.id
 }
 
+// GetKey returns the remote address of the connection, which identifies the
+// peer among the connected ones
+func (p Peer) GetKey() string {
+	return p.conn.RemoteAddr().String()
+}
+
+func (p Peer) GetUserAgent() string {
+	return p.userAgent
+}
+
+// GetProtocolVersion returns the negotiated protocol version
+func (p Peer) GetProtocolVersion() uint32 {
+	return p.protocolVersion
+}
+
+// GetBestHeight returns the height the peer advertised in its version
+func (p Peer) GetBestHeight() uint64 {
+	return p.bestHeight
+}
+
 func (p Peer) IsInboud() bool {
 	return p.inbound
 }
@@ -92,73 +119,43 @@ func (p Peer) IsAlive() bool {
 	return p.alive
 }
 
+// ReadMessage reads the next frame from the connection
 func (p Peer) ReadMessage() (messages.Message, error) {
-	var msg messages.Message
-	if err := gob.NewDecoder(p.conn).Decode(&msg); err != nil {
-		return nil, err
-	}
-	return msg, nil
-}
-
-func parseMessage[T messages.Msg](conn net.Conn) (*T, error) {
-	msg := new(T)
-	if err := json.NewDecoder(conn).Decode(msg); err != nil {
-		return nil, err
-	}
-	return msg, nil
+	return messages.ReadMessage(p.conn)
 }
 
+// WriteMessage sends the message as a single frame
 func (p Peer) WriteMessage(msg messages.Message) error {
-	return gob.NewEncoder(p.conn).Encode(&msg)
+	return messages.WriteMessage(p.conn, msg)
 }
 
+// HandleAddressMessage hands the addresses to the node's address manager,
+// the node decides which ones to connect to
 func (p *Peer) HandleAddressMessage(msg messages.AddrMessage) {
-	for _, addr := range msg.Nodes {
-		if err := p.newOutboundPeerCallback(addr); err != nil {
-			p.logger.Warn("Failed to connect to node", "addr", addr)
-		} else {
-			p.logger.Debug("Connected to", "addr", addr)
-		}
+	nodes := msg.Nodes
+	if len(nodes) > messages.MaxAddrs {
+		nodes = nodes[:messages.MaxAddrs]
 	}
+	p.addAddresses(nodes, p.addr.ToString())
 }
 
 func (p *Peer) HandleGetAddressMessage() error {
-	otherPeers := p.getPeers(p.id)
+	otherPeers := p.getPeers(p.addr.ToString())
 	msg := messages.NewAddrMessage(otherPeers)
 	return p.WriteMessage(msg)
 }
 
-// handleVersionMessage reads a message from the peer network connection,
-// parses it if it's a VersionMessage and sends a VerAck, otherwise returns error
-func (p *Peer) HandleVersionMessage() error {
-	msg, err := p.ReadMessage()
-	if err != nil {
-		return err
-	}
-	ver := msg.(messages.VersionMessage)
-
-	address := p.conn.RemoteAddr().String()
-	p.logger.Info("Remote addr string", "addr", address)
-	p.addr = config.NewAddressFromString(address)
-	p.id = ver.ID
-	p.logger.Debug("addr", "addr", p.addr)
-
-	return nil
+// Disconnect closes the connection and stops the handlers of the peer
+func (p Peer) Disconnect() {
+	p.closeOnce.Do(func() {
+		p.conn.Close()
+		close(p.done)
+	})
 }
 
-// TODO: Add background func started in main that periodically
-// iterates over all peers and tries to reconnect to dead ones
-// or deletes ones that are dead for longer than 90 minutes
-func (p *Peer) restartConnection() error {
-	p.conn.Close()
-	conn, err := net.Dial(connType, p.addr.ToString())
-	if err != nil {
-		//log.Error().Err(err).Str("peer", p.addr).Msg("Failed restaring connection to peer")
-		p.alive = false
-		return err
-	}
-	p.conn = conn
-	return nil
+// Done is closed once the peer got disconnected
+func (p Peer) Done() <-chan struct{} {
+	return p.done
 }
 
 func (p Peer) Start() {
@@ -169,7 +166,14 @@ func (p Peer) Start() {
 
 // inHandler sends messages to other peers
 func (p *Peer) outHandler() {
-	for range time.Tick(3 * time.Second) {
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
 		if !p.inbound {
 			if err := p.WriteMessage(messages.NewPingMessage()); err != nil {
 				log.Error("Failed to send ping", "err", err)
@@ -243,13 +247,16 @@ func (p *Peer) outHandler() {
 func (p *Peer) inHandler() {
 	for {
 		msg, err := p.ReadMessage()
+		if messages.IsFrameError(err) {
+			// The frame got skipped, the stream is still usable
+			p.logger.Warn("Dropped malformed message", "err", err)
+			continue
+		}
 		if err != nil {
+			// The node's connection manager replaces lost outbound peers
 			p.logger.Error("Received malformed request", "err", err)
-			if err := p.restartConnection(); err != nil {
-				// TODO: Kill all goroutines?
-				return
-			}
-			continue
+			p.Disconnect()
+			return
 		}
 		switch msg.Command() {
 		case messages.CmdVersion:
@@ -269,6 +276,32 @@ func (p *Peer) inHandler() {
 		case messages.CmdAddr:
 			p.logger.Debug("Got Address command")
 			p.HandleAddressMessage(msg.(messages.AddrMessage))
+		case messages.CmdInv:
+			if err := p.HandleInvMessage(msg.(messages.InvMessage)); err != nil {
+				p.logger.Warn("Failed to handle inventory", "err", err)
+			}
+		case messages.CmdGetData:
+			if err := p.HandleGetDataMessage(msg.(messages.GetDataMessage)); err != nil {
+				p.logger.Warn("Failed to send requested data", "err", err)
+			}
+		case messages.CmdNotFound:
+			p.logger.Debug("Peer doesn't have requested data", "items", len(msg.(messages.NotFoundMessage).Items))
+		case messages.CmdTx:
+			if err := p.HandleTxMessage(msg.(messages.TxMessage)); err != nil {
+				p.logger.Debug("Rejected transaction", "err", err)
+			}
+		case messages.CmdBlock:
+			if err := p.HandleBlockMessage(msg.(messages.BlockMessage)); err != nil {
+				p.logger.Debug("Rejected block", "err", err)
+			}
+		case messages.CmdGetHeaders:
+			if err := p.HandleGetHeadersMessage(msg.(messages.GetHeadersMessage)); err != nil {
+				p.logger.Warn("Failed to send headers", "err", err)
+			}
+		case messages.CmdHeaders:
+			if err := p.HandleHeadersMessage(msg.(messages.HeadersMessage)); err != nil {
+				p.logger.Warn("Rejected headers", "err", err)
+			}
 		default:
 			p.logger.Warn("Unknown command")
 		}
@@ -277,12 +310,17 @@ func (p *Peer) inHandler() {
 
 func NewPeer(
 	logger log.Logger,
-	getPeersCallback func(crypto.FixedHash) []string,
-	newOutboundPeerCallback func(string) error,
+	getPeersCallback func(string) []string,
+	addAddressesCallback func([]string, string),
+	relay Relay,
 ) Peer {
 	return Peer{
-		logger:                  logger,
-		getPeers:                getPeersCallback,
-		newOutboundPeerCallback: newOutboundPeerCallback,
+		logger:       logger,
+		known:        newInventorySet(),
+		done:         make(chan struct{}),
+		closeOnce:    new(sync.Once),
+		getPeers:     getPeersCallback,
+		addAddresses: addAddressesCallback,
+		relay:        relay,
 	}
 }
@@ -2,13 +2,15 @@ package transaction
 
 import (
 	"bytes"
-	"encoding/json"
+	"errors"
 
 	"filippo.io/edwards25519"
 	"github.com/akamensky/base58"
 	"github.com/timcki/learncoin/internal/crypto"
 )
 
+var MismatchedInputsError = errors.New("Every input needs its real utxo and a set of decoys")
+
 type curveValue interface {
 	*edwards25519.Point | *edwards25519.Scalar
 }
@@ -33,27 +35,6 @@ type OneTimeAddress struct {
 	R *edwards25519.Point
 }
 
-func (a OneTimeAddress) MarshalJSON() ([]byte, error) {
-	result := make(map[string][]byte)
-	result["P"] = a.P.Bytes()
-	result["R"] = a.R.Bytes()
-	return json.Marshal(&result)
-}
-
-func (a *OneTimeAddress) UnmarshalJSON([]byte) error {
-	result := make(map[string][]byte)
-	var err error
-	a.P, err = edwards25519.NewIdentityPoint().SetBytes(result["P"])
-	if err != nil {
-		return err
-	}
-	a.R, err = edwards25519.NewIdentityPoint().SetBytes(result["R"])
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 func (pb PublicKey) ToHumanReadable(truncated bool) (string, error) {
 	var buffer bytes.Buffer
 	var addressType string
@@ -116,30 +97,112 @@ func NewAddress() (Address, error) {
 	return addr, nil
 }
 
-func (a Address) NewTransaction(utxosIn []Utxo, amount float32, to Address) Transaction {
+// NewTransaction creates a transaction spending the realUtxos, each hidden in its
+// own ring with the decoys at the same index. It sends amount to the destination
+// address and the rest of the inputs minus the fee back to us as change. The
+// ring members are referenced by their output numbers looked up in outputs.
+// The inputs still have to be signed with SignTransaction
+func (a Address) NewTransaction(realUtxos []Utxo, decoys [][]Utxo, amount, fee Amount, to Address, outputs OutputIndexer) (Transaction, error) {
+	if len(realUtxos) == 0 || len(realUtxos) != len(decoys) {
+		return Transaction{}, MismatchedInputsError
+	}
+	inAmounts := make([]Amount, len(realUtxos))
+	for i, utxo := range realUtxos {
+		inAmount, _, err := a.OpenUtxo(utxo)
+		if err != nil {
+			return Transaction{}, err
+		}
+		inAmounts[i] = inAmount
+	}
+	inTotal, err := SumAmounts(inAmounts...)
+	if err != nil {
+		return Transaction{}, err
+	}
+	spent, err := SumAmounts(amount, fee)
+	if err != nil {
+		return Transaction{}, err
+	}
 	// Check if input amount == output amount.  If not we need
 	// to generate change output to a new one time address generated
 	// from our keys
-	changeAmount := utxosIn[0].Amount - amount
-	oneTimeTo, _ := to.NewDestinationAddress()
+	changeAmount, err := inTotal.Sub(spent)
+	if err != nil {
+		return Transaction{}, err
+	}
 
 	// Create utxo out
-	utxosOut := []Utxo{*NewUtxo(amount, oneTimeTo)}
-	var changeUtxo *Utxo = nil
+	out, outMask, err := to.NewOutput(amount)
+	if err != nil {
+		return Transaction{}, err
+	}
+	utxosOut := []Utxo{*out}
+	amounts := []Amount{amount}
+	outMasks := []*edwards25519.Scalar{outMask}
+	masks := edwards25519.NewScalar().Set(outMask)
 	if changeAmount != 0 {
-		oneTimeChange, _ := a.NewDestinationAddress()
-		changeUtxo = NewUtxo(changeAmount, oneTimeChange)
+		change, changeMask, err := a.NewOutput(changeAmount)
+		if err != nil {
+			return Transaction{}, err
+		}
+		utxosOut = append(utxosOut, *change)
+		amounts = append(amounts, changeAmount)
+		outMasks = append(outMasks, changeMask)
+		masks.Add(masks, changeMask)
 	}
-	if changeUtxo != nil {
-		utxosOut = append(utxosOut, *changeUtxo)
+	rangeProof, err := NewRangeProof(amounts, outMasks)
+	if err != nil {
+		return Transaction{}, err
 	}
 
+	// Every pseudo output gets a random mask except the last one which makes
+	// the masks sum up to the output masks, so the commitments balance out
+	inputs := make([]TxInput, len(realUtxos))
+	pseudoMasks := make([]*edwards25519.Scalar, len(realUtxos))
+	for i, utxo := range realUtxos {
+		mask := edwards25519.NewScalar().Set(masks)
+		if i != len(realUtxos)-1 {
+			if mask, err = randomScalar(); err != nil {
+				return Transaction{}, err
+			}
+			masks.Subtract(masks, mask)
+		}
+		pseudoMasks[i] = mask
+		ring, offsets, err := newRing(utxo, decoys[i], outputs)
+		if err != nil {
+			return Transaction{}, err
+		}
+		inputs[i] = TxInput{
+			RingOffsets:  offsets,
+			Ring:         ring,
+			PseudoOutput: Commit(inAmounts[i], mask).Bytes(),
+		}
+	}
 	return Transaction{
-		UtxosIn:  utxosIn,
-		UtxosOut: utxosOut,
-		To:       oneTimeTo,
-		Sigature: RingSignature{},
+		Inputs:      inputs,
+		UtxosOut:    utxosOut,
+		RangeProof:  rangeProof,
+		Fee:         fee,
+		To:          out.Keypair,
+		pseudoMasks: pseudoMasks,
+	}, nil
+}
+
+// SignTransaction signs every input of the transaction with a CLSAG signature.
+// realUtxos[i] is the utxo spent by the i-th input. Only transactions created
+// with NewTransaction can be signed since the pseudo output masks are needed
+func (a Address) SignTransaction(t *Transaction, realUtxos []Utxo) error {
+	if len(realUtxos) != len(t.Inputs) || len(t.pseudoMasks) != len(t.Inputs) {
+		return MismatchedInputsError
 	}
+	message := t.SignatureMessage()
+	for i, realUtxo := range realUtxos {
+		sig, err := a.NewCLSAG(realUtxo, t.Inputs[i].Ring, t.Inputs[i].PseudoOutput, t.pseudoMasks[i], message)
+		if err != nil {
+			return err
+		}
+		t.Inputs[i].Signature = sig
+	}
+	return nil
 }
 
 // CheckDestinationAddress checks if the destination address was generated from
@@ -168,9 +231,19 @@ func (a Address) CheckDestinationAddress(dest OneTimeAddress) bool {
 // P = Hs(rA)G + B
 // R = rG
 func (addr Address) NewDestinationAddress() (OneTimeAddress, error) {
+	dest, _, err := addr.newDestination()
+	return dest, err
+}
+
+// newDestination computes the one time address together with the
+// shared secret Hs(rA) which only the sender and recipient know
+func (addr Address) newDestination() (OneTimeAddress, *edwards25519.Scalar, error) {
 	// Calculate random r and corresponding R
 	// R = rG
 	R, r, err := newKeypair()
+	if err != nil {
+		return OneTimeAddress{}, nil, err
+	}
 
 	// Calculate rA
 	rA := new(edwards25519.Point).ScalarMult(r, addr.PubKey.A)
@@ -178,7 +251,7 @@ func (addr Address) NewDestinationAddress() (OneTimeAddress, error) {
 	// Calculate Hs(rA)
 	HsrA, err := hashPointToScalar(rA)
 	if err != nil {
-		return OneTimeAddress{}, err
+		return OneTimeAddress{}, nil, err
 	}
 
 	// P = Hs(rA)G + B
@@ -187,5 +260,5 @@ func (addr Address) NewDestinationAddress() (OneTimeAddress, error) {
 		addr.PubKey.B,
 	)
 
-	return OneTimeAddress{P: P, R: R}, nil
+	return OneTimeAddress{P: P, R: R}, HsrA, nil
 }
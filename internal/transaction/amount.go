@@ -0,0 +1,101 @@
+package transaction
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Amount is a quantity of learncoin expressed in atomic units. Using
+// integers keeps the arithmetic exact, unlike floating point values
+type Amount uint64
+
+const (
+	// Number of decimal places of a coin
+	AmountDecimals = 8
+	// Number of atomic units in a single coin
+	AtomicUnitsPerCoin Amount = 100_000_000
+)
+
+var (
+	AmountOverflowError  = errors.New("Amount overflows")
+	AmountUnderflowError = errors.New("Amount would be negative")
+	InvalidAmountError   = errors.New("Malformed amount")
+)
+
+// Add returns a + b or AmountOverflowError if the sum doesn't fit in an Amount
+func (a Amount) Add(b Amount) (Amount, error) {
+	if a > math.MaxUint64-b {
+		return 0, AmountOverflowError
+	}
+	return a + b, nil
+}
+
+// Sub returns a - b or AmountUnderflowError if b is greater than a
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if b > a {
+		return 0, AmountUnderflowError
+	}
+	return a - b, nil
+}
+
+// SumAmounts adds all amounts checking for overflow
+func SumAmounts(amounts ...Amount) (Amount, error) {
+	var sum Amount
+	var err error
+	for _, amount := range amounts {
+		if sum, err = sum.Add(amount); err != nil {
+			return 0, err
+		}
+	}
+	return sum, nil
+}
+
+// ParseAmount parses a human readable coin amount e.g. "12.5" into
+// atomic units. At most AmountDecimals decimal places are allowed
+func ParseAmount(s string) (Amount, error) {
+	whole, fraction, _ := strings.Cut(strings.TrimSpace(s), ".")
+	if whole == "" && fraction == "" {
+		return 0, InvalidAmountError
+	}
+	if len(fraction) > AmountDecimals || strings.ContainsAny(whole+fraction, "+-") {
+		return 0, InvalidAmountError
+	}
+
+	var coins, units uint64
+	var err error
+	if whole != "" {
+		coins, err = strconv.ParseUint(whole, 10, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, AmountOverflowError
+		}
+		if err != nil {
+			return 0, InvalidAmountError
+		}
+	}
+	if fraction != "" {
+		// Right pad the fraction so it's expressed in atomic units
+		fraction += strings.Repeat("0", AmountDecimals-len(fraction))
+		if units, err = strconv.ParseUint(fraction, 10, 64); err != nil {
+			return 0, InvalidAmountError
+		}
+	}
+
+	if coins > math.MaxUint64/uint64(AtomicUnitsPerCoin) {
+		return 0, AmountOverflowError
+	}
+	return Amount(coins * uint64(AtomicUnitsPerCoin)).Add(Amount(units))
+}
+
+// String formats the amount in coins without trailing zeros e.g. "12.5"
+func (a Amount) String() string {
+	whole := strconv.FormatUint(uint64(a/AtomicUnitsPerCoin), 10)
+	units := uint64(a % AtomicUnitsPerCoin)
+	if units == 0 {
+		return whole
+	}
+	fraction := strconv.FormatUint(units, 10)
+	fraction = strings.Repeat("0", AmountDecimals-len(fraction)) + fraction
+	return whole + "." + strings.TrimRight(fraction, "0")
+}
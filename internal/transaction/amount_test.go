@@ -0,0 +1,99 @@
+package transaction
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	for _, test := range []struct {
+		s      string
+		amount Amount
+	}{
+		{"0", 0},
+		{"12.5", 1_250_000_000},
+		{" 1.5 ", 150_000_000},
+		{".5", 50_000_000},
+		{"5.", 500_000_000},
+		{"0.00000001", 1},
+		{"184467440737.09551615", math.MaxUint64},
+	} {
+		amount, err := ParseAmount(test.s)
+		if err != nil {
+			t.Fatalf("%q: %v", test.s, err)
+		}
+		if amount != test.amount {
+			t.Fatalf("%q: expected %d, got %d", test.s, test.amount, amount)
+		}
+	}
+}
+
+func TestParseAmountInvalid(t *testing.T) {
+	for _, test := range []struct {
+		s   string
+		err error
+	}{
+		{"", InvalidAmountError},
+		{" ", InvalidAmountError},
+		{".", InvalidAmountError},
+		{"1.123456789", InvalidAmountError},
+		{"-1", InvalidAmountError},
+		{"+1", InvalidAmountError},
+		{"1.-5", InvalidAmountError},
+		{"1.2.3", InvalidAmountError},
+		{"1e5", InvalidAmountError},
+		{"abc", InvalidAmountError},
+		{"184467440737.09551616", AmountOverflowError},
+		{"184467440738", AmountOverflowError},
+		{"99999999999999999999", AmountOverflowError},
+	} {
+		if _, err := ParseAmount(test.s); !errors.Is(err, test.err) {
+			t.Fatalf("%q: expected %v, got %v", test.s, test.err, err)
+		}
+	}
+}
+
+func TestAmountString(t *testing.T) {
+	for _, amount := range []Amount{0, 1, 50_000_000, AtomicUnitsPerCoin, 1_250_000_000, math.MaxUint64} {
+		parsed, err := ParseAmount(amount.String())
+		if err != nil {
+			t.Fatalf("%s: %v", amount, err)
+		}
+		if parsed != amount {
+			t.Fatalf("%s: expected %d, got %d", amount, amount, parsed)
+		}
+	}
+	if s := Amount(1_250_000_000).String(); s != "12.5" {
+		t.Fatalf("expected 12.5, got %s", s)
+	}
+}
+
+func TestAmountArithmetic(t *testing.T) {
+	if sum, err := Amount(2).Add(3); err != nil || sum != 5 {
+		t.Fatalf("expected 5, got %d (%v)", sum, err)
+	}
+	if sum, err := Amount(math.MaxUint64 - 1).Add(1); err != nil || sum != math.MaxUint64 {
+		t.Fatalf("expected the maximum amount, got %d (%v)", sum, err)
+	}
+	if _, err := Amount(math.MaxUint64).Add(1); !errors.Is(err, AmountOverflowError) {
+		t.Fatalf("expected %v, got %v", AmountOverflowError, err)
+	}
+
+	if diff, err := Amount(5).Sub(5); err != nil || diff != 0 {
+		t.Fatalf("expected 0, got %d (%v)", diff, err)
+	}
+	if _, err := Amount(2).Sub(3); !errors.Is(err, AmountUnderflowError) {
+		t.Fatalf("expected %v, got %v", AmountUnderflowError, err)
+	}
+
+	if sum, err := SumAmounts(); err != nil || sum != 0 {
+		t.Fatalf("expected 0, got %d (%v)", sum, err)
+	}
+	if sum, err := SumAmounts(1, 2, 3); err != nil || sum != 6 {
+		t.Fatalf("expected 6, got %d (%v)", sum, err)
+	}
+	if _, err := SumAmounts(1, math.MaxUint64/2, math.MaxUint64/2+1); !errors.Is(err, AmountOverflowError) {
+		t.Fatalf("expected %v, got %v", AmountOverflowError, err)
+	}
+}
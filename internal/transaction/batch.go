@@ -0,0 +1,141 @@
+package transaction
+
+import (
+	"sync"
+
+	"filippo.io/edwards25519"
+)
+
+// BatchVerifier checks the ring signatures and range proofs of many
+// transactions at once e.g. every transaction of a block
+type BatchVerifier struct {
+	workers int
+}
+
+func NewBatchVerifier(workers int) *BatchVerifier {
+	if workers < 1 {
+		workers = 1
+	}
+	return &BatchVerifier{workers: workers}
+}
+
+// VerifySignatures checks every ring signature of the transactions. The
+// challenges of a ring are chained so rings can't be merged into a single
+// multiscalar multiplication, instead the inputs are spread over the worker
+// goroutines. Returns the index of the first transaction with an invalid
+// signature or -1 if all are valid
+func (v *BatchVerifier) VerifySignatures(txns []Transaction) int {
+	type job struct {
+		tx      int
+		message []byte
+		input   TxInput
+	}
+	jobs := make(chan job)
+	failed := make([]bool, len(txns))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < v.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if !j.input.Signature.Verify(j.message, j.input.PseudoOutput) {
+					mu.Lock()
+					failed[j.tx] = true
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i, txn := range txns {
+		message := txn.SignatureMessage()
+		for _, in := range txn.Inputs {
+			jobs <- job{tx: i, message: message, input: in}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, f := range failed {
+		if f {
+			return i
+		}
+	}
+	return -1
+}
+
+// VerifyRangeProofs checks the range proofs of all transactions with a single
+// multiscalar multiplication. The terms of every proof are randomly weighted
+// so they can't cancel each other out, and the terms of the shared generators
+// are merged. If the batch fails the proofs are checked one by one to find
+// the culprit. Returns the index of the first transaction with an invalid
+// proof or -1 if all are valid
+func (v *BatchVerifier) VerifyRangeProofs(txns []Transaction) int {
+	if len(txns) == 0 {
+		return -1
+	}
+	type terms struct {
+		scalars []*edwards25519.Scalar
+		points  []*edwards25519.Point
+		err     error
+	}
+	results := make([]terms, len(txns))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < v.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				commitments, err := txns[j].outputCommitments()
+				if err != nil {
+					results[j].err = err
+					continue
+				}
+				results[j].scalars, results[j].points, results[j].err = txns[j].RangeProof.verificationTerms(commitments)
+			}
+		}()
+	}
+	for i := range txns {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Generators are shared by all proofs, sum their scalars
+	shared := make(map[*edwards25519.Point]*edwards25519.Scalar)
+	var scalars []*edwards25519.Scalar
+	var points []*edwards25519.Point
+	for i, r := range results {
+		if r.err != nil {
+			return i
+		}
+		for j, p := range r.points {
+			if s, ok := shared[p]; ok {
+				s.Add(s, r.scalars[j])
+			} else if isGenerator(p) {
+				shared[p] = edwards25519.NewScalar().Set(r.scalars[j])
+			} else {
+				scalars = append(scalars, r.scalars[j])
+				points = append(points, p)
+			}
+		}
+	}
+	for p, s := range shared {
+		scalars = append(scalars, s)
+		points = append(points, p)
+	}
+	res := new(edwards25519.Point).VarTimeMultiScalarMult(scalars, points)
+	if res.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return -1
+	}
+
+	for i, txn := range txns {
+		if !txn.CheckRangeProof() {
+			return i
+		}
+	}
+	// The batch can only fail when a proof is invalid
+	return 0
+}
@@ -0,0 +1,119 @@
+package transaction
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+const (
+	// Number of transactions in the benchmarked block
+	benchmarkBlockSize = 1000
+	// Ring size of the benchmarked transactions
+	benchmarkRingSize = 8
+)
+
+// testIndexer numbers outputs in the order they are looked up
+type testIndexer struct {
+	mu      sync.Mutex
+	indices map[string]uint64
+}
+
+func (idx *testIndexer) OutputIndexOf(utxo Utxo) (uint64, error) {
+	hash, err := utxo.Hash()
+	if err != nil {
+		return 0, err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.indices == nil {
+		idx.indices = make(map[string]uint64)
+	}
+	if i, ok := idx.indices[string(hash)]; ok {
+		return i, nil
+	}
+	i := uint64(len(idx.indices))
+	idx.indices[string(hash)] = i
+	return i, nil
+}
+
+// newTestTransactions creates n signed transactions with a single input
+// hidden among decoys and a change output
+func newTestTransactions(tb testing.TB, n int) []Transaction {
+	tb.Helper()
+	sender, err := NewAddress()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	receiver, err := NewAddress()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	indexer := &testIndexer{}
+	decoys := make([]Utxo, benchmarkRingSize-1)
+	for i := range decoys {
+		decoy, _, err := receiver.NewOutput(Amount(i + 1))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		decoys[i] = *decoy
+	}
+	txns := make([]Transaction, n)
+	for i := range txns {
+		real, _, err := sender.NewOutput(50)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		txn, err := sender.NewTransaction([]Utxo{*real}, [][]Utxo{decoys}, 30, 1, receiver, indexer)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := sender.SignTransaction(&txn, []Utxo{*real}); err != nil {
+			tb.Fatal(err)
+		}
+		txns[i] = txn
+	}
+	return txns
+}
+
+var (
+	blockTxnsOnce sync.Once
+	blockTxns     []Transaction
+)
+
+// benchmarkBlock returns the transactions of a full block, they're created
+// once since signing and proving them takes a while
+func benchmarkBlock(b *testing.B) []Transaction {
+	blockTxnsOnce.Do(func() {
+		blockTxns = newTestTransactions(b, benchmarkBlockSize)
+	})
+	return blockTxns
+}
+
+// BenchmarkVerifyBlock checks the ring signatures and range proofs of a
+// block of benchmarkBlockSize transactions
+func BenchmarkVerifyBlock(b *testing.B) {
+	txns := benchmarkBlock(b)
+	v := NewBatchVerifier(runtime.NumCPU())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if failed := v.VerifySignatures(txns); failed != -1 {
+			b.Fatalf("signature of transaction %d is invalid", failed)
+		}
+		if failed := v.VerifyRangeProofs(txns); failed != -1 {
+			b.Fatalf("range proof of transaction %d is invalid", failed)
+		}
+	}
+}
+
+// BenchmarkVerifyBlockSignatures checks only the ring signatures of the block
+func BenchmarkVerifyBlockSignatures(b *testing.B) {
+	txns := benchmarkBlock(b)
+	v := NewBatchVerifier(runtime.NumCPU())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if failed := v.VerifySignatures(txns); failed != -1 {
+			b.Fatalf("signature of transaction %d is invalid", failed)
+		}
+	}
+}
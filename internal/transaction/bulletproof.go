@@ -0,0 +1,459 @@
+package transaction
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sync"
+
+	"filippo.io/edwards25519"
+)
+
+// Range proofs follow the aggregated Bulletproofs protocol (Bünz et al. 2018)
+// with the Pedersen generators swapped to match our commitments C = xG + aH:
+// H is the value generator and G blinds. Every output amount is proven to
+// lie in [0, 2^64) so the commitments can't wrap around the group order
+
+const (
+	// Number of bits proven for every amount
+	rangeProofBits = 64
+	// Maximum number of outputs covered by a single aggregated proof
+	MaxRangeProofOutputs = 16
+)
+
+var (
+	TooManyOutputsError    = errors.New("Too many outputs for a single range proof")
+	InvalidRangeProofError = errors.New("Range proof is malformed")
+)
+
+// RangeProof proves the amounts of a set of commitments are in range.
+// The proof size grows logarithmically with the number of outputs
+type RangeProof struct {
+	// Commitments to the bits of the amounts and the blinding vectors
+	A, S []byte
+	// Commitments to the coefficients of t(X)
+	T1, T2 []byte
+	// Blinding of t(x), blinding of A and S, and the value t(x)
+	TauX, Mu, T []byte
+	// Inner product argument rounds
+	L, R [][]byte
+	// Final scalars of the inner product argument
+	APrime, BPrime []byte
+}
+
+type bulletproofGenerators struct {
+	G, H []*edwards25519.Point
+	// Base point G used by the proofs
+	base *edwards25519.Point
+	// Every generator shared by the proofs, used to merge their terms
+	shared map[*edwards25519.Point]struct{}
+}
+
+var (
+	generatorsOnce sync.Once
+	generators     bulletproofGenerators
+)
+
+// getGenerators returns the vector generators G_i, H_i. They're derived
+// once, the same way as H, so nobody knows their discrete logarithms
+func getGenerators() bulletproofGenerators {
+	generatorsOnce.Do(func() {
+		size := rangeProofBits * MaxRangeProofOutputs
+		generators.G = make([]*edwards25519.Point, size)
+		generators.H = make([]*edwards25519.Point, size)
+		index := make([]byte, 4)
+		for i := 0; i < size; i++ {
+			binary.BigEndian.PutUint32(index, uint32(i))
+			generators.G[i] = hashToPointTryAndIncrement([]byte("learncoin_bulletproof_G"), index)
+			generators.H[i] = hashToPointTryAndIncrement([]byte("learncoin_bulletproof_H"), index)
+		}
+		generators.base = edwards25519.NewGeneratorPoint()
+		generators.shared = map[*edwards25519.Point]struct{}{generators.base: {}, H: {}}
+		for i := 0; i < size; i++ {
+			generators.shared[generators.G[i]] = struct{}{}
+			generators.shared[generators.H[i]] = struct{}{}
+		}
+	})
+	return generators
+}
+
+// transcript derives the Fiat-Shamir challenges of a proof from
+// everything the prover committed to so far
+type transcript struct {
+	state []byte
+}
+
+func newTranscript(domain string) *transcript {
+	return &transcript{state: []byte(domain)}
+}
+
+func (t *transcript) append(data ...[]byte) {
+	h := sha512.New()
+	h.Write(t.state)
+	for _, d := range data {
+		h.Write(d)
+	}
+	t.state = h.Sum(nil)
+}
+
+func (t *transcript) challenge() *edwards25519.Scalar {
+	t.append([]byte("challenge"))
+	s, _ := edwards25519.NewScalar().SetUniformBytes(t.state)
+	return s
+}
+
+func scalarFromUint64(v uint64) *edwards25519.Scalar {
+	return amountToScalar(Amount(v))
+}
+
+// powers returns [1, x, x^2, .., x^(n-1)]
+func powers(x *edwards25519.Scalar, n int) []*edwards25519.Scalar {
+	res := make([]*edwards25519.Scalar, n)
+	acc := scalarFromUint64(1)
+	for i := range res {
+		res[i] = edwards25519.NewScalar().Set(acc)
+		acc.Multiply(acc, x)
+	}
+	return res
+}
+
+func innerProduct(a, b []*edwards25519.Scalar) *edwards25519.Scalar {
+	res := edwards25519.NewScalar()
+	for i := range a {
+		res.MultiplyAdd(a[i], b[i], res)
+	}
+	return res
+}
+
+// paddedOutputs rounds the number of outputs up to a power of two
+func paddedOutputs(n int) int {
+	m := 1
+	for m < n {
+		m <<= 1
+	}
+	return m
+}
+
+// NewRangeProof creates an aggregated proof that every amount is in range.
+// masks[i] is the mask of the commitment to amounts[i]
+func NewRangeProof(amounts []Amount, masks []*edwards25519.Scalar) (RangeProof, error) {
+	if len(amounts) == 0 || len(amounts) != len(masks) {
+		return RangeProof{}, InvalidRangeProofError
+	}
+	m := paddedOutputs(len(amounts))
+	if m > MaxRangeProofOutputs {
+		return RangeProof{}, TooManyOutputsError
+	}
+	n := rangeProofBits
+	nm := n * m
+	gens := getGenerators()
+	Gi, Hi := gens.G[:nm], gens.H[:nm]
+	base := edwards25519.NewGeneratorPoint()
+
+	ts := newTranscript("learncoin_range_proof")
+	for i := range amounts {
+		ts.append(Commit(amounts[i], masks[i]).Bytes())
+	}
+
+	// aL holds the bits of the amounts (padded with zero amounts), aR = aL - 1
+	one := scalarFromUint64(1)
+	aL := make([]*edwards25519.Scalar, nm)
+	aR := make([]*edwards25519.Scalar, nm)
+	for i := 0; i < nm; i++ {
+		var bit uint64
+		if j := i / n; j < len(amounts) {
+			bit = (uint64(amounts[j]) >> (i % n)) & 1
+		}
+		aL[i] = scalarFromUint64(bit)
+		aR[i] = edwards25519.NewScalar().Subtract(aL[i], one)
+	}
+
+	alpha, _ := randomScalar()
+	rho, _ := randomScalar()
+	sL := make([]*edwards25519.Scalar, nm)
+	sR := make([]*edwards25519.Scalar, nm)
+	for i := 0; i < nm; i++ {
+		sL[i], _ = randomScalar()
+		sR[i], _ = randomScalar()
+	}
+	// MultiScalarMult adds to the receiver so it has to start at the identity
+	vecPoints := append(append([]*edwards25519.Point{base}, Gi...), Hi...)
+	A := edwards25519.NewIdentityPoint().MultiScalarMult(append(append([]*edwards25519.Scalar{alpha}, aL...), aR...), vecPoints)
+	S := edwards25519.NewIdentityPoint().MultiScalarMult(append(append([]*edwards25519.Scalar{rho}, sL...), sR...), vecPoints)
+	ts.append(A.Bytes(), S.Bytes())
+	y := ts.challenge()
+	z := ts.challenge()
+
+	// l(X) = l0 + l1*X and r(X) = r0 + r1*X
+	yPow := powers(y, nm)
+	zPow := powers(z, m+2)
+	twoPow := powers(scalarFromUint64(2), n)
+	l0 := make([]*edwards25519.Scalar, nm)
+	r0 := make([]*edwards25519.Scalar, nm)
+	r1 := make([]*edwards25519.Scalar, nm)
+	for i := 0; i < nm; i++ {
+		l0[i] = edwards25519.NewScalar().Subtract(aL[i], z)
+		r0[i] = edwards25519.NewScalar().Add(aR[i], z)
+		r0[i].Multiply(r0[i], yPow[i])
+		r0[i].MultiplyAdd(zPow[2+i/n], twoPow[i%n], r0[i])
+		r1[i] = edwards25519.NewScalar().Multiply(yPow[i], sR[i])
+	}
+	t1 := edwards25519.NewScalar().Add(innerProduct(l0, r1), innerProduct(sL, r0))
+	t2 := innerProduct(sL, r1)
+
+	tau1, _ := randomScalar()
+	tau2, _ := randomScalar()
+	T1 := new(edwards25519.Point).VarTimeDoubleScalarBaseMult(t1, H, tau1)
+	T2 := new(edwards25519.Point).VarTimeDoubleScalarBaseMult(t2, H, tau2)
+	ts.append(T1.Bytes(), T2.Bytes())
+	x := ts.challenge()
+
+	// tauX = tau2*x^2 + tau1*x + sum(z^(2+j) * mask_j)
+	tauX := edwards25519.NewScalar().Multiply(tau2, x)
+	tauX.MultiplyAdd(tauX, x, edwards25519.NewScalar().Multiply(tau1, x))
+	for j := range masks {
+		tauX.MultiplyAdd(zPow[2+j], masks[j], tauX)
+	}
+	mu := edwards25519.NewScalar().MultiplyAdd(rho, x, alpha)
+	l := make([]*edwards25519.Scalar, nm)
+	r := make([]*edwards25519.Scalar, nm)
+	for i := 0; i < nm; i++ {
+		l[i] = edwards25519.NewScalar().MultiplyAdd(sL[i], x, l0[i])
+		r[i] = edwards25519.NewScalar().MultiplyAdd(r1[i], x, r0[i])
+	}
+	t := innerProduct(l, r)
+	ts.append(tauX.Bytes(), mu.Bytes(), t.Bytes())
+	w := ts.challenge()
+
+	// The inner product argument runs over G and H' where H'_i = y^-i * H_i
+	yInv := edwards25519.NewScalar().Invert(y)
+	yInvPow := powers(yInv, nm)
+	Gs := make([]*edwards25519.Point, nm)
+	Hs := make([]*edwards25519.Point, nm)
+	for i := 0; i < nm; i++ {
+		Gs[i] = new(edwards25519.Point).Set(Gi[i])
+		Hs[i] = new(edwards25519.Point).ScalarMult(yInvPow[i], Hi[i])
+	}
+
+	proof := RangeProof{
+		A:    A.Bytes(),
+		S:    S.Bytes(),
+		T1:   T1.Bytes(),
+		T2:   T2.Bytes(),
+		TauX: tauX.Bytes(),
+		Mu:   mu.Bytes(),
+		T:    t.Bytes(),
+	}
+	for len(l) > 1 {
+		k := len(l) / 2
+		cL := innerProduct(l[:k], r[k:])
+		cR := innerProduct(l[k:], r[:k])
+		cL.Multiply(cL, w)
+		cR.Multiply(cR, w)
+		L := edwards25519.NewIdentityPoint().MultiScalarMult(
+			append(append(append([]*edwards25519.Scalar{}, l[:k]...), r[k:]...), cL),
+			append(append(append([]*edwards25519.Point{}, Gs[k:]...), Hs[:k]...), H),
+		)
+		R := edwards25519.NewIdentityPoint().MultiScalarMult(
+			append(append(append([]*edwards25519.Scalar{}, l[k:]...), r[:k]...), cR),
+			append(append(append([]*edwards25519.Point{}, Gs[:k]...), Hs[k:]...), H),
+		)
+		proof.L = append(proof.L, L.Bytes())
+		proof.R = append(proof.R, R.Bytes())
+		ts.append(L.Bytes(), R.Bytes())
+		u := ts.challenge()
+		uInv := edwards25519.NewScalar().Invert(u)
+
+		for i := 0; i < k; i++ {
+			Gs[i] = new(edwards25519.Point).VarTimeMultiScalarMult([]*edwards25519.Scalar{uInv, u}, []*edwards25519.Point{Gs[i], Gs[k+i]})
+			Hs[i] = new(edwards25519.Point).VarTimeMultiScalarMult([]*edwards25519.Scalar{u, uInv}, []*edwards25519.Point{Hs[i], Hs[k+i]})
+			l[i] = edwards25519.NewScalar().Multiply(l[i], u)
+			l[i].MultiplyAdd(l[k+i], uInv, l[i])
+			r[i] = edwards25519.NewScalar().Multiply(r[i], uInv)
+			r[i].MultiplyAdd(r[k+i], u, r[i])
+		}
+		Gs, Hs, l, r = Gs[:k], Hs[:k], l[:k], r[:k]
+	}
+	proof.APrime = l[0].Bytes()
+	proof.BPrime = r[0].Bytes()
+	return proof, nil
+}
+
+// isGenerator checks if the point is one of the generators shared by all proofs
+func isGenerator(p *edwards25519.Point) bool {
+	_, ok := getGenerators().shared[p]
+	return ok
+}
+
+// Verify checks the proof covers exactly the given commitments
+func (p RangeProof) Verify(commitments []*edwards25519.Point) bool {
+	scalars, points, err := p.verificationTerms(commitments)
+	if err != nil {
+		return false
+	}
+	res := new(edwards25519.Point).VarTimeMultiScalarMult(scalars, points)
+	return res.Equal(edwards25519.NewIdentityPoint()) == 1
+}
+
+// verificationTerms returns the terms of a multiscalar multiplication which
+// sums to the identity iff the proof is valid. Both verification equations
+// are combined with random weights so they're checked in a single pass
+func (p RangeProof) verificationTerms(commitments []*edwards25519.Point) ([]*edwards25519.Scalar, []*edwards25519.Point, error) {
+	if len(commitments) == 0 {
+		return nil, nil, InvalidRangeProofError
+	}
+	m := paddedOutputs(len(commitments))
+	if m > MaxRangeProofOutputs {
+		return nil, nil, TooManyOutputsError
+	}
+	n := rangeProofBits
+	nm := n * m
+	rounds := bits.Len(uint(nm)) - 1
+	if len(p.L) != rounds || len(p.R) != rounds {
+		return nil, nil, InvalidRangeProofError
+	}
+
+	parsePoint := func(b []byte) (*edwards25519.Point, error) {
+		return edwards25519.NewIdentityPoint().SetBytes(b)
+	}
+	parseScalar := func(b []byte) (*edwards25519.Scalar, error) {
+		return edwards25519.NewScalar().SetCanonicalBytes(b)
+	}
+	var err error
+	var A, S, T1, T2 *edwards25519.Point
+	var tauX, mu, t, a, b *edwards25519.Scalar
+	for _, pt := range []struct {
+		dst **edwards25519.Point
+		src []byte
+	}{{&A, p.A}, {&S, p.S}, {&T1, p.T1}, {&T2, p.T2}} {
+		if *pt.dst, err = parsePoint(pt.src); err != nil {
+			return nil, nil, InvalidRangeProofError
+		}
+	}
+	for _, sc := range []struct {
+		dst **edwards25519.Scalar
+		src []byte
+	}{{&tauX, p.TauX}, {&mu, p.Mu}, {&t, p.T}, {&a, p.APrime}, {&b, p.BPrime}} {
+		if *sc.dst, err = parseScalar(sc.src); err != nil {
+			return nil, nil, InvalidRangeProofError
+		}
+	}
+	L := make([]*edwards25519.Point, rounds)
+	R := make([]*edwards25519.Point, rounds)
+	for k := 0; k < rounds; k++ {
+		if L[k], err = parsePoint(p.L[k]); err != nil {
+			return nil, nil, InvalidRangeProofError
+		}
+		if R[k], err = parsePoint(p.R[k]); err != nil {
+			return nil, nil, InvalidRangeProofError
+		}
+	}
+
+	// Replay the transcript to recover the challenges
+	ts := newTranscript("learncoin_range_proof")
+	for _, V := range commitments {
+		ts.append(V.Bytes())
+	}
+	ts.append(p.A, p.S)
+	y := ts.challenge()
+	z := ts.challenge()
+	ts.append(p.T1, p.T2)
+	x := ts.challenge()
+	ts.append(p.TauX, p.Mu, p.T)
+	w := ts.challenge()
+	u := make([]*edwards25519.Scalar, rounds)
+	uInv := make([]*edwards25519.Scalar, rounds)
+	for k := 0; k < rounds; k++ {
+		ts.append(p.L[k], p.R[k])
+		u[k] = ts.challenge()
+		uInv[k] = edwards25519.NewScalar().Invert(u[k])
+	}
+
+	yPow := powers(y, nm)
+	yInvPow := powers(edwards25519.NewScalar().Invert(y), nm)
+	zPow := powers(z, m+3)
+	twoPow := powers(scalarFromUint64(2), n)
+	c, _ := randomScalar()
+	d, _ := randomScalar()
+
+	// delta(y, z) = (z - z^2) * sum(y^i) - sum(z^(3+j)) * sum(2^i)
+	sumY := edwards25519.NewScalar()
+	for _, yi := range yPow {
+		sumY.Add(sumY, yi)
+	}
+	sumTwo := edwards25519.NewScalar()
+	for _, ti := range twoPow {
+		sumTwo.Add(sumTwo, ti)
+	}
+	delta := edwards25519.NewScalar().Subtract(z, zPow[2])
+	delta.Multiply(delta, sumY)
+	for j := 0; j < m; j++ {
+		delta.Subtract(delta, edwards25519.NewScalar().Multiply(zPow[3+j], sumTwo))
+	}
+
+	var scalars []*edwards25519.Scalar
+	var points []*edwards25519.Point
+	add := func(s *edwards25519.Scalar, p *edwards25519.Point) {
+		scalars = append(scalars, s)
+		points = append(points, p)
+	}
+	mul := func(s ...*edwards25519.Scalar) *edwards25519.Scalar {
+		res := scalarFromUint64(1)
+		for _, v := range s {
+			res.Multiply(res, v)
+		}
+		return res
+	}
+	neg := func(s *edwards25519.Scalar) *edwards25519.Scalar {
+		return edwards25519.NewScalar().Negate(s)
+	}
+
+	// First equation, weighted by c:
+	// t*H + tauX*G = sum(z^(2+j) * V_j) + delta*H + x*T1 + x^2*T2
+	// Second equation, weighted by d, is the inner product argument over
+	// P = A + x*S - z*sum(G_i) + sum((z*y^i + z^(2+j)*2^i) * H'_i) - mu*G
+	tMinusDelta := edwards25519.NewScalar().Subtract(t, delta)
+	ab := edwards25519.NewScalar().Multiply(a, b)
+	tMinusAB := edwards25519.NewScalar().Subtract(t, ab)
+	hScalar := mul(c, tMinusDelta)
+	hScalar.Add(hScalar, mul(d, w, tMinusAB))
+	add(hScalar, H)
+	gens := getGenerators()
+	add(edwards25519.NewScalar().Subtract(mul(c, tauX), mul(d, mu)), gens.base)
+	for j, V := range commitments {
+		add(neg(mul(c, zPow[2+j])), V)
+	}
+	add(neg(mul(c, x)), T1)
+	add(neg(mul(c, x, x)), T2)
+	add(d, A)
+	add(mul(d, x), S)
+	for k := 0; k < rounds; k++ {
+		add(mul(d, u[k], u[k]), L[k])
+		add(mul(d, uInv[k], uInv[k]), R[k])
+	}
+
+	// s_i is the product of the challenges folded into G_i, H'_i gets 1/s_i
+	for i := 0; i < nm; i++ {
+		s := scalarFromUint64(1)
+		sInv := scalarFromUint64(1)
+		for k := 0; k < rounds; k++ {
+			if (i>>(rounds-1-k))&1 == 1 {
+				s.Multiply(s, u[k])
+				sInv.Multiply(sInv, uInv[k])
+			} else {
+				s.Multiply(s, uInv[k])
+				sInv.Multiply(sInv, u[k])
+			}
+		}
+		gScalar := edwards25519.NewScalar().MultiplyAdd(a, s, z)
+		add(neg(mul(d, gScalar)), gens.G[i])
+
+		// z + (z^(2+j)*2^i - b/s_i) * y^-i
+		hi := edwards25519.NewScalar().Multiply(zPow[2+i/n], twoPow[i%n])
+		hi.Subtract(hi, mul(b, sInv))
+		hi.MultiplyAdd(hi, yInvPow[i], z)
+		add(mul(d, hi), gens.H[i])
+	}
+	return scalars, points, nil
+}
@@ -0,0 +1,53 @@
+package transaction
+
+import (
+	"runtime"
+	"testing"
+
+	"filippo.io/edwards25519"
+)
+
+// BenchmarkNewRangeProof proves the amounts of a payment and its change
+func BenchmarkNewRangeProof(b *testing.B) {
+	amounts := []Amount{30, 19}
+	masks := make([]*edwards25519.Scalar, len(amounts))
+	for i := range masks {
+		mask, err := randomScalar()
+		if err != nil {
+			b.Fatal(err)
+		}
+		masks[i] = mask
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewRangeProof(amounts, masks); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCheckRangeProofs checks the range proofs of a block one by one
+func BenchmarkCheckRangeProofs(b *testing.B) {
+	txns := benchmarkBlock(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, txn := range txns {
+			if !txn.CheckRangeProof() {
+				b.Fatalf("range proof of transaction %d is invalid", j)
+			}
+		}
+	}
+}
+
+// BenchmarkBatchVerifyRangeProofs checks the range proofs of a block with a
+// single multiscalar multiplication
+func BenchmarkBatchVerifyRangeProofs(b *testing.B) {
+	txns := benchmarkBlock(b)
+	v := NewBatchVerifier(runtime.NumCPU())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if failed := v.VerifyRangeProofs(txns); failed != -1 {
+			b.Fatalf("range proof of transaction %d is invalid", failed)
+		}
+	}
+}
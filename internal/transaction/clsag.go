@@ -0,0 +1,207 @@
+package transaction
+
+import (
+	"crypto/sha512"
+	"errors"
+
+	"filippo.io/edwards25519"
+)
+
+// CLSAG (Goodell et al. 2019) signs with the one time key of the real input and
+// at the same time proves the commitment of the real input minus the pseudo output
+// is a commitment to zero, so the pseudo output hides the amount of the input.
+// It only needs a single challenge c_0 and a response for every ring member
+
+var InvalidPseudoOutputError = errors.New("Pseudo output doesn't commit to the amount of the real input")
+
+var basePoint = edwards25519.NewGeneratorPoint()
+
+// -1 = l-1 mod l, used to multiply points by the group order
+var scalarMinusOne = func() *edwards25519.Scalar {
+	one, _ := edwards25519.NewScalar().SetCanonicalBytes(append([]byte{1}, make([]byte, 31)...))
+	return one.Negate(one)
+}()
+
+// InPrimeOrderSubgroup reports if the point has no small order component.
+// l*P = (l-1)*P + P is the identity iff it has none
+func InPrimeOrderSubgroup(p *edwards25519.Point) bool {
+	lP := new(edwards25519.Point).VarTimeDoubleScalarBaseMult(scalarMinusOne, p, edwards25519.NewScalar())
+	return lP.Add(lP, p).Equal(edwards25519.NewIdentityPoint()) == 1
+}
+
+// hashToScalar computes a domain separated Hs(data)
+func hashToScalar(domain string, data ...[]byte) *edwards25519.Scalar {
+	h := sha512.New()
+	h.Write([]byte(domain))
+	for _, d := range data {
+		h.Write(d)
+	}
+	s, _ := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	return s
+}
+
+// clsagRing holds the parsed ring together with the data hashed into every challenge
+type clsagRing struct {
+	P, C      []*edwards25519.Point
+	pseudo    *edwards25519.Point
+	prefix    [][]byte
+	hashPoint func(*edwards25519.Point) *edwards25519.Point
+}
+
+func newCLSAGRing(utxos []Utxo, pseudoOutput []byte, hashPoint func(*edwards25519.Point) *edwards25519.Point) (*clsagRing, error) {
+	pseudo, err := edwards25519.NewIdentityPoint().SetBytes(pseudoOutput)
+	if err != nil {
+		return nil, InvalidCommitmentError
+	}
+	ring := &clsagRing{pseudo: pseudo, hashPoint: hashPoint}
+	for _, utxo := range utxos {
+		C, err := utxo.CommitmentPoint()
+		if err != nil {
+			return nil, err
+		}
+		ring.P = append(ring.P, utxo.Keypair.P)
+		ring.C = append(ring.C, C)
+		ring.prefix = append(ring.prefix, utxo.Keypair.P.Bytes())
+	}
+	for _, C := range ring.C {
+		ring.prefix = append(ring.prefix, C.Bytes())
+	}
+	ring.prefix = append(ring.prefix, pseudoOutput)
+	return ring, nil
+}
+
+// aggregate returns the coefficients mu_P, mu_C combining the two keys
+func (ring *clsagRing) aggregate(I, D *edwards25519.Point) (muP, muC *edwards25519.Scalar) {
+	data := append(append([][]byte{}, ring.prefix...), I.Bytes(), D.Bytes())
+	return hashToScalar("CLSAG_agg_0", data...), hashToScalar("CLSAG_agg_1", data...)
+}
+
+// challenge computes c_i+1 = Hs(ring, message, L_i, R_i)
+func (ring *clsagRing) challenge(message []byte, L, R *edwards25519.Point) *edwards25519.Scalar {
+	data := append(append([][]byte{}, ring.prefix...), message, L.Bytes(), R.Bytes())
+	return hashToScalar("CLSAG_round", data...)
+}
+
+// NewCLSAG returns a CLSAG signature for the real utxo hidden in the ring, which
+// keeps the order of the ring offsets of the input. pseudoOutput is the pseudo
+// output of the input and pseudoMask its mask
+func (a Address) NewCLSAG(realTxn Utxo, txns []Utxo, pseudoOutput []byte, pseudoMask *edwards25519.Scalar, message []byte) (RingSignature, error) {
+	_, inMask, err := a.OpenUtxo(realTxn)
+	if err != nil {
+		return RingSignature{}, err
+	}
+	x, I := KeyImage(a, realTxn.Keypair)
+	// C_l - C' = zG is a commitment to zero iff the amounts match
+	z := edwards25519.NewScalar().Subtract(inMask, pseudoMask)
+
+	truePos, err := ringPosition(txns, realTxn)
+	if err != nil {
+		return RingSignature{}, err
+	}
+	n := len(txns)
+	ring, err := newCLSAGRing(txns, pseudoOutput, HashToPoint)
+	if err != nil {
+		return RingSignature{}, err
+	}
+	if new(edwards25519.Point).Subtract(ring.C[truePos], ring.pseudo).Equal(new(edwards25519.Point).ScalarBaseMult(z)) != 1 {
+		return RingSignature{}, InvalidPseudoOutputError
+	}
+
+	Hp := HashToPoint(realTxn.Keypair.P)
+	D := new(edwards25519.Point).ScalarMult(z, Hp)
+	muP, muC := ring.aggregate(I, D)
+	// Aggregated key image and secret w = mu_P*x + mu_C*z
+	W := new(edwards25519.Point).VarTimeMultiScalarMult([]*edwards25519.Scalar{muP, muC}, []*edwards25519.Point{I, D})
+	w := edwards25519.NewScalar().Multiply(muP, x)
+	w.MultiplyAdd(muC, z, w)
+
+	alpha, err := randomScalar()
+	if err != nil {
+		return RingSignature{}, err
+	}
+	c := make([]*edwards25519.Scalar, n)
+	s := make([]*edwards25519.Scalar, n)
+	c[(truePos+1)%n] = ring.challenge(message,
+		new(edwards25519.Point).ScalarBaseMult(alpha),
+		new(edwards25519.Point).ScalarMult(alpha, Hp),
+	)
+	// Walk around the ring from the member after ours back to ours
+	for j := 1; j < n; j++ {
+		i := (truePos + j) % n
+		if s[i], err = randomScalar(); err != nil {
+			return RingSignature{}, err
+		}
+		L, R := ring.round(i, c[i], s[i], muP, muC, W)
+		c[(i+1)%n] = ring.challenge(message, L, R)
+	}
+	s[truePos] = edwards25519.NewScalar().Subtract(alpha, edwards25519.NewScalar().Multiply(c[truePos], w))
+
+	sig := RingSignature{
+		Version: CLSAGV2SignatureVersion,
+		Utxos:   txns,
+		Image:   I.Bytes(),
+		C:       [][]byte{c[0].Bytes()},
+		R:       make([][]byte, n),
+		D:       D.Bytes(),
+	}
+	for i, val := range s {
+		sig.R[i] = val.Bytes()
+	}
+	return sig, nil
+}
+
+// round computes L_i = s_i*G + c_i*W_i and R_i = s_i*Hp(P_i) + c_i*W where
+// W_i = mu_P*P_i + mu_C*(C_i - C') is the aggregated public key of the member
+func (ring *clsagRing) round(i int, c, s, muP, muC *edwards25519.Scalar, W *edwards25519.Point) (L, R *edwards25519.Point) {
+	commitment := new(edwards25519.Point).Subtract(ring.C[i], ring.pseudo)
+	L = new(edwards25519.Point).VarTimeMultiScalarMult(
+		[]*edwards25519.Scalar{s, edwards25519.NewScalar().Multiply(c, muP), edwards25519.NewScalar().Multiply(c, muC)},
+		[]*edwards25519.Point{basePoint, ring.P[i], commitment},
+	)
+	R = new(edwards25519.Point).VarTimeMultiScalarMult([]*edwards25519.Scalar{s, c}, []*edwards25519.Point{ring.hashPoint(ring.P[i]), W})
+	return L, R
+}
+
+// checkCLSAG verifies a CLSAG signature of the message for the given pseudo output
+func (ringSig RingSignature) checkCLSAG(message, pseudoOutput []byte) bool {
+	n := len(ringSig.Utxos)
+	if n == 0 || len(ringSig.C) != 1 || len(ringSig.R) != n {
+		return false
+	}
+	c0, err := edwards25519.NewScalar().SetCanonicalBytes(ringSig.C[0])
+	if err != nil {
+		return false
+	}
+	s := make([]*edwards25519.Scalar, n)
+	for i, val := range ringSig.R {
+		if s[i], err = edwards25519.NewScalar().SetCanonicalBytes(val); err != nil {
+			return false
+		}
+	}
+	I, err := ringSig.ImageToPoint()
+	if err != nil {
+		return false
+	}
+	D, err := edwards25519.NewIdentityPoint().SetBytes(ringSig.D)
+	if err != nil {
+		return false
+	}
+	// The key image gets checked by the chain. A small order component of D
+	// would be multiplied by mu_C into W, where the signer could cancel it
+	if !InPrimeOrderSubgroup(D) {
+		return false
+	}
+	ring, err := newCLSAGRing(ringSig.Utxos, pseudoOutput, ringSig.keyImageBase())
+	if err != nil {
+		return false
+	}
+
+	muP, muC := ring.aggregate(I, D)
+	W := new(edwards25519.Point).VarTimeMultiScalarMult([]*edwards25519.Scalar{muP, muC}, []*edwards25519.Point{I, D})
+	c := c0
+	for i := 0; i < n; i++ {
+		L, R := ring.round(i, c, s[i], muP, muC, W)
+		c = ring.challenge(message, L, R)
+	}
+	return c.Equal(c0) == 1
+}
@@ -0,0 +1,126 @@
+package transaction
+
+import (
+	"testing"
+
+	"filippo.io/edwards25519"
+)
+
+// signatureBenchmark holds a CLSAG and an LSAG signature over the same ring
+type signatureBenchmark struct {
+	message      []byte
+	pseudoOutput []byte
+	clsag, lsag  RingSignature
+}
+
+func newSignatureBenchmark(b testing.TB) signatureBenchmark {
+	sender, err := NewAddress()
+	if err != nil {
+		b.Fatal(err)
+	}
+	receiver, err := NewAddress()
+	if err != nil {
+		b.Fatal(err)
+	}
+	real, _, err := sender.NewOutput(50)
+	if err != nil {
+		b.Fatal(err)
+	}
+	decoys := make([]Utxo, benchmarkRingSize-1)
+	for i := range decoys {
+		decoy, _, err := receiver.NewOutput(Amount(i + 1))
+		if err != nil {
+			b.Fatal(err)
+		}
+		decoys[i] = *decoy
+	}
+	txn, err := sender.NewTransaction([]Utxo{*real}, [][]Utxo{decoys}, 30, 1, receiver, &testIndexer{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := sender.SignTransaction(&txn, []Utxo{*real}); err != nil {
+		b.Fatal(err)
+	}
+	message := txn.SignatureMessage()
+	return signatureBenchmark{
+		message:      message,
+		pseudoOutput: txn.Inputs[0].PseudoOutput,
+		clsag:        txn.Inputs[0].Signature,
+		lsag:         sender.NewRingSignature(*real, decoys, message),
+	}
+}
+
+// reportSize reports the size of the encoded signature
+func reportSize(b *testing.B, sig RingSignature) {
+	data, err := sig.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(len(data)), "sig-bytes")
+}
+
+func BenchmarkVerifyCLSAG(b *testing.B) {
+	bench := newSignatureBenchmark(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !bench.clsag.Verify(bench.message, bench.pseudoOutput) {
+			b.Fatal("CLSAG signature is invalid")
+		}
+	}
+	reportSize(b, bench.clsag)
+}
+
+func BenchmarkVerifyLSAG(b *testing.B) {
+	bench := newSignatureBenchmark(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := bench.lsag.CheckSignatureValidity(bench.message); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportSize(b, bench.lsag)
+}
+
+// The point (0, -1) of order 2
+var orderTwoPoint = func() *edwards25519.Point {
+	data := append([]byte{0xec}, make([]byte, 31)...)
+	for i := 1; i < 31; i++ {
+		data[i] = 0xff
+	}
+	data[31] = 0x7f
+	p, err := edwards25519.NewIdentityPoint().SetBytes(data)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}()
+
+func TestInPrimeOrderSubgroup(t *testing.T) {
+	if !InPrimeOrderSubgroup(edwards25519.NewGeneratorPoint()) {
+		t.Fatal("generator isn't in the prime order subgroup")
+	}
+	if InPrimeOrderSubgroup(orderTwoPoint) {
+		t.Fatal("point of order 2 is in the prime order subgroup")
+	}
+	mixed := new(edwards25519.Point).Add(edwards25519.NewGeneratorPoint(), orderTwoPoint)
+	if InPrimeOrderSubgroup(mixed) {
+		t.Fatal("point with a small order component is in the prime order subgroup")
+	}
+}
+
+// Signatures whose D has a small order component are rejected
+func TestCLSAGRejectsSmallOrderD(t *testing.T) {
+	bench := newSignatureBenchmark(t)
+	if !bench.clsag.Verify(bench.message, bench.pseudoOutput) {
+		t.Fatal("CLSAG signature is invalid")
+	}
+	D, err := edwards25519.NewIdentityPoint().SetBytes(bench.clsag.D)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := bench.clsag
+	sig.D = new(edwards25519.Point).Add(D, orderTwoPoint).Bytes()
+	if sig.Verify(bench.message, bench.pseudoOutput) {
+		t.Fatal("CLSAG signature with a small order D is valid")
+	}
+}
@@ -0,0 +1,132 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"filippo.io/edwards25519"
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+var (
+	// H is the second generator used in Pedersen commitments. Nobody knows
+	// its discrete logarithm with respect to G, otherwise commitments
+	// could be opened to arbitrary amounts
+	H = hashToPointTryAndIncrement([]byte("learncoin_pedersen_H"), edwards25519.NewGeneratorPoint().Bytes())
+
+	NotOwnUtxoError         = errors.New("Utxo wasn't sent to this address")
+	InvalidCommitmentError  = errors.New("Commitment isn't a valid point")
+	CommitmentMismatchError = errors.New("Decrypted amount doesn't match the commitment")
+)
+
+// hashToPointTryAndIncrement hashes the data with an incrementing counter until
+// the digest decodes to a curve point. The point is multiplied by the cofactor
+// so it lands in the prime order subgroup
+func hashToPointTryAndIncrement(domain, data []byte) *edwards25519.Point {
+	for counter := uint32(0); ; counter++ {
+		var buf bytes.Buffer
+		buf.Write(domain)
+		buf.Write(data)
+		binary.Write(&buf, binary.BigEndian, counter)
+		digest, _ := crypto.HashData(buf.Bytes())
+		p, err := edwards25519.NewIdentityPoint().SetBytes(digest)
+		if err != nil {
+			continue
+		}
+		p.MultByCofactor(p)
+		if p.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+		return p
+	}
+}
+
+// amountToScalar converts the amount to a scalar (little-endian encoding)
+func amountToScalar(amount Amount) *edwards25519.Scalar {
+	buf := make([]byte, 32)
+	binary.LittleEndian.PutUint64(buf, uint64(amount))
+	s, _ := edwards25519.NewScalar().SetCanonicalBytes(buf)
+	return s
+}
+
+// Commit computes the Pedersen commitment C = xG + aH hiding amount a with mask x
+func Commit(amount Amount, mask *edwards25519.Scalar) *edwards25519.Point {
+	return new(edwards25519.Point).VarTimeDoubleScalarBaseMult(amountToScalar(amount), H, mask)
+}
+
+// commitmentMask derives the mask of an output commitment from the
+// shared secret Hs(rA) = Hs(aR) of the one time address
+func commitmentMask(sharedSecret *edwards25519.Scalar) *edwards25519.Scalar {
+	digest, _ := crypto.HashData(append([]byte("commitment_mask"), sharedSecret.Bytes()...))
+	mask, _ := edwards25519.NewScalar().SetBytesWithClamping(digest)
+	return mask
+}
+
+// amountKey derives the key used to encrypt the amount of an output from
+// the shared secret of the one time address
+func amountKey(sharedSecret *edwards25519.Scalar) []byte {
+	digest, _ := crypto.HashData(append([]byte("amount"), sharedSecret.Bytes()...))
+	return digest[:8]
+}
+
+// xorAmount encrypts/decrypts the 8 byte little-endian amount with the key
+func xorAmount(data, key []byte) []byte {
+	res := make([]byte, 8)
+	for i := range res {
+		res[i] = data[i] ^ key[i]
+	}
+	return res
+}
+
+// NewOutput creates a utxo sending amount to the address. The amount is hidden
+// in a Pedersen commitment and encrypted so only the recipient can read it.
+// Returns the utxo together with the mask of its commitment
+func (addr Address) NewOutput(amount Amount) (*Utxo, *edwards25519.Scalar, error) {
+	dest, sharedSecret, err := addr.newDestination()
+	if err != nil {
+		return nil, nil, err
+	}
+	mask := commitmentMask(sharedSecret)
+
+	plain := make([]byte, 8)
+	binary.LittleEndian.PutUint64(plain, uint64(amount))
+
+	utxo := Utxo{
+		Keypair:         dest,
+		Commitment:      Commit(amount, mask).Bytes(),
+		EncryptedAmount: xorAmount(plain, amountKey(sharedSecret)),
+	}
+	if utxo.hash, err = utxo.Hash(); err != nil {
+		return nil, nil, err
+	}
+	return &utxo, mask, nil
+}
+
+// OpenUtxo decrypts the amount of a utxo sent to this address and recomputes
+// the mask of its commitment. Fails if the utxo belongs to someone else or
+// the encrypted amount doesn't match the commitment
+func (a Address) OpenUtxo(utxo Utxo) (Amount, *edwards25519.Scalar, error) {
+	if !a.CheckDestinationAddress(utxo.Keypair) {
+		return 0, nil, NotOwnUtxoError
+	}
+	aR := new(edwards25519.Point).ScalarMult(a.privKey.a, utxo.Keypair.R)
+	sharedSecret, err := hashPointToScalar(aR)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(utxo.EncryptedAmount) != 8 {
+		return 0, nil, CommitmentMismatchError
+	}
+	amount := Amount(binary.LittleEndian.Uint64(xorAmount(utxo.EncryptedAmount, amountKey(sharedSecret))))
+	mask := commitmentMask(sharedSecret)
+
+	C, err := utxo.CommitmentPoint()
+	if err != nil {
+		return 0, nil, err
+	}
+	if Commit(amount, mask).Equal(C) != 1 {
+		return 0, nil, CommitmentMismatchError
+	}
+	return amount, mask, nil
+}
@@ -0,0 +1,110 @@
+package transaction
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"filippo.io/edwards25519"
+)
+
+func TestOpenUtxo(t *testing.T) {
+	addr, err := NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range []Amount{0, 1, 1_250_000_000, math.MaxUint64} {
+		utxo, mask, err := addr.NewOutput(amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened, openedMask, err := addr.OpenUtxo(*utxo)
+		if err != nil {
+			t.Fatalf("%d: %v", amount, err)
+		}
+		if opened != amount || openedMask.Equal(mask) != 1 {
+			t.Fatalf("expected %d with the output mask, got %d", amount, opened)
+		}
+		C, err := utxo.CommitmentPoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Commit(amount, mask).Equal(C) != 1 {
+			t.Fatalf("%d: commitment doesn't open to the amount", amount)
+		}
+	}
+}
+
+func TestOpenUtxoFails(t *testing.T) {
+	addr, err := NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxo, _, err := addr.NewOutput(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := other.OpenUtxo(*utxo); !errors.Is(err, NotOwnUtxoError) {
+		t.Fatalf("expected %v, got %v", NotOwnUtxoError, err)
+	}
+
+	// The amount decrypts to another value than the commitment hides
+	tampered := *utxo
+	tampered.EncryptedAmount = append([]byte{}, utxo.EncryptedAmount...)
+	tampered.EncryptedAmount[0] ^= 1
+	if _, _, err := addr.OpenUtxo(tampered); !errors.Is(err, CommitmentMismatchError) {
+		t.Fatalf("expected %v, got %v", CommitmentMismatchError, err)
+	}
+	tampered.EncryptedAmount = utxo.EncryptedAmount[:7]
+	if _, _, err := addr.OpenUtxo(tampered); !errors.Is(err, CommitmentMismatchError) {
+		t.Fatalf("expected %v, got %v", CommitmentMismatchError, err)
+	}
+	// A commitment to another amount
+	tampered = *utxo
+	tampered.Commitment = Commit(6, edwards25519.NewScalar()).Bytes()
+	if _, _, err := addr.OpenUtxo(tampered); !errors.Is(err, CommitmentMismatchError) {
+		t.Fatalf("expected %v, got %v", CommitmentMismatchError, err)
+	}
+}
+
+// Commitments add up like the amounts and masks they hide
+func TestCommitHomomorphic(t *testing.T) {
+	x, err := randomScalar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := randomScalar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := new(edwards25519.Point).Add(Commit(2, x), Commit(3, y))
+	if Commit(5, new(edwards25519.Scalar).Add(x, y)).Equal(sum) != 1 {
+		t.Fatal("commitments don't add up")
+	}
+}
+
+// H comes from hashing G, it isn't a small multiple of G or a low order point
+func TestGeneratorH(t *testing.T) {
+	identity := edwards25519.NewIdentityPoint()
+	if H.Equal(identity) == 1 {
+		t.Fatal("H is the identity")
+	}
+	if new(edwards25519.Point).MultByCofactor(H).Equal(identity) == 1 {
+		t.Fatal("H has small order")
+	}
+	if H.Equal(hashToPointTryAndIncrement([]byte("learncoin_pedersen_H"), edwards25519.NewGeneratorPoint().Bytes())) != 1 {
+		t.Fatal("H isn't derived from G")
+	}
+	kG := edwards25519.NewIdentityPoint()
+	negH := new(edwards25519.Point).Negate(H)
+	for k := 1; k <= 10000; k++ {
+		kG.Add(kG, edwards25519.NewGeneratorPoint())
+		if kG.Equal(H) == 1 || kG.Equal(negH) == 1 {
+			t.Fatalf("H is %dG", k)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package transaction
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+// Decoys are picked the way Monero does it (Möser et al. 2018): real inputs
+// are usually young outputs, so the age of a decoy is sampled from the gamma
+// distribution fitted to the log of the age of real spends. Picking decoys
+// uniformly would make the youngest ring member the real one most of the time
+
+const (
+	// Shape and rate of the gamma distribution of log(age in seconds)
+	decoyGammaShape = 19.28
+	decoyGammaRate  = 1.61
+	// Number of newest outputs the average time between outputs is taken over
+	decoySpacingWindow = 10000
+	// Gamma samples tried for a single decoy before falling back to a uniform pick
+	decoyMaxAttempts = 100
+)
+
+var (
+	NotEnoughDecoysError = errors.New("Not enough outputs to pick decoys from")
+	InvalidRingSizeError = errors.New("Ring size has to be at least 2")
+)
+
+// OutputSource gives access to every output decoys can be picked from.
+// Outputs are indexed from the oldest (0) to the newest (NumOutputs-1)
+type OutputSource interface {
+	NumOutputs() int
+	// Output returns the output with the given index and the time it was created
+	Output(int) (Utxo, time.Time, error)
+}
+
+// DecoySelector picks the decoys of ring inputs from an OutputSource. Amounts
+// are hidden in commitments so any output can be a decoy of any other.
+// It isn't safe for concurrent use
+type DecoySelector struct {
+	source   OutputSource
+	ringSize int
+	rng      *rand.Rand
+}
+
+// cryptoSource is a rand.Source64 reading from crypto/rand. Predictable
+// decoys would give the real input away, and every output of a seeded
+// generator follows from the ones before it
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var buf [8]byte
+	if _, err := crand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+func (s cryptoSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// Seed does nothing, the source can't be seeded
+func (cryptoSource) Seed(int64) {}
+
+func NewDecoySelector(source OutputSource, ringSize int) (*DecoySelector, error) {
+	if ringSize < 2 {
+		return nil, InvalidRingSizeError
+	}
+	return &DecoySelector{
+		source:   source,
+		ringSize: ringSize,
+		rng:      rand.New(cryptoSource{}),
+	}, nil
+}
+
+func (d *DecoySelector) RingSize() int {
+	return d.ringSize
+}
+
+// SelectDecoys returns RingSize-1 distinct decoys for the real utxo. None of
+// them is the real utxo itself
+func (d *DecoySelector) SelectDecoys(real Utxo) ([]Utxo, error) {
+	n := d.source.NumOutputs()
+	if n < d.ringSize {
+		return nil, NotEnoughDecoysError
+	}
+	realHash, err := real.Hash()
+	if err != nil {
+		return nil, err
+	}
+	spacing, err := d.outputSpacing(n)
+	if err != nil {
+		return nil, err
+	}
+
+	picked := map[crypto.FixedHash]struct{}{realHash.ToFixedHash(): {}}
+	decoys := make([]Utxo, 0, d.ringSize-1)
+	tried := make(map[int]struct{})
+	for len(decoys) < d.ringSize-1 {
+		// Every output was tried, the real one must have been among them
+		if len(tried) == n {
+			return nil, NotEnoughDecoysError
+		}
+		i := d.pickIndex(n, spacing)
+		if _, ok := tried[i]; ok {
+			continue
+		}
+		tried[i] = struct{}{}
+		utxo, _, err := d.source.Output(i)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := utxo.Hash()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := picked[hash.ToFixedHash()]; ok {
+			continue
+		}
+		picked[hash.ToFixedHash()] = struct{}{}
+		decoys = append(decoys, utxo)
+	}
+	return decoys, nil
+}
+
+// outputSpacing returns the average time between the newest outputs. Ages
+// are measured from the newest output
+func (d *DecoySelector) outputSpacing(n int) (time.Duration, error) {
+	_, newest, err := d.source.Output(n - 1)
+	if err != nil {
+		return 0, err
+	}
+	window := decoySpacingWindow
+	if window > n-1 {
+		window = n - 1
+	}
+	_, oldest, err := d.source.Output(n - 1 - window)
+	if err != nil {
+		return 0, err
+	}
+	spacing := newest.Sub(oldest) / time.Duration(window)
+	if spacing <= 0 {
+		spacing = time.Second
+	}
+	return spacing, nil
+}
+
+// pickIndex samples the index of an output by its age. Ages older than the
+// oldest output are resampled and if that keeps happening (e.g. the outputs
+// are only a few hours old) the index is picked uniformly
+func (d *DecoySelector) pickIndex(n int, spacing time.Duration) int {
+	for i := 0; i < decoyMaxAttempts; i++ {
+		age := math.Exp(d.gamma(decoyGammaShape) / decoyGammaRate)
+		back := age / spacing.Seconds()
+		if back < float64(n) {
+			return n - 1 - int(back)
+		}
+	}
+	return d.rng.Intn(n)
+}
+
+// gamma samples the gamma distribution with the given shape (> 1) and scale 1
+// with the method of Marsaglia and Tsang
+func (d *DecoySelector) gamma(shape float64) float64 {
+	dd := shape - 1.0/3
+	c := 1 / math.Sqrt(9*dd)
+	for {
+		x := d.rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := d.rng.Float64()
+		if math.Log(u) < x*x/2+dd-dd*v+dd*math.Log(v) {
+			return dd * v
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package transaction
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testSource holds outputs created two minutes apart, of which only the
+// oldest mature ones are exposed like the chain does
+type testSource struct {
+	outputs []Utxo
+	mature  int
+}
+
+func (s *testSource) NumOutputs() int {
+	return s.mature
+}
+
+func (s *testSource) Output(i int) (Utxo, time.Time, error) {
+	if i < 0 || i >= len(s.outputs) {
+		return Utxo{}, time.Time{}, errors.New("Unknown output")
+	}
+	return s.outputs[i], time.Unix(1700000000, 0).Add(time.Duration(i) * 2 * time.Minute), nil
+}
+
+func newTestSource(t *testing.T, n, mature int) *testSource {
+	t.Helper()
+	addr, err := NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &testSource{mature: mature}
+	for i := 0; i < n; i++ {
+		out, _, err := addr.NewOutput(Amount(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		source.outputs = append(source.outputs, *out)
+	}
+	return source
+}
+
+// indexOf returns the index of the output in the source
+func (s *testSource) indexOf(t *testing.T, utxo Utxo) int {
+	t.Helper()
+	hash, err := utxo.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, out := range s.outputs {
+		other, err := out.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash.String() == other.String() {
+			return i
+		}
+	}
+	t.Fatal("decoy isn't an output of the source")
+	return -1
+}
+
+// Decoys are distinct mature outputs other than the real one
+func TestSelectDecoys(t *testing.T) {
+	source := newTestSource(t, 30, 20)
+	real := source.outputs[10]
+	selector, err := NewDecoySelector(source, benchmarkRingSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 200; round++ {
+		decoys, err := selector.SelectDecoys(real)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoys) != benchmarkRingSize-1 {
+			t.Fatalf("expected %d decoys, got %d", benchmarkRingSize-1, len(decoys))
+		}
+		picked := make(map[int]bool)
+		for _, decoy := range decoys {
+			i := source.indexOf(t, decoy)
+			if i >= source.mature {
+				t.Fatalf("picked immature output %d", i)
+			}
+			if i == 10 {
+				t.Fatal("picked the real output")
+			}
+			if picked[i] {
+				t.Fatalf("picked output %d twice", i)
+			}
+			picked[i] = true
+		}
+	}
+}
+
+// An output listed twice is still picked once, and never if it's the real one
+func TestSelectDecoysDuplicateOutputs(t *testing.T) {
+	source := newTestSource(t, 8, 8)
+	real := source.outputs[0]
+	source.outputs[7] = real
+	source.outputs[6] = source.outputs[5]
+	selector, err := NewDecoySelector(source, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 50; round++ {
+		decoys, err := selector.SelectDecoys(real)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked := make(map[int]bool)
+		for _, decoy := range decoys {
+			i := source.indexOf(t, decoy)
+			if i == 0 {
+				t.Fatal("picked the real output")
+			}
+			if picked[i] {
+				t.Fatalf("picked output %d twice", i)
+			}
+			picked[i] = true
+		}
+	}
+}
+
+func TestSelectDecoysNotEnough(t *testing.T) {
+	if _, err := NewDecoySelector(newTestSource(t, 0, 0), 1); !errors.Is(err, InvalidRingSizeError) {
+		t.Fatalf("expected %v, got %v", InvalidRingSizeError, err)
+	}
+
+	// Fewer mature outputs than ring members
+	source := newTestSource(t, 10, 5)
+	selector, err := NewDecoySelector(source, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := selector.SelectDecoys(source.outputs[0]); !errors.Is(err, NotEnoughDecoysError) {
+		t.Fatalf("expected %v, got %v", NotEnoughDecoysError, err)
+	}
+
+	// Enough outputs, but the real one and a duplicate leave too few decoys
+	source = newTestSource(t, 6, 6)
+	source.outputs[5] = source.outputs[4]
+	selector, err = NewDecoySelector(source, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := selector.SelectDecoys(source.outputs[0]); !errors.Is(err, NotEnoughDecoysError) {
+		t.Fatalf("expected %v, got %v", NotEnoughDecoysError, err)
+	}
+}
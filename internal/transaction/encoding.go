@@ -0,0 +1,219 @@
+package transaction
+
+import (
+	"errors"
+
+	"filippo.io/edwards25519"
+	"github.com/timcki/learncoin/internal/codec"
+)
+
+// Canonical binary encoding of transactions, see the codec package for the
+// primitives. Hashes and signatures are computed over it so it must never
+// change for a given version, a new layout needs a new version
+//
+//	utxo:        P (32) | R (32) | commitment (32) | encrypted amount (8)
+//	signature:   version (1) | image (32) | C (elements) | R (elements) | has D (1) [| D (32)]
+//	input:       ring offsets (count, varints) | pseudo output (32) | signature
+//	range proof: present (1) [| A | S | T1 | T2 | tau_x | mu | t (32 each) | L, R (elements) | a' | b' (32 each)]
+//	transaction: version (1) | inputs (count, input) | outputs (count, utxo) | range proof | fee (varint) | to P (32) | to R (32)
+//
+// The signature message is the transaction encoded without the signatures
+
+const (
+	TransactionEncodingVersion uint8 = 1
+	// Size of the encrypted amount of a utxo
+	encryptedAmountSize = 8
+)
+
+var InvalidPointError = errors.New("Encoded point isn't a valid point")
+
+func encodeAddress(w *codec.Writer, a OneTimeAddress) {
+	if a.P == nil || a.R == nil {
+		w.Fail(InvalidPointError)
+		return
+	}
+	w.Element(a.P.Bytes())
+	w.Element(a.R.Bytes())
+}
+
+func decodeAddress(r *codec.Reader) OneTimeAddress {
+	var a OneTimeAddress
+	P, R := r.Point(), r.Point()
+	if r.Err() != nil {
+		return a
+	}
+	// The reader made sure both are valid points
+	a.P, _ = edwards25519.NewIdentityPoint().SetBytes(P)
+	a.R, _ = edwards25519.NewIdentityPoint().SetBytes(R)
+	return a
+}
+
+func (utxo Utxo) encode(w *codec.Writer) {
+	encodeAddress(w, utxo.Keypair)
+	w.Element(utxo.Commitment)
+	if len(utxo.EncryptedAmount) != encryptedAmountSize {
+		w.Fail(InvalidAmountError)
+		return
+	}
+	w.Fixed(utxo.EncryptedAmount)
+}
+
+func (utxo *Utxo) decode(r *codec.Reader) {
+	utxo.Keypair = decodeAddress(r)
+	utxo.Commitment = r.Point()
+	utxo.EncryptedAmount = r.Fixed(encryptedAmountSize)
+}
+
+func (utxo Utxo) MarshalBinary() ([]byte, error) {
+	w := new(codec.Writer)
+	utxo.encode(w)
+	return w.Result()
+}
+
+func (utxo *Utxo) UnmarshalBinary(data []byte) error {
+	r := codec.NewReader(data)
+	utxo.decode(r)
+	return r.Finish()
+}
+
+func (ringSig RingSignature) encode(w *codec.Writer) {
+	w.Byte(ringSig.Version)
+	w.Element(ringSig.Image)
+	w.Elements(ringSig.C)
+	w.Elements(ringSig.R)
+	if len(ringSig.D) == 0 {
+		w.Byte(0)
+	} else {
+		w.Byte(1)
+		w.Element(ringSig.D)
+	}
+}
+
+func (ringSig *RingSignature) decode(r *codec.Reader) {
+	ringSig.Version = r.Byte()
+	ringSig.Image = r.Point()
+	ringSig.C = r.Scalars()
+	ringSig.R = r.Scalars()
+	switch r.Byte() {
+	case 0:
+		ringSig.D = nil
+	case 1:
+		ringSig.D = r.Point()
+	default:
+		r.Fail(codec.NonCanonicalError)
+	}
+}
+
+func (ringSig RingSignature) MarshalBinary() ([]byte, error) {
+	w := new(codec.Writer)
+	ringSig.encode(w)
+	return w.Result()
+}
+
+func (ringSig *RingSignature) UnmarshalBinary(data []byte) error {
+	r := codec.NewReader(data)
+	ringSig.decode(r)
+	return r.Finish()
+}
+
+func (p RangeProof) empty() bool {
+	return p.A == nil && p.S == nil && p.T1 == nil && p.T2 == nil && p.TauX == nil && p.Mu == nil &&
+		p.T == nil && len(p.L) == 0 && len(p.R) == 0 && p.APrime == nil && p.BPrime == nil
+}
+
+func (p RangeProof) encode(w *codec.Writer) {
+	// Transactions without outputs to prove, like the genesis allocation, have no proof
+	if p.empty() {
+		w.Byte(0)
+		return
+	}
+	w.Byte(1)
+	for _, e := range [][]byte{p.A, p.S, p.T1, p.T2, p.TauX, p.Mu, p.T} {
+		w.Element(e)
+	}
+	w.Elements(p.L)
+	w.Elements(p.R)
+	w.Element(p.APrime)
+	w.Element(p.BPrime)
+}
+
+func (p *RangeProof) decode(r *codec.Reader) {
+	switch r.Byte() {
+	case 0:
+		*p = RangeProof{}
+		return
+	case 1:
+	default:
+		r.Fail(codec.NonCanonicalError)
+		return
+	}
+	for _, e := range []*[]byte{&p.A, &p.S, &p.T1, &p.T2} {
+		*e = r.Point()
+	}
+	for _, e := range []*[]byte{&p.TauX, &p.Mu, &p.T} {
+		*e = r.Scalar()
+	}
+	p.L = r.Points()
+	p.R = r.Points()
+	p.APrime = r.Scalar()
+	p.BPrime = r.Scalar()
+}
+
+// encode writes the transaction, leaving out the signatures if withSignatures is false
+func (t Transaction) encode(w *codec.Writer, withSignatures bool) {
+	w.Byte(TransactionEncodingVersion)
+	w.Uvarint(uint64(len(t.Inputs)))
+	for _, in := range t.Inputs {
+		w.Uvarint(uint64(len(in.RingOffsets)))
+		for _, offset := range in.RingOffsets {
+			w.Uvarint(offset)
+		}
+		w.Element(in.PseudoOutput)
+		if withSignatures {
+			in.Signature.encode(w)
+		}
+	}
+	w.Uvarint(uint64(len(t.UtxosOut)))
+	for _, utxo := range t.UtxosOut {
+		utxo.encode(w)
+	}
+	t.RangeProof.encode(w)
+	w.Uvarint(uint64(t.Fee))
+	encodeAddress(w, t.To)
+}
+
+func (t *Transaction) decode(r *codec.Reader) {
+	if r.Byte() != TransactionEncodingVersion {
+		r.Fail(codec.UnsupportedVersionError)
+		return
+	}
+	t.Inputs = make([]TxInput, r.Count(1))
+	for i := range t.Inputs {
+		in := &t.Inputs[i]
+		in.RingOffsets = make([]uint64, r.Count(1))
+		for j := range in.RingOffsets {
+			in.RingOffsets[j] = r.Uvarint()
+		}
+		in.PseudoOutput = r.Point()
+		in.Signature.decode(r)
+	}
+	t.UtxosOut = make([]Utxo, r.Count(1))
+	for i := range t.UtxosOut {
+		t.UtxosOut[i].decode(r)
+	}
+	t.RangeProof.decode(r)
+	t.Fee = Amount(r.Uvarint())
+	t.To = decodeAddress(r)
+}
+
+func (t Transaction) MarshalBinary() ([]byte, error) {
+	w := new(codec.Writer)
+	t.encode(w, true)
+	return w.Result()
+}
+
+func (t *Transaction) UnmarshalBinary(data []byte) error {
+	r := codec.NewReader(data)
+	t.decode(r)
+	return r.Finish()
+}
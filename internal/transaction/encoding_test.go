@@ -0,0 +1,63 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding"
+	"testing"
+)
+
+// fuzzRoundTrip checks that every encoding the value decodes from is the
+// canonical one i.e. encoding the decoded value gives the same bytes
+func fuzzRoundTrip(t *testing.T, data []byte, value interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}) {
+	if err := value.UnmarshalBinary(data); err != nil {
+		return
+	}
+	encoded, err := value.MarshalBinary()
+	if err != nil {
+		t.Fatalf("decoded value can't be encoded: %v", err)
+	}
+	if !bytes.Equal(encoded, data) {
+		t.Fatalf("%x re-encoded as %x", data, encoded)
+	}
+}
+
+func FuzzDecodeTransaction(f *testing.F) {
+	txn := newTestTransactions(f, 1)[0]
+	data, err := txn.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzRoundTrip(t, data, new(Transaction))
+	})
+}
+
+func FuzzDecodeUtxo(f *testing.F) {
+	txn := newTestTransactions(f, 1)[0]
+	for _, utxo := range txn.UtxosOut {
+		data, err := utxo.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzRoundTrip(t, data, new(Utxo))
+	})
+}
+
+func FuzzDecodeRingSignature(f *testing.F) {
+	txn := newTestTransactions(f, 1)[0]
+	data, err := txn.Inputs[0].Signature.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzRoundTrip(t, data, new(RingSignature))
+	})
+}
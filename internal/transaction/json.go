@@ -0,0 +1,301 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"filippo.io/edwards25519"
+	"github.com/timcki/learncoin/internal/crypto"
+)
+
+// JSON representation of transactions used by tools to save, inspect and
+// resubmit them. Points, scalars and other byte strings are lowercase hex,
+// amounts are integers of atomic units. Ring members aren't part of it, they
+// get resolved from the ring offsets like with the binary encoding
+//
+//	address:     {"p": hex, "r": hex}
+//	utxo:        {"hash": hex, "address": address, "commitment": hex, "encrypted_amount": hex}
+//	signature:   {"version": int, "image": hex, "c": [hex], "r": [hex], "d": hex}
+//	input:       {"ring_offsets": [int], "pseudo_output": hex, "signature": signature}
+//	range proof: {"a", "s", "t1", "t2", "tau_x", "mu", "t": hex, "l", "r": [hex], "a_prime", "b_prime": hex}
+//	transaction: {"hash": hex, "inputs": [input], "outputs": [utxo], "range_proof": range proof, "fee": int, "to": address}
+//
+// Hashes are only informative. They're left out if the value can't be hashed
+// and decoding fails if they don't match the decoded value. "d" is left out
+// for LSAG signatures and "range_proof" for transactions without one
+
+var HashMismatchError = errors.New("Hash doesn't match the decoded value")
+
+// hexBytes is a byte string encoded as hex
+type hexBytes []byte
+
+func (h hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+func (h *hexBytes) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*h = data
+	return nil
+}
+
+func toHexList(list [][]byte) []hexBytes {
+	res := make([]hexBytes, len(list))
+	for i, b := range list {
+		res[i] = b
+	}
+	return res
+}
+
+func fromHexList(list []hexBytes) [][]byte {
+	if list == nil {
+		return nil
+	}
+	res := make([][]byte, len(list))
+	for i, b := range list {
+		res[i] = b
+	}
+	return res
+}
+
+// checkCanonical decodes the binary encoding of the value, which rejects the
+// points and scalars that aren't canonically encoded. In JSON they would give
+// the same value another hash
+func checkCanonical(value encoding.BinaryMarshaler, decoder encoding.BinaryUnmarshaler) error {
+	data, err := value.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return decoder.UnmarshalBinary(data)
+}
+
+// checkHash compares the hash decoded from JSON with the hash of the value
+func checkHash(decoded hexBytes, hash func() (crypto.Hash, error)) error {
+	if decoded == nil {
+		return nil
+	}
+	h, err := hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(h, decoded) {
+		return HashMismatchError
+	}
+	return nil
+}
+
+type addressJSON struct {
+	P hexBytes `json:"p"`
+	R hexBytes `json:"r"`
+}
+
+func (a OneTimeAddress) MarshalJSON() ([]byte, error) {
+	if a.P == nil || a.R == nil {
+		return nil, InvalidPointError
+	}
+	return json.Marshal(addressJSON{P: a.P.Bytes(), R: a.R.Bytes()})
+}
+
+func (a *OneTimeAddress) UnmarshalJSON(data []byte) error {
+	var v addressJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	P, err := edwards25519.NewIdentityPoint().SetBytes(v.P)
+	if err != nil {
+		return InvalidPointError
+	}
+	R, err := edwards25519.NewIdentityPoint().SetBytes(v.R)
+	if err != nil {
+		return InvalidPointError
+	}
+	a.P, a.R = P, R
+	return nil
+}
+
+type utxoJSON struct {
+	Hash            hexBytes       `json:"hash,omitempty"`
+	Address         OneTimeAddress `json:"address"`
+	Commitment      hexBytes       `json:"commitment"`
+	EncryptedAmount hexBytes       `json:"encrypted_amount"`
+}
+
+func (utxo Utxo) MarshalJSON() ([]byte, error) {
+	v := utxoJSON{
+		Address:         utxo.Keypair,
+		Commitment:      utxo.Commitment,
+		EncryptedAmount: utxo.EncryptedAmount,
+	}
+	if hash, err := utxo.Hash(); err == nil {
+		v.Hash = hexBytes(hash)
+	}
+	return json.Marshal(v)
+}
+
+func (utxo *Utxo) UnmarshalJSON(data []byte) error {
+	var v utxoJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	res := Utxo{
+		Keypair:         v.Address,
+		Commitment:      v.Commitment,
+		EncryptedAmount: v.EncryptedAmount,
+	}
+	if err := checkCanonical(res, new(Utxo)); err != nil {
+		return err
+	}
+	if err := checkHash(v.Hash, res.Hash); err != nil {
+		return err
+	}
+	*utxo = res
+	return nil
+}
+
+type ringSignatureJSON struct {
+	Version uint8      `json:"version"`
+	Image   hexBytes   `json:"image"`
+	C       []hexBytes `json:"c"`
+	R       []hexBytes `json:"r"`
+	D       hexBytes   `json:"d,omitempty"`
+}
+
+func (ringSig RingSignature) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ringSignatureJSON{
+		Version: ringSig.Version,
+		Image:   ringSig.Image,
+		C:       toHexList(ringSig.C),
+		R:       toHexList(ringSig.R),
+		D:       ringSig.D,
+	})
+}
+
+func (ringSig *RingSignature) UnmarshalJSON(data []byte) error {
+	var v ringSignatureJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*ringSig = RingSignature{
+		Version: v.Version,
+		Image:   v.Image,
+		C:       fromHexList(v.C),
+		R:       fromHexList(v.R),
+		D:       v.D,
+	}
+	return nil
+}
+
+type txInputJSON struct {
+	RingOffsets  []uint64      `json:"ring_offsets"`
+	PseudoOutput hexBytes      `json:"pseudo_output"`
+	Signature    RingSignature `json:"signature"`
+}
+
+func (in TxInput) MarshalJSON() ([]byte, error) {
+	return json.Marshal(txInputJSON{
+		RingOffsets:  in.RingOffsets,
+		PseudoOutput: in.PseudoOutput,
+		Signature:    in.Signature,
+	})
+}
+
+func (in *TxInput) UnmarshalJSON(data []byte) error {
+	var v txInputJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*in = TxInput{
+		RingOffsets:  v.RingOffsets,
+		PseudoOutput: v.PseudoOutput,
+		Signature:    v.Signature,
+	}
+	return nil
+}
+
+type rangeProofJSON struct {
+	A      hexBytes   `json:"a"`
+	S      hexBytes   `json:"s"`
+	T1     hexBytes   `json:"t1"`
+	T2     hexBytes   `json:"t2"`
+	TauX   hexBytes   `json:"tau_x"`
+	Mu     hexBytes   `json:"mu"`
+	T      hexBytes   `json:"t"`
+	L      []hexBytes `json:"l"`
+	R      []hexBytes `json:"r"`
+	APrime hexBytes   `json:"a_prime"`
+	BPrime hexBytes   `json:"b_prime"`
+}
+
+func (p RangeProof) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rangeProofJSON{
+		A: p.A, S: p.S, T1: p.T1, T2: p.T2, TauX: p.TauX, Mu: p.Mu, T: p.T,
+		L: toHexList(p.L), R: toHexList(p.R), APrime: p.APrime, BPrime: p.BPrime,
+	})
+}
+
+func (p *RangeProof) UnmarshalJSON(data []byte) error {
+	var v rangeProofJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = RangeProof{
+		A: v.A, S: v.S, T1: v.T1, T2: v.T2, TauX: v.TauX, Mu: v.Mu, T: v.T,
+		L: fromHexList(v.L), R: fromHexList(v.R), APrime: v.APrime, BPrime: v.BPrime,
+	}
+	return nil
+}
+
+type transactionJSON struct {
+	Hash       hexBytes       `json:"hash,omitempty"`
+	Inputs     []TxInput      `json:"inputs"`
+	Outputs    []Utxo         `json:"outputs"`
+	RangeProof *RangeProof    `json:"range_proof,omitempty"`
+	Fee        Amount         `json:"fee"`
+	To         OneTimeAddress `json:"to"`
+}
+
+func (t Transaction) MarshalJSON() ([]byte, error) {
+	v := transactionJSON{
+		Inputs:  t.Inputs,
+		Outputs: t.UtxosOut,
+		Fee:     t.Fee,
+		To:      t.To,
+	}
+	if !t.RangeProof.empty() {
+		v.RangeProof = &t.RangeProof
+	}
+	if hash, err := t.Hash(); err == nil {
+		v.Hash = hexBytes(hash)
+	}
+	return json.Marshal(v)
+}
+
+func (t *Transaction) UnmarshalJSON(data []byte) error {
+	var v transactionJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	res := Transaction{
+		Inputs:   v.Inputs,
+		UtxosOut: v.Outputs,
+		Fee:      v.Fee,
+		To:       v.To,
+	}
+	if v.RangeProof != nil {
+		res.RangeProof = *v.RangeProof
+	}
+	if err := checkCanonical(res, new(Transaction)); err != nil {
+		return err
+	}
+	if err := checkHash(v.Hash, res.Hash); err != nil {
+		return err
+	}
+	*t = res
+	return nil
+}
@@ -0,0 +1,110 @@
+package transaction
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+// Rings don't carry copies of their members. Every output of the chain has a
+// global output number and an input references its ring members by those
+// numbers in ascending order, the first one absolute and every other one
+// relative to the previous member. The offsets are small numbers so they
+// compress well, and verifiers look the members up in their own output index
+// instead of trusting keys sent along with the transaction
+
+var (
+	InvalidRingOffsetsError  = errors.New("Ring offsets don't reference distinct outputs")
+	DuplicateRingMemberError = errors.New("Ring contains the same output twice")
+)
+
+// OutputIndexer returns the global output number of an output
+type OutputIndexer interface {
+	OutputIndexOf(Utxo) (uint64, error)
+}
+
+// EncodeRingOffsets converts the ascending output numbers to ring offsets
+func EncodeRingOffsets(indices []uint64) []uint64 {
+	offsets := make([]uint64, len(indices))
+	for i, index := range indices {
+		if i == 0 {
+			offsets[i] = index
+		} else {
+			offsets[i] = index - indices[i-1]
+		}
+	}
+	return offsets
+}
+
+// DecodeRingOffsets converts ring offsets back to output numbers. Every offset
+// after the first has to be positive so the members are distinct
+func DecodeRingOffsets(offsets []uint64) ([]uint64, error) {
+	if len(offsets) == 0 {
+		return nil, InvalidRingOffsetsError
+	}
+	indices := make([]uint64, len(offsets))
+	for i, offset := range offsets {
+		if i == 0 {
+			indices[i] = offset
+			continue
+		}
+		if offset == 0 || indices[i-1]+offset < indices[i-1] {
+			return nil, InvalidRingOffsetsError
+		}
+		indices[i] = indices[i-1] + offset
+	}
+	return indices, nil
+}
+
+// newRing orders the real utxo and its decoys by their output numbers, which
+// hides the position of the real one, and returns the ring with its offsets
+func newRing(real Utxo, decoys []Utxo, indexer OutputIndexer) ([]Utxo, []uint64, error) {
+	type member struct {
+		utxo  Utxo
+		index uint64
+	}
+	members := make([]member, 0, len(decoys)+1)
+	for _, utxo := range append([]Utxo{real}, decoys...) {
+		index, err := indexer.OutputIndexOf(utxo)
+		if err != nil {
+			return nil, nil, err
+		}
+		members = append(members, member{utxo: utxo, index: index})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].index < members[j].index })
+
+	ring := make([]Utxo, len(members))
+	indices := make([]uint64, len(members))
+	for i, m := range members {
+		if i > 0 && m.index == indices[i-1] {
+			return nil, nil, DuplicateRingMemberError
+		}
+		ring[i] = m.utxo
+		indices[i] = m.index
+	}
+	return ring, EncodeRingOffsets(indices), nil
+}
+
+// SetRing sets the resolved ring members of the input and its signature
+func (in *TxInput) SetRing(ring []Utxo) {
+	in.Ring = ring
+	in.Signature.Utxos = ring
+}
+
+// ringPosition returns the position of the utxo in the ring
+func ringPosition(ring []Utxo, utxo Utxo) (int, error) {
+	hash, err := utxo.Hash()
+	if err != nil {
+		return 0, err
+	}
+	for i, member := range ring {
+		h, err := member.Hash()
+		if err != nil {
+			return 0, err
+		}
+		if bytes.Equal(h, hash) {
+			return i, nil
+		}
+	}
+	return 0, MismatchedInputsError
+}
@@ -2,22 +2,41 @@ package transaction
 
 import (
 	"bytes"
-	"fmt"
+	"errors"
 
 	"filippo.io/edwards25519"
 	"github.com/timcki/learncoin/internal/crypto"
 	"github.com/timcki/learncoin/internal/utility"
 )
 
+// Versions of the ring signature scheme, verifiers dispatch on them
+const (
+	// LSAG style signature with a challenge for every ring member
+	LSAGSignatureVersion uint8 = iota
+	// Compact CLSAG signature binding the pseudo output of the input
+	CLSAGSignatureVersion
+	// Same schemes with the key image base Hp(P) computed by HashToPoint
+	// instead of the legacy HashPoint. LSAG doesn't bind a pseudo output
+	// so it's only used to sign messages, never transaction inputs
+	LSAGV2SignatureVersion
+	CLSAGV2SignatureVersion
+)
+
+var InvalidSignatureError = errors.New("Ring signature is invalid")
+
 type RingSignature struct {
-	// Message for which the ring sig is computed
-	Utxos []Utxo
+	Version uint8
+	// Ring members the signature is computed for. Like the ring of the
+	// input they aren't serialized
+	Utxos []Utxo `json:"-"`
 	// Key image in byte representation
 	Image []byte
-	// Challenges in byte representation
+	// Challenges in byte representation. CLSAG only keeps the first one
 	C [][]byte
 	// Responses in byte representation
 	R [][]byte
+	// Commitment key image D = zHp(P), CLSAG only
+	D []byte
 }
 
 func KeyImage(addr Address, dest OneTimeAddress) (x *edwards25519.Scalar, img *edwards25519.Point) {
@@ -26,7 +45,7 @@ func KeyImage(addr Address, dest OneTimeAddress) (x *edwards25519.Scalar, img *e
 	if x, err = addr.ComputePrivateKey(dest); err != nil {
 		panic(err)
 	}
-	img = new(edwards25519.Point).ScalarMult(x, HashPoint(dest.P))
+	img = new(edwards25519.Point).ScalarMult(x, HashToPoint(dest.P))
 	return
 }
 
@@ -96,7 +115,7 @@ func (a Address) NewRingSignature(realTxn Utxo, decoyTxns []Utxo, message []byte
 	R := make([]*edwards25519.Point, n)
 	for i := 0; i < n; i++ {
 		R[i] = new(edwards25519.Point).Add(
-			new(edwards25519.Point).ScalarMult(q[i], HashPoint(txns[i].Keypair.P)),
+			new(edwards25519.Point).ScalarMult(q[i], HashToPoint(txns[i].Keypair.P)),
 			new(edwards25519.Point).ScalarMult(w[i], I),
 		)
 	}
@@ -134,8 +153,9 @@ func (a Address) NewRingSignature(realTxn Utxo, decoyTxns []Utxo, message []byte
 		}
 	}
 	return RingSignature{
-		Utxos: txns,
-		Image: I.Bytes(),
+		Version: LSAGV2SignatureVersion,
+		Utxos:   txns,
+		Image:   I.Bytes(),
 		// Convert scalar/point values to []byte
 		C: func() [][]byte {
 			ret := make([][]byte, n)
@@ -179,38 +199,71 @@ func (ringSig RingSignature) ImageToPoint() (*edwards25519.Point, error) {
 	return edwards25519.NewIdentityPoint().SetBytes(ringSig.Image)
 }
 
-func (ringSig RingSignature) CheckSignatureValidity(message []byte) bool {
+// Legacy checks if the signature uses the legacy key image base Hs(P)P. The
+// key images of the same output differ between legacy and current signatures
+// so both can't be accepted at the same time without allowing double spends
+func (ringSig RingSignature) Legacy() bool {
+	return ringSig.Version == LSAGSignatureVersion || ringSig.Version == CLSAGSignatureVersion
+}
+
+// keyImageBase returns the hash to point used by the version of the signature
+func (ringSig RingSignature) keyImageBase() func(*edwards25519.Point) *edwards25519.Point {
+	if ringSig.Legacy() {
+		return HashPoint
+	}
+	return HashToPoint
+}
+
+// Verify checks the signature of a transaction input with the pseudo output
+// of the input. LSAG signatures don't bind the pseudo output so they are never
+// valid here, use CheckSignatureValidity for them
+func (ringSig RingSignature) Verify(message, pseudoOutput []byte) bool {
+	switch ringSig.Version {
+	case CLSAGSignatureVersion, CLSAGV2SignatureVersion:
+		return ringSig.checkCLSAG(message, pseudoOutput)
+	default:
+		return false
+	}
+}
+
+// CheckSignatureValidity checks an LSAG signature of the message, it returns
+// nil if the signature is valid
+func (ringSig RingSignature) CheckSignatureValidity(message []byte) error {
+	if ringSig.Version != LSAGSignatureVersion && ringSig.Version != LSAGV2SignatureVersion {
+		return InvalidSignatureError
+	}
+	hashPoint := ringSig.keyImageBase()
+	if len(ringSig.C) != len(ringSig.Utxos) || len(ringSig.R) != len(ringSig.Utxos) {
+		return InvalidSignatureError
+	}
 	// Parse from byte values
 	c, r, err := ringSig.CRToScalars()
 	if err != nil {
-		fmt.Println(err)
-		return false
+		return err
 	}
 	I, err := ringSig.ImageToPoint()
 	if err != nil {
-		fmt.Println(err)
-		return false
+		return err
 	}
 	// Prepare L, R arrays and scalar for sum of c values
 	L, R := make([]*edwards25519.Point, len(c)), make([]*edwards25519.Point, len(c))
 	sumCi := edwards25519.NewScalar()
 	for i := 0; i < len(c); i++ {
-		L[i] = edwards25519.NewIdentityPoint().Add(
-			edwards25519.NewIdentityPoint().ScalarBaseMult(r[i]),
-			edwards25519.NewIdentityPoint().ScalarMult(c[i], ringSig.Utxos[i].Keypair.P),
-		)
-		R[i] = edwards25519.NewIdentityPoint().Add(
-			edwards25519.NewIdentityPoint().ScalarMult(r[i], HashPoint(ringSig.Utxos[i].Keypair.P)),
-			edwards25519.NewIdentityPoint().ScalarMult(c[i], I),
+		// Everything here is public so the variable time multiplications are fine
+		L[i] = new(edwards25519.Point).VarTimeDoubleScalarBaseMult(c[i], ringSig.Utxos[i].Keypair.P, r[i])
+		R[i] = new(edwards25519.Point).VarTimeMultiScalarMult(
+			[]*edwards25519.Scalar{r[i], c[i]},
+			[]*edwards25519.Point{hashPoint(ringSig.Utxos[i].Keypair.P), I},
 		)
 		sumCi = edwards25519.NewScalar().Add(sumCi, c[i])
 	}
 
 	challenge, err := ComputeChallenge(message, L, R)
 	if err != nil {
-		fmt.Println(err)
-		return false
+		return err
 	}
-
-	return challenge.Equal(sumCi) == 1
+	if challenge.Equal(sumCi) != 1 {
+		return InvalidSignatureError
+	}
+	return nil
 }
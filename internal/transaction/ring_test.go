@@ -0,0 +1,84 @@
+package transaction
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestRingOffsetsRoundTrip(t *testing.T) {
+	for _, indices := range [][]uint64{
+		{0},
+		{7},
+		{3, 5, 100, 101},
+		{0, math.MaxUint64},
+	} {
+		decoded, err := DecodeRingOffsets(EncodeRingOffsets(indices))
+		if err != nil {
+			t.Fatalf("%v: %v", indices, err)
+		}
+		if !reflect.DeepEqual(decoded, indices) {
+			t.Fatalf("expected %v, got %v", indices, decoded)
+		}
+	}
+	if offsets := EncodeRingOffsets([]uint64{3, 5, 100}); !reflect.DeepEqual(offsets, []uint64{3, 2, 95}) {
+		t.Fatalf("expected relative offsets, got %v", offsets)
+	}
+}
+
+// Only ascending distinct output numbers survive the round trip
+func TestRingOffsetsInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		offsets []uint64
+	}{
+		{"empty", nil},
+		{"duplicate", EncodeRingOffsets([]uint64{3, 3})},
+		{"unsorted", EncodeRingOffsets([]uint64{5, 3})},
+		{"overflow", []uint64{math.MaxUint64, 1}},
+		{"overflow later", []uint64{1, math.MaxUint64 - 1, 1}},
+	} {
+		if _, err := DecodeRingOffsets(test.offsets); !errors.Is(err, InvalidRingOffsetsError) {
+			t.Fatalf("%s: expected %v, got %v", test.name, InvalidRingOffsetsError, err)
+		}
+	}
+}
+
+// Members are ordered by their output numbers whatever the position of the
+// real one, and the same output can't be in the ring twice
+func TestNewRing(t *testing.T) {
+	addr, err := NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := make([]Utxo, 4)
+	indexer := &testIndexer{}
+	for i := range outputs {
+		out, _, err := addr.NewOutput(Amount(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs[i] = *out
+		if _, err := indexer.OutputIndexOf(*out); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ring, offsets, err := newRing(outputs[2], []Utxo{outputs[3], outputs[0], outputs[1]}, indexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(offsets, []uint64{0, 1, 1, 1}) {
+		t.Fatalf("expected offsets of outputs 0 to 3, got %v", offsets)
+	}
+	for i := range ring {
+		if position, err := ringPosition(ring, outputs[i]); err != nil || position != i {
+			t.Fatalf("expected output %d at %d, got %d", i, i, position)
+		}
+	}
+
+	if _, _, err := newRing(outputs[2], []Utxo{outputs[0], outputs[2]}, indexer); !errors.Is(err, DuplicateRingMemberError) {
+		t.Fatalf("expected %v, got %v", DuplicateRingMemberError, err)
+	}
+}
@@ -5,54 +5,122 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"filippo.io/edwards25519"
+
 	//"github.com/TylerBrock/colorjson"
+	"github.com/timcki/learncoin/internal/codec"
 	"github.com/timcki/learncoin/internal/crypto"
 )
 
 // Address is a mock structure for representing addresses
 // TODO: Implement valid addresses
 
-// Utxo represents an unspent transaction output that's used in actual transactions to move value between addresses
+// Utxo represents an unspent transaction output that's used in actual transactions to move value between addresses.
+// The amount is hidden in a Pedersen commitment and only readable by the recipient
 
 type Utxo struct {
 	hash    crypto.Hash
-	Amount  float32
 	Keypair OneTimeAddress
+	// Commitment C = xG + aH to the amount a in byte representation
+	Commitment []byte
+	// Amount encrypted with the shared secret of the one time address
+	EncryptedAmount []byte
+}
+
+// TxInput is a single ring input of a transaction. The real utxo being spent
+// is hidden among the decoys of its ring
+type TxInput struct {
+	// Global output numbers of the ring members as offsets, see EncodeRingOffsets
+	RingOffsets []uint64
+	// Ring members in the order of the offsets. They aren't serialized, the
+	// chain resolves them from the offsets
+	Ring []Utxo `json:"-"`
+	// Commitment to the amount of the real input with a fresh mask
+	// so it can't be matched with any of the ring members
+	PseudoOutput []byte
+	Signature    RingSignature
 }
 
-// Transaction represents a transaction in the learncoin network. It has one ring input and returns either a single output
-// or the output and change back to the origin address
+// Transaction represents a transaction in the learncoin network. It spends one or more ring inputs and returns
+// either a single output or the output and change back to the origin address
 type Transaction struct {
-	UtxosIn  []Utxo
+	Inputs   []TxInput
 	UtxosOut []Utxo
-	To       OneTimeAddress
-	Sigature RingSignature
+	// Aggregated proof that every output amount is in range
+	RangeProof RangeProof
+	// The fee is public so it can be checked against the commitments
+	Fee Amount
+	To  OneTimeAddress
+
+	// Masks of the pseudo outputs, only known to the creator of the txn
+	pseudoMasks []*edwards25519.Scalar
 }
 
-// CheckValidity performs checks making sure that the txn is valid
+// CheckValidity performs checks making sure that the txn is valid i.e. its
+// commitments balance: sum(pseudo outputs) - sum(output commitments) - fee*H = 0.
+// The CLSAG signatures of the inputs prove the pseudo outputs commit to the
+// amounts of the real inputs
 func (t Transaction) CheckValidity() bool {
-	var sumIn float32 = t.UtxosIn[0].Amount
-	var sumOut float32 = 0
-	// check if all amounts are >0
-	for _, utxo := range t.UtxosIn {
-		// Check if all inputs in ring sig have the same amount
-		if utxo.Amount < 0 || utxo.Amount != sumIn {
+	if len(t.Inputs) == 0 || len(t.UtxosOut) == 0 {
+		return false
+	}
+	sum := edwards25519.NewIdentityPoint()
+	for _, in := range t.Inputs {
+		if len(in.RingOffsets) == 0 {
+			return false
+		}
+		pseudo, err := edwards25519.NewIdentityPoint().SetBytes(in.PseudoOutput)
+		if err != nil {
 			return false
 		}
+		sum.Add(sum, pseudo)
 	}
 	for _, utxo := range t.UtxosOut {
-		if utxo.Amount < 0 {
+		C, err := utxo.CommitmentPoint()
+		if err != nil {
 			return false
 		}
-		sumOut += utxo.Amount
+		sum.Subtract(sum, C)
+	}
+	sum.Subtract(sum, Commit(t.Fee, edwards25519.NewScalar()))
+	return sum.Equal(edwards25519.NewIdentityPoint()) == 1
+}
+
+// KeyImages returns the key images of all inputs of the transaction
+func (t Transaction) KeyImages() [][]byte {
+	images := make([][]byte, len(t.Inputs))
+	for i, in := range t.Inputs {
+		images[i] = in.Signature.Image
+	}
+	return images
+}
+
+// CheckRangeProof verifies the range proof covers the output commitments
+// in order. Without it the outputs could commit to "negative" amounts
+func (t Transaction) CheckRangeProof() bool {
+	commitments, err := t.outputCommitments()
+	if err != nil {
+		return false
 	}
-	return sumIn == sumOut
+	return t.RangeProof.Verify(commitments)
 }
 
+func (t Transaction) outputCommitments() ([]*edwards25519.Point, error) {
+	commitments := make([]*edwards25519.Point, len(t.UtxosOut))
+	for i, utxo := range t.UtxosOut {
+		C, err := utxo.CommitmentPoint()
+		if err != nil {
+			return nil, err
+		}
+		commitments[i] = C
+	}
+	return commitments, nil
+}
+
+// Bytes returns the canonical encoding of the utxo or nil if it's malformed
 func (utxo Utxo) Bytes() []byte {
-	buffer := new(bytes.Buffer)
-	json.NewEncoder(buffer).Encode(utxo)
-	return buffer.Bytes()
+	data, _ := utxo.MarshalBinary()
+	return data
 }
 
 func (utxo Utxo) CheckValidity() bool {
@@ -67,38 +135,36 @@ func (utxo Utxo) Hash() (crypto.Hash, error) {
 	if len(utxo.hash) != 0 {
 		return utxo.hash, nil
 	}
-	var buf bytes.Buffer
-	amt := []byte(fmt.Sprintf("%x", utxo.Amount))
-	buf.Write(amt)
-	buf.Write(utxo.Keypair.P.Bytes())
-	buf.Write(utxo.Keypair.R.Bytes())
-
-	return crypto.HashData(buf.Bytes())
+	data, err := utxo.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return crypto.HashData(data)
 }
 
-// NewUtxo returns
-func NewUtxo(amount float32, keypair OneTimeAddress) *Utxo {
-	utxo := Utxo{
-		Amount:  amount,
-		Keypair: keypair,
-	}
-	hash, err := utxo.Hash()
+// CommitmentPoint parses the amount commitment of the utxo
+func (utxo Utxo) CommitmentPoint() (*edwards25519.Point, error) {
+	C, err := edwards25519.NewIdentityPoint().SetBytes(utxo.Commitment)
 	if err != nil {
-		panic(err)
+		return nil, InvalidCommitmentError
 	}
-	utxo.hash = hash
-	return &utxo
+	return C, nil
 }
 
-// Used for testing purposes
-
-// I'm choosing the default json encoder for encoding. It increases interoperability
-// while lossing out on space. This is a reference design.
-// In case of a problem it's also abstracted away so easy to change
+// Bytes returns the canonical encoding of the transaction or nil if it's malformed
 func (t Transaction) Bytes() []byte {
-	buffer := new(bytes.Buffer)
-	json.NewEncoder(buffer).Encode(t)
-	return buffer.Bytes()
+	data, _ := t.MarshalBinary()
+	return data
+}
+
+// SignatureMessage returns the message signed by the ring signatures of the
+// transaction i.e. its canonical encoding without the signatures. It's nil
+// if the transaction is malformed
+func (t Transaction) SignatureMessage() []byte {
+	w := new(codec.Writer)
+	t.encode(w, false)
+	data, _ := w.Result()
+	return data
 }
 
 func (t Transaction) PrettyPrint() string {
@@ -109,10 +175,11 @@ func (t Transaction) PrettyPrint() string {
 	return string(res)
 }
 
+// Hash is the hash of the canonical encoding of the transaction
 func (t Transaction) Hash() (crypto.Hash, error) {
-	if h, err := crypto.HashData(t.Bytes()); err != nil {
+	data, err := t.MarshalBinary()
+	if err != nil {
 		return nil, err
-	} else {
-		return h, nil
 	}
+	return crypto.HashData(data)
 }
@@ -5,8 +5,12 @@ import (
 
 	"filippo.io/edwards25519"
 	"github.com/timcki/learncoin/internal/crypto"
+	"github.com/timcki/learncoin/internal/crypto/ed25519"
 )
 
+// Domain separation tag of the hash to point used for key images
+var keyImageDST = []byte("learncoin-V01-CS02-with-edwards25519_XMD:SHA-512_ELL2_RO_")
+
 /*
 func toBytes[T edwards25519.Point | edwards25519.Scalar](arr []*T) [][]byte {
 	res := make([][]byte, len(arr))
@@ -39,10 +43,23 @@ func hashPointToScalar(point *edwards25519.Point) (*edwards25519.Scalar, error)
 	return edwards25519.NewScalar().SetBytesWithClamping(rBytes)
 }
 
+// HashPoint computes the legacy key image base Hs(P)P. It's a known multiple
+// of P so it's only kept to verify legacy signatures, use HashToPoint instead
 func HashPoint(p *edwards25519.Point) *edwards25519.Point {
 	// Compute sha256 of point and convert it to scalar with clamping -> deterministic
 	x, _ := hashPointToScalar(p)
-	return edwards25519.NewIdentityPoint().ScalarMult(x, p)
+	// Both x and P are public so variable time is fine
+	return new(edwards25519.Point).VarTimeDoubleScalarBaseMult(x, p, edwards25519.NewScalar())
+}
+
+// HashToPoint computes the key image base Hp(P) by hashing P to the curve,
+// so nobody knows its discrete logarithm with respect to P
+func HashToPoint(p *edwards25519.Point) *edwards25519.Point {
+	point, err := ed25519.HashToCurve(p.Bytes(), keyImageDST)
+	if err != nil {
+		panic(err)
+	}
+	return point
 }
 
 func randomScalar() (priv *edwards25519.Scalar, err error) {
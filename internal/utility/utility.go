@@ -10,10 +10,12 @@ import (
 func ShuffleAndAdd[T any](addition T, array []T) (pos int, res []T) {
 	// Seed the random function
 	rand.Seed(time.Now().UnixNano())
-	// Shuffle incoming array to get more uniform txn distribution
+	// Shuffle a copy of the incoming array to get more uniform txn distribution
+	// without reordering the slice owned by the caller
+	array = append([]T{}, array...)
 	rand.Shuffle(len(array), func(i, j int) { array[i], array[j] = array[j], array[i] })
 	// Randomly choose the position of the true txn
-	pos = rand.Intn(len(array))
+	pos = rand.Intn(len(array) + 1)
 
 	// Add the txn to the required position in the array
 	res = append(res, array[:pos]...)